@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+)
+
+// backend is one of the forward target addresses with its own health state.
+type backend struct {
+	addr   string
+	weight int
+
+	mu          sync.Mutex
+	unhealthy   bool
+	lastErr     error
+	failures    int
+	activeConns int
+	// currentWeight is the smooth weighted round robin state
+	currentWeight int
+}
+
+func newBackends(targets []agentapi.Target) []*backend {
+	var result []*backend
+	for _, target := range targets {
+		weight := target.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		result = append(result, &backend{addr: target.Addr, weight: weight})
+	}
+	return result
+}
+
+func (b *backend) info() agentapi.Backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	item := agentapi.Backend{
+		Addr:              b.addr,
+		Weight:            b.weight,
+		State:             agentapi.ForwarderStateHealthy,
+		ActiveConnections: b.activeConns,
+	}
+	if b.unhealthy {
+		item.State = agentapi.ForwarderStateDegraded
+	}
+	if b.lastErr != nil {
+		item.Error = b.lastErr.Error()
+	}
+	return item
+}
+
+func (b *backend) healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.unhealthy
+}
+
+// recordCheck records a health check result and returns whether health state changed.
+func (b *backend) recordCheck(err error, failureThreshold int) (changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasUnhealthy := b.unhealthy
+	if err != nil {
+		b.failures++
+		if b.failures >= failureThreshold {
+			b.unhealthy = true
+			b.lastErr = err
+		}
+	} else {
+		b.failures = 0
+		b.unhealthy = false
+		b.lastErr = nil
+	}
+	return wasUnhealthy != b.unhealthy
+}
+
+func (b *backend) connOpened() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.activeConns++
+}
+
+func (b *backend) connections() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.activeConns
+}
+
+func (b *backend) connClosed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.activeConns--
+}
+
+// balancer orders backends to dial for a new connection following the balance strategy.
+type balancer struct {
+	strategy string
+
+	mu       sync.Mutex
+	backends []*backend
+}
+
+func newBalancer(strategy string, targets []agentapi.Target) *balancer {
+	return &balancer{strategy: strategy, backends: newBackends(targets)}
+}
+
+// list returns current backends.
+func (l *balancer) list() []*backend {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.backends
+}
+
+// setTargets replaces backends with given targets, backends of addresses already known keep their health state.
+func (l *balancer) setTargets(targets []agentapi.Target) (changed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current := map[string]*backend{}
+	for _, b := range l.backends {
+		current[b.addr] = b
+	}
+
+	var result []*backend
+	for _, b := range newBackends(targets) {
+		if existing, ok := current[b.addr]; ok && existing.weight == b.weight {
+			b = existing
+		}
+		result = append(result, b)
+	}
+
+	changed = len(result) != len(l.backends)
+	for idx := 0; !changed && idx < len(result); idx++ {
+		changed = result[idx] != l.backends[idx]
+	}
+	l.backends = result
+	return changed
+}
+
+// candidates returns healthy backends in the order they should be dialed for a connection from clientAddr.
+func (l *balancer) candidates(clientAddr string) []*backend {
+	var healthy []*backend
+	for _, b := range l.list() {
+		if b.healthy() {
+			healthy = append(healthy, b)
+		}
+	}
+
+	if len(healthy) <= 1 {
+		return healthy
+	}
+
+	switch l.strategy {
+	case agentapi.BalanceRoundRobin:
+		return moveFirst(healthy, l.nextWeighted(healthy))
+	case agentapi.BalanceLeastConnections:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].connections() < healthy[j].connections()
+		})
+		return healthy
+	case agentapi.BalanceSticky:
+		// NOTE: Hash the host only, every connection of a client comes from a different port
+		host, _, err := net.SplitHostPort(clientAddr)
+		if err != nil {
+			host = clientAddr
+		}
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(host))
+		start := int(hash.Sum32() % uint32(len(healthy)))
+		return append(append([]*backend{}, healthy[start:]...), healthy[:start]...)
+	default:
+		return healthy
+	}
+}
+
+// moveFirst returns backends with first moved to the front.
+func moveFirst(backends []*backend, first *backend) []*backend {
+	result := []*backend{first}
+	for _, b := range backends {
+		if b != first {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+// nextWeighted picks a backend using smooth weighted round robin (as nginx does).
+func (l *balancer) nextWeighted(backends []*backend) *backend {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	total := 0
+	var best *backend
+	for _, b := range backends {
+		b.currentWeight += b.weight
+		total += b.weight
+		if best == nil || b.currentWeight > best.currentWeight {
+			best = b
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// healthErr returns an error when every backend is unhealthy, nil otherwise.
+func (l *balancer) healthErr() error {
+	backends := l.list()
+	if len(backends) == 0 {
+		return fmt.Errorf("no target address resolved")
+	}
+
+	var lastErr error
+	for _, b := range backends {
+		b.mu.Lock()
+		unhealthy, err := b.unhealthy, b.lastErr
+		b.mu.Unlock()
+		if !unhealthy {
+			return nil
+		}
+		lastErr = err
+	}
+
+	if len(backends) == 1 {
+		return lastErr
+	}
+	return fmt.Errorf("all %d targets are unhealthy, last error: %w", len(backends), lastErr)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func addrs(backends []*backend) []string {
+	var result []string
+	for _, b := range backends {
+		result = append(result, b.addr)
+	}
+	return result
+}
+
+func Test_BalancerCandidates(t *testing.T) {
+	targets := []agentapi.Target{{Addr: "a:1"}, {Addr: "b:1"}, {Addr: "c:1"}}
+
+	tests := []struct {
+		Name     string
+		Strategy string
+		Targets  []agentapi.Target
+		// Unhealthy backends are skipped, Connections are active connections by backend.
+		Unhealthy   []string
+		Connections map[string]int
+		ClientAddrs []string
+		// Expected holds the first candidate of each client address.
+		Expected []string
+	}{
+		{
+			Name:        "failover keeps order",
+			Strategy:    agentapi.BalanceFailover,
+			Targets:     targets,
+			ClientAddrs: []string{"127.0.0.1:1000", "127.0.0.1:1001"},
+			Expected:    []string{"a:1", "a:1"},
+		},
+		{
+			Name:        "failover skips unhealthy",
+			Strategy:    agentapi.BalanceFailover,
+			Targets:     targets,
+			Unhealthy:   []string{"a:1"},
+			ClientAddrs: []string{"127.0.0.1:1000"},
+			Expected:    []string{"b:1"},
+		},
+		{
+			Name:        "round robin",
+			Strategy:    agentapi.BalanceRoundRobin,
+			Targets:     targets,
+			ClientAddrs: []string{"127.0.0.1:1000", "127.0.0.1:1001", "127.0.0.1:1002", "127.0.0.1:1003"},
+			Expected:    []string{"a:1", "b:1", "c:1", "a:1"},
+		},
+		{
+			Name:        "weighted round robin",
+			Strategy:    agentapi.BalanceRoundRobin,
+			Targets:     []agentapi.Target{{Addr: "a:1", Weight: 2}, {Addr: "b:1"}},
+			ClientAddrs: []string{"127.0.0.1:1000", "127.0.0.1:1001", "127.0.0.1:1002", "127.0.0.1:1003"},
+			Expected:    []string{"a:1", "b:1", "a:1", "a:1"},
+		},
+		{
+			Name:        "least connections",
+			Strategy:    agentapi.BalanceLeastConnections,
+			Targets:     targets,
+			Connections: map[string]int{"a:1": 3, "b:1": 1, "c:1": 2},
+			ClientAddrs: []string{"127.0.0.1:1000"},
+			Expected:    []string{"b:1"},
+		},
+		{
+			Name:        "sticky ignores client port",
+			Strategy:    agentapi.BalanceSticky,
+			Targets:     targets,
+			ClientAddrs: []string{"192.168.1.20:1000", "192.168.1.20:1001", "192.168.1.20:1002"},
+			Expected:    []string{"a:1", "a:1", "a:1"},
+		},
+		{
+			Name:        "sticky spreads clients",
+			Strategy:    agentapi.BalanceSticky,
+			Targets:     targets,
+			ClientAddrs: []string{"192.168.1.20:1000", "192.168.1.21:1000", "192.168.1.23:1000"},
+			Expected:    []string{"a:1", "b:1", "c:1"},
+		},
+		{
+			Name:        "sticky skips unhealthy",
+			Strategy:    agentapi.BalanceSticky,
+			Targets:     targets,
+			Unhealthy:   []string{"c:1"},
+			ClientAddrs: []string{"192.168.1.20:1000", "192.168.1.21:1000"},
+			Expected:    []string{"b:1", "a:1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			l := newBalancer(tt.Strategy, tt.Targets)
+			for _, b := range l.list() {
+				for _, addr := range tt.Unhealthy {
+					if b.addr == addr {
+						b.recordCheck(errors.New("connection refused"), 1)
+					}
+				}
+				for i := 0; i < tt.Connections[b.addr]; i++ {
+					b.connOpened()
+				}
+			}
+
+			var first []string
+			for _, clientAddr := range tt.ClientAddrs {
+				candidates := l.candidates(clientAddr)
+				assert.Len(t, candidates, len(tt.Targets)-len(tt.Unhealthy))
+				first = append(first, candidates[0].addr)
+			}
+			assert.Equal(t, tt.Expected, first)
+		})
+	}
+}
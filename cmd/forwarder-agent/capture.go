@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+)
+
+// captureHub fans out capture records of a forwarder to the api clients capturing it.
+type captureHub struct {
+	// active is the number of subscribers, checked on the copy path so that nothing is copied while nobody captures
+	active atomic.Int32
+
+	mu          sync.Mutex
+	subscribers map[chan agentapi.CaptureRecord]*int
+}
+
+func (h *captureHub) subscribe() chan agentapi.CaptureRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subscribers == nil {
+		h.subscribers = map[chan agentapi.CaptureRecord]*int{}
+	}
+	ch := make(chan agentapi.CaptureRecord, 1024)
+	h.subscribers[ch] = new(int)
+	h.active.Add(1)
+	return ch
+}
+
+func (h *captureHub) unsubscribe(ch chan agentapi.CaptureRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		h.active.Add(-1)
+	}
+}
+
+func (h *captureHub) capturing() bool {
+	return h.active.Load() > 0
+}
+
+// record sends record to every subscriber without blocking the connection,
+// records are dropped for subscribers too slow to keep up and the count is reported on their next record.
+func (h *captureHub) record(record agentapi.CaptureRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	record.Time = time.Now()
+	for ch, dropped := range h.subscribers {
+		record.Dropped = *dropped
+		select {
+		case ch <- record:
+			*dropped = 0
+		default:
+			*dropped++
+		}
+	}
+}
+
+// connCapture records the traffic of a single forwarded connection.
+type connCapture struct {
+	hub        *captureHub
+	connID     uint64
+	clientAddr string
+	targetAddr string
+}
+
+func (c *connCapture) record(recordType, direction string, data []byte) {
+	if c == nil || !c.hub.capturing() {
+		return
+	}
+
+	record := agentapi.CaptureRecord{
+		Type:       recordType,
+		ConnID:     c.connID,
+		ClientAddr: c.clientAddr,
+		TargetAddr: c.targetAddr,
+		Direction:  direction,
+	}
+	if len(data) > 0 {
+		// NOTE: data is the copy buffer, which is reused for the next read
+		record.Data = append([]byte(nil), data...)
+	}
+	c.hub.record(record)
+}
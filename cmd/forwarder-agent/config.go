@@ -1,29 +1,38 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"strings"
-)
 
-type forwarderConfig struct {
-	SourceAddr string
-	TargetAddr string
-}
+	"github.com/abdularis/kportfwd/internal/agentapi"
+)
 
-func newForwarderConfig(configStr string) (forwarderConfig, error) {
+func newForwarderConfig(configStr string) (agentapi.ForwardSpec, error) {
 	splits := strings.Split(configStr, "->")
 	if len(splits) < 2 {
-		return forwarderConfig{}, fmt.Errorf("invalid forward config format: %s", configStr)
+		return agentapi.ForwardSpec{}, fmt.Errorf("invalid forward config format: %s", configStr)
 	}
 
-	return forwarderConfig{
+	return agentapi.ForwardSpec{
 		SourceAddr: strings.TrimSpace(splits[0]),
 		TargetAddr: strings.TrimSpace(splits[1]),
 	}, nil
 }
 
-func parseForwarderConfigList(forwardConfigStringList []string) ([]forwarderConfig, error) {
-	var result []forwarderConfig
+// parseForwarderSpec parses forward spec given as JSON by kportfwd.
+func parseForwarderSpec(specStr string) (agentapi.ForwardSpec, error) {
+	var spec agentapi.ForwardSpec
+	if err := json.Unmarshal([]byte(specStr), &spec); err != nil {
+		return agentapi.ForwardSpec{}, fmt.Errorf("invalid forward spec: %w", err)
+	}
+	return spec, nil
+}
+
+// parseForwarderConfigList returns forward specs of -address and -forward arguments followed by specs.
+func parseForwarderConfigList(forwardConfigStringList []string, forwardSpecList []string, specs []agentapi.ForwardSpec) ([]agentapi.ForwardSpec, error) {
+	var result []agentapi.ForwardSpec
 	for idx, item := range forwardConfigStringList {
 		cfg, err := newForwarderConfig(item)
 		if err != nil {
@@ -31,5 +40,40 @@ func parseForwarderConfigList(forwardConfigStringList []string) ([]forwarderConf
 		}
 		result = append(result, cfg)
 	}
+
+	for idx, item := range forwardSpecList {
+		spec, err := parseForwarderSpec(item)
+		if err != nil {
+			return nil, fmt.Errorf("forward spec err[%d]: %w", idx, err)
+		}
+		result = append(result, spec)
+	}
+	result = append(result, specs...)
+
+	for idx := range result {
+		sourceAddr, err := defaultLoopbackHost(result[idx].SourceAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source address %s: %w", result[idx].SourceAddr, err)
+		}
+		result[idx].SourceAddr = sourceAddr
+
+		if err := result[idx].Validate(); err != nil {
+			return nil, fmt.Errorf("forward %s: %w", result[idx].Redact(result[idx].TargetAddr), err)
+		}
+		result[idx].HealthCheck = result[idx].HealthCheck.WithDefaults()
+	}
 	return result, nil
 }
+
+// defaultLoopbackHost binds source address without host to 127.0.0.1,
+// listeners are only reached through kubernetes port forward so they don't need to be exposed on pod network.
+func defaultLoopbackHost(sourceAddr string) (string, error) {
+	host, port, err := net.SplitHostPort(sourceAddr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
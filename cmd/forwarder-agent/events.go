@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/abdularis/kportfwd/internal/log"
+)
+
+// outputBufferSize is the number of events waiting to be written to the output before new ones are dropped.
+const outputBufferSize = 256
+
+// outputFlushTimeout is how long events still buffered are given to be written by close.
+const outputFlushTimeout = time.Second
+
+// eventEmitter writes agent events as JSON lines to its output and fans them out to api subscribers.
+// The output is the stdout of the kportfwd session that started the agent, which outlives it: it's written
+// by its own goroutine, events are dropped while it's blocked and it's no longer written after an error.
+type eventEmitter struct {
+	mu          sync.Mutex
+	output      chan agentapi.Event
+	outputDone  chan struct{}
+	closed      bool
+	subscribers map[chan agentapi.Event]struct{}
+}
+
+func newEventEmitter(output io.Writer) *eventEmitter {
+	e := &eventEmitter{
+		output:      make(chan agentapi.Event, outputBufferSize),
+		outputDone:  make(chan struct{}),
+		subscribers: map[chan agentapi.Event]struct{}{},
+	}
+	go e.writeOutput(output)
+	return e
+}
+
+func (e *eventEmitter) writeOutput(output io.Writer) {
+	defer close(e.outputDone)
+
+	encoder := json.NewEncoder(output)
+	for event := range e.output {
+		if err := encoder.Encode(event); err != nil {
+			// NOTE: The session reading events is gone, further events are only streamed to api subscribers
+			log.Warnf("unable to write event %s, events output disabled: %s", event.Type, err)
+			return
+		}
+	}
+}
+
+func (e *eventEmitter) emit(event agentapi.Event) {
+	event.Version = agentapi.EventVersion
+	event.Time = time.Now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.closed {
+		select {
+		case e.output <- event:
+		default:
+			// NOTE: Output blocked or disabled, drop the event rather than blocking forwarders
+		}
+	}
+
+	for ch := range e.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// NOTE: Slow subscriber, drop the event rather than blocking forwarders
+		}
+	}
+}
+
+// close writes events still buffered to the output for up to outputFlushTimeout, further events are only
+// streamed to api subscribers.
+func (e *eventEmitter) close() {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.output)
+	}
+	e.mu.Unlock()
+
+	timer := time.NewTimer(outputFlushTimeout)
+	defer timer.Stop()
+	select {
+	case <-e.outputDone:
+	case <-timer.C:
+	}
+}
+
+func (e *eventEmitter) subscribe() chan agentapi.Event {
+	ch := make(chan agentapi.Event, 64)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (e *eventEmitter) unsubscribe(ch chan agentapi.Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.subscribers[ch]; ok {
+		delete(e.subscribers, ch)
+		close(ch)
+	}
+}
+
+// closeSubscribers ends every subscription, used on shutdown so streaming api requests return.
+func (e *eventEmitter) closeSubscribers() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch := range e.subscribers {
+		delete(e.subscribers, ch)
+		close(ch)
+	}
+}
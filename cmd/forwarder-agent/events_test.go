@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingWriter fails every write, as stdout of a kportfwd session that is gone.
+type failingWriter struct {
+	writes atomic.Int32
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes.Add(1)
+	return 0, errors.New("write |1: broken pipe")
+}
+
+func Test_EventEmitterOutput(t *testing.T) {
+	output := &bytes.Buffer{}
+	events := newEventEmitter(output)
+	events.emit(agentapi.Event{Type: agentapi.EventReady, Session: "s1"})
+	events.emit(agentapi.Event{Type: agentapi.EventShutdown, Reason: "exit"})
+	events.close()
+	// NOTE: Events emitted once closed only go to subscribers
+	events.emit(agentapi.Event{Type: agentapi.EventShutdown})
+
+	decoder := json.NewDecoder(output)
+	var types []string
+	for {
+		var event agentapi.Event
+		if err := decoder.Decode(&event); err != nil {
+			assert.ErrorIs(t, err, io.EOF)
+			break
+		}
+		assert.Equal(t, agentapi.EventVersion, event.Version)
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []string{agentapi.EventReady, agentapi.EventShutdown}, types)
+}
+
+func Test_EventEmitterOutputGone(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Output func(t *testing.T) io.Writer
+	}{
+		{
+			Name:   "failing output",
+			Output: func(t *testing.T) io.Writer { return &failingWriter{} },
+		},
+		{
+			Name: "blocking output",
+			Output: func(t *testing.T) io.Writer {
+				reader, writer := io.Pipe()
+				t.Cleanup(func() { reader.Close() })
+				return writer
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			output := tt.Output(t)
+			events := newEventEmitter(output)
+			ch := events.subscribe()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < outputBufferSize*2; i++ {
+					events.emit(agentapi.Event{Type: agentapi.EventConnectionOpened})
+				}
+				events.emit(agentapi.Event{Type: agentapi.EventConnectionClosed})
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(time.Second * 5):
+				t.Fatal("emit blocked on output")
+			}
+
+			// subscribers keep receiving events
+			var last agentapi.Event
+			for len(ch) > 0 {
+				last = <-ch
+			}
+			assert.Equal(t, agentapi.EventConnectionOpened, last.Type)
+
+			events.emit(agentapi.Event{Type: agentapi.EventShutdown})
+			assert.Equal(t, agentapi.EventShutdown, (<-ch).Type)
+
+			events.close()
+			if w, ok := output.(*failingWriter); ok {
+				// output is no longer written after the first error
+				assert.Equal(t, int32(1), w.writes.Load())
+			}
+		})
+	}
+}
+
+func Test_EventEmitterUnsubscribe(t *testing.T) {
+	events := newEventEmitter(io.Discard)
+	defer events.close()
+
+	first, second := events.subscribe(), events.subscribe()
+	events.emit(agentapi.Event{Type: agentapi.EventReady})
+	assert.Equal(t, agentapi.EventReady, (<-first).Type)
+	assert.Equal(t, agentapi.EventReady, (<-second).Type)
+
+	events.unsubscribe(first)
+	_, open := <-first
+	assert.False(t, open)
+	// NOTE: Unsubscribing twice, e.g. after closeSubscribers, must not close the channel again
+	events.unsubscribe(first)
+
+	events.emit(agentapi.Event{Type: agentapi.EventShutdown})
+	assert.Equal(t, agentapi.EventShutdown, (<-second).Type)
+
+	events.closeSubscribers()
+	_, open = <-second
+	assert.False(t, open)
+}
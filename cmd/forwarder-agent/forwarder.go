@@ -1,26 +1,157 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/abdularis/kportfwd/internal/agentapi"
 	"github.com/abdularis/kportfwd/internal/log"
 )
 
 type tcpForwarder struct {
-	healthCheckInterval time.Duration
-	targetAddr          string
-	sourceAddr          string
-	bufferSize          int
-	lastErr             error
+	spec        agentapi.ForwardSpec
+	name        string
+	healthCheck agentapi.HealthCheck
+	targetAddr  string
+	sourceAddr  string
+	bufferSize  int
+	events      *eventEmitter
+	balancer    *balancer
+	tlsConfig   *tls.Config
+	// healthTLSConfig is the TLS config of https health checks.
+	healthTLSConfig *tls.Config
+
+	maxConnections        int
+	idleTimeout           time.Duration
+	maxConnectionLifetime time.Duration
+	drainTimeout          time.Duration
+	shaping               atomic.Pointer[agentapi.Shaping]
+	captures              captureHub
+	exchanges             httpExchangeLog
+	nextConnID            atomic.Uint64
+
+	// active counts accepted connections, connWg waits for them to finish on shutdown
+	// and closeConns closes the ones still open once drainTimeout is over.
+	active     atomic.Int32
+	connWg     sync.WaitGroup
+	closeConns context.CancelCauseFunc
+
+	// mu guards listenAddr, set once listening and read by the api, and connections.
+	mu          sync.Mutex
+	listenAddr  string
+	connections map[net.Conn]agentapi.Connection
+}
+
+// proxyHeaderTimeout is how long the PROXY protocol header of a new connection is waited for.
+const proxyHeaderTimeout = time.Second * 10
+
+// defaultDrainTimeout is how long active connections are given to finish on shutdown by default.
+const defaultDrainTimeout = time.Second * 5
+
+var (
+	errIdleTimeout           = errors.New("idle timeout")
+	errMaxConnectionLifetime = errors.New("max connection lifetime reached")
+	errDrainTimeout          = errors.New("agent shutdown, drain timeout reached")
+)
+
+func newTCPForwarder(spec agentapi.ForwardSpec, events *eventEmitter) *tcpForwarder {
+	targets := spec.TargetList()
+	if spec.Resolve() {
+		// NOTE: Backends are only known once target hosts are resolved when forwarder starts
+		targets = nil
+	}
+
+	drainTimeout := spec.DrainTimeout
+	if drainTimeout == 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+
+	r := &tcpForwarder{
+		spec:        spec,
+		name:        spec.Name,
+		healthCheck: spec.HealthCheck,
+		targetAddr:  spec.TargetList()[0].Addr,
+		sourceAddr:  spec.SourceAddr,
+		bufferSize:  32 * 1024,
+		events:      events,
+		balancer:    newBalancer(spec.Balance, targets),
+
+		maxConnections:        spec.MaxConnections,
+		idleTimeout:           spec.IdleTimeout,
+		maxConnectionLifetime: spec.MaxConnectionLifetime,
+		drainTimeout:          drainTimeout,
+
+		connections: map[net.Conn]agentapi.Connection{},
+	}
+	r.setShaping(spec.Shaping)
+	return r
+}
+
+// setShaping changes traffic shaping of new and open connections.
+func (r *tcpForwarder) setShaping(shaping agentapi.Shaping) {
+	r.shaping.Store(&shaping)
+}
+
+// listening returns the address the forwarder listens on, empty until it's started.
+func (r *tcpForwarder) listening() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.listenAddr
+}
+
+// info returns forwarder description reported through api and events,
+// backends and connections are only included when detailed is true.
+func (r *tcpForwarder) info(detailed bool) agentapi.Forwarder {
+	item := agentapi.Forwarder{
+		Name:       r.name,
+		TargetAddr: r.spec.Redact(r.targetAddr),
+		SourceAddr: r.listening(),
+		State:      agentapi.ForwarderStateHealthy,
+	}
+	if err := r.balancer.healthErr(); err != nil {
+		item.State = agentapi.ForwarderStateDegraded
+		item.Error = r.spec.Redact(err.Error())
+	}
+
+	if detailed {
+		spec := r.spec.Redacted()
+		item.Spec = &spec
+		item.Shaping = r.shaping.Load()
+		for _, b := range r.balancer.list() {
+			info := b.info()
+			info.Addr, info.Error = r.spec.Redact(info.Addr), r.spec.Redact(info.Error)
+			item.Backends = append(item.Backends, info)
+		}
+
+		r.mu.Lock()
+		for _, conn := range r.connections {
+			conn.Backend = r.spec.Redact(conn.Backend)
+			item.Connections = append(item.Connections, conn)
+		}
+		r.mu.Unlock()
+	}
+	return item
 }
 
 func (r *tcpForwarder) Start(ctx context.Context, readyCh chan struct{}) error {
+	if r.spec.OriginateTLS != nil {
+		tlsConfig, err := newOriginateTLSConfig(*r.spec.OriginateTLS, r.targetAddr)
+		if err != nil {
+			return fmt.Errorf("originate tls: %w", err)
+		}
+		r.tlsConfig = tlsConfig
+	}
+	r.healthTLSConfig = healthCheckTLSConfig(r.healthCheck, r.tlsConfig, r.targetAddr)
+
 	var lc net.ListenConfig
 	listener, err := lc.Listen(ctx, "tcp", r.sourceAddr)
 	if err != nil {
@@ -28,13 +159,26 @@ func (r *tcpForwarder) Start(ctx context.Context, readyCh chan struct{}) error {
 	}
 	defer listener.Close()
 
-	log.Infof("start forwarding %s -> %s", r.sourceAddr, r.targetAddr)
+	// NOTE: sourceAddr might use port 0, keep the actual address so it can be reported back to kportfwd
+	listenAddr := listener.Addr().String()
+	r.mu.Lock()
+	r.listenAddr = listenAddr
+	r.mu.Unlock()
+
+	log.Infof("start forwarding %s -> %s", listenAddr, r.spec.Redact(r.targetAddr))
+	r.emit(agentapi.Event{Type: agentapi.EventForwarderStarted})
 	defer func() {
-		log.Infof("stop forwarding %s -> %s", r.sourceAddr, r.targetAddr)
+		log.Infof("stop forwarding %s -> %s", listenAddr, r.spec.Redact(r.targetAddr))
+		r.emit(agentapi.Event{Type: agentapi.EventForwarderStopped})
 	}()
 
-	ctx, cancel := context.WithCancel(ctx)
-	go r.healthCheckTarget(ctx, cancel)
+	if r.spec.Resolve() {
+		r.resolveBackends(ctx)
+		go r.resolveBackendsPeriodically(ctx)
+	}
+	if r.healthCheck.Mode != agentapi.HealthCheckModeNone {
+		go r.healthCheckTargets(ctx)
+	}
 	go func() {
 		<-ctx.Done()
 		listener.Close()
@@ -44,85 +188,404 @@ func (r *tcpForwarder) Start(ctx context.Context, readyCh chan struct{}) error {
 		go func() { readyCh <- struct{}{} }()
 	}
 
+	// NOTE: Connections outlive ctx, they are drained once the listener is closed
+	connCtx, closeConns := context.WithCancelCause(context.Background())
+	defer closeConns(nil)
+	r.closeConns = closeConns
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			// NOTE: Don't print false-positive errors
 			if ctx.Err() != nil {
+				r.drain()
 				return nil
 			}
 			continue
 		}
 
+		if err := r.balancer.healthErr(); err != nil {
+			r.refuse(conn, fmt.Sprintf("target %s is unhealthy: %s", r.targetAddr, err))
+			continue
+		}
+
+		if r.maxConnections > 0 && int(r.active.Load()) >= r.maxConnections {
+			r.refuse(conn, fmt.Sprintf("max connections reached: %d", r.maxConnections))
+			continue
+		}
+
 		log.Infof("connection established %s -> %s", conn.RemoteAddr(), conn.LocalAddr())
-		go r.forward(ctx, conn)
+		r.active.Add(1)
+		r.connWg.Add(1)
+		go r.forward(connCtx, conn)
 	}
 }
 
-func (r *tcpForwarder) healthCheckTarget(ctx context.Context, cancel context.CancelFunc) {
-	defer cancel()
+// resetConn makes closing conn send a TCP reset instead of a graceful FIN.
+func resetConn(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+}
 
+// drain waits for active connections to finish up to drainTimeout, then closes the remaining ones.
+func (r *tcpForwarder) drain() {
+	done := make(chan struct{})
+	go func() {
+		r.connWg.Wait()
+		close(done)
+	}()
+
+	if active := r.active.Load(); active > 0 {
+		log.Infof("draining %d connections of %s for %s", active, r.listening(), r.drainTimeout)
+	}
+
+	timer := time.NewTimer(r.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Warnf("drain timeout of %s, closing %d connections", r.listening(), r.active.Load())
+		r.closeConns(errDrainTimeout)
+		<-done
+	}
+}
+
+// refuse closes an accepted connection with a TCP reset, reason is reported through logs and events.
+func (r *tcpForwarder) refuse(conn net.Conn, reason string) {
+	resetConn(conn)
+	_ = conn.Close()
+
+	reason = r.spec.Redact(reason)
+	log.Warnf("connection refused %s: %s", conn.RemoteAddr(), reason)
+	r.emit(agentapi.Event{Type: agentapi.EventConnectionClosed, RemoteAddr: conn.RemoteAddr().String(), Reason: reason})
+}
+
+// healthCheckTargets checks every backend periodically following forwarder health check policy,
+// a backend is marked degraded after consecutive failures and healthy again on the first successful check.
+func (r *tcpForwarder) healthCheckTargets(ctx context.Context) {
 	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-timer.C:
-			// NOTE: Dial source to make sure it's alive
-			conn, err := r.dialTarget(ctx)
-			if err != nil {
-				r.lastErr = fmt.Errorf("health check %s err: %s", r.targetAddr, err)
-				log.Errorf(r.lastErr.Error())
-				return
-			}
-			conn.Close()
-			timer.Reset(r.healthCheckInterval)
 		}
+
+		var wg sync.WaitGroup
+		for _, b := range r.balancer.list() {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				r.healthCheckBackend(ctx, b)
+			}(b)
+		}
+		wg.Wait()
+
+		timer.Reset(r.healthCheck.Interval)
 	}
 }
 
-func (r *tcpForwarder) dialTarget(ctx context.Context) (net.Conn, error) {
-	dialer := &net.Dialer{}
-	conn, err := dialer.DialContext(ctx, "tcp", r.targetAddr)
+func (r *tcpForwarder) healthCheckBackend(ctx context.Context, b *backend) {
+	err := checkTarget(ctx, r.healthCheck, b.addr, r.healthTLSConfig)
+	if ctx.Err() != nil {
+		return
+	}
+
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial TCP address: %s: %w", r.targetAddr, err)
+		log.Warnf("%s", r.spec.Redact(fmt.Sprintf("health check %s failed: %s", b.addr, err)))
+		err = fmt.Errorf("health check %s err: %s", b.addr, err)
+	}
+
+	if !b.recordCheck(err, r.healthCheck.FailureThreshold) {
+		return
 	}
 
-	return conn, nil
+	if err != nil {
+		log.Errorf("target degraded: %s", r.spec.Redact(err.Error()))
+		r.emit(agentapi.Event{Type: agentapi.EventHealthCheckFailure, Backend: b.addr, Error: err.Error()})
+	} else {
+		log.Infof("target %s recovered", r.spec.Redact(b.addr))
+		r.emit(agentapi.Event{Type: agentapi.EventHealthCheckRecover, Backend: b.addr})
+	}
+}
+
+func (r *tcpForwarder) resolveBackendsPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(resolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.resolveBackends(ctx)
+	}
+}
+
+// resolveBackends resolves target hosts into backends, previous backends are kept when resolving fails.
+func (r *tcpForwarder) resolveBackends(ctx context.Context) {
+	targets, err := resolveTargets(ctx, net.DefaultResolver.LookupIPAddr, r.spec)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Warnf("%s", r.spec.Redact(fmt.Sprintf("resolve targets of %s failed: %s", r.targetAddr, err)))
+		}
+		return
+	}
+
+	if r.balancer.setTargets(targets) {
+		var addrs []string
+		for _, target := range targets {
+			addrs = append(addrs, target.Addr)
+		}
+		log.Infof("%s", r.spec.Redact(fmt.Sprintf("targets of %s resolved: %s", r.targetAddr, strings.Join(addrs, ", "))))
+	}
+}
+
+func (r *tcpForwarder) emit(event agentapi.Event) {
+	if r.events == nil {
+		return
+	}
+	info := r.info(false)
+	event.Forwarder = &info
+	event.Backend, event.Reason, event.Error = r.spec.Redact(event.Backend), r.spec.Redact(event.Reason), r.spec.Redact(event.Error)
+	r.events.emit(event)
+}
+
+// readClientAddr reads the PROXY protocol header kportfwd writes ahead of the connection data and returns
+// the local client address it carries, empty when unknown.
+func (r *tcpForwarder) readClientAddr(conn net.Conn) (string, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	return agentapi.ReadProxyHeader(conn)
+}
+
+// dialTarget dials healthy backends in balancer order and returns the first connection established.
+func (r *tcpForwarder) dialTarget(ctx context.Context, clientAddr string) (net.Conn, *backend, error) {
+	candidates := r.balancer.candidates(clientAddr)
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("no healthy target available")
+	}
+
+	var errs []error
+	for _, b := range candidates {
+		dialer := &net.Dialer{}
+		conn, err := dialer.DialContext(ctx, "tcp", b.addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to dial TCP address: %s: %w", b.addr, err))
+			continue
+		}
+		if r.tlsConfig != nil {
+			if conn, err = originateTLS(ctx, conn, r.tlsConfig); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		return conn, b, nil
+	}
+
+	return nil, nil, errors.Join(errs...)
 }
 
 func (r *tcpForwarder) forward(ctx context.Context, sourceConn net.Conn) {
+	closeReason := ""
+	backendAddr := ""
 	defer func() {
 		_ = sourceConn.Close()
 		log.Infof("connection closed %s", sourceConn.RemoteAddr())
+		r.emit(agentapi.Event{Type: agentapi.EventConnectionClosed, RemoteAddr: sourceConn.RemoteAddr().String(), Backend: backendAddr, Reason: closeReason})
+		r.active.Add(-1)
+		r.connWg.Done()
 	}()
 
-	targetConn, err := r.dialTarget(ctx)
+	clientAddr := sourceConn.RemoteAddr().String()
+	if r.spec.ProxyProtocol {
+		addr, err := r.readClientAddr(sourceConn)
+		if err != nil {
+			log.Warnf("connection %s: %s", sourceConn.RemoteAddr(), err)
+			closeReason = err.Error()
+			return
+		}
+		if addr != "" {
+			clientAddr = addr
+		}
+	}
+
+	targetConn, b, err := r.dialTarget(ctx, clientAddr)
 	if err != nil {
 		log.Errorf(
 			"could not read from source error: %s",
-			err,
+			r.spec.Redact(err.Error()),
 		)
+		closeReason = err.Error()
 		return
 	}
+	backendAddr = b.addr
+
+	b.connOpened()
+	r.trackConnection(sourceConn, b.addr)
+	defer func() {
+		b.connClosed()
+		r.untrackConnection(sourceConn)
+	}()
+	r.emit(agentapi.Event{Type: agentapi.EventConnectionOpened, RemoteAddr: sourceConn.RemoteAddr().String(), Backend: b.addr})
+
+	capture := &connCapture{
+		hub:        &r.captures,
+		connID:     r.nextConnID.Add(1),
+		clientAddr: clientAddr,
+		targetAddr: r.spec.Redact(targetConn.RemoteAddr().String()),
+	}
+	capture.record(agentapi.CaptureOpen, "", nil)
+	defer capture.record(agentapi.CaptureClose, "", nil)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if r.maxConnectionLifetime > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, r.maxConnectionLifetime, errMaxConnectionLifetime)
+		defer cancelTimeout()
+	}
 
-	copyFn := func(wg *sync.WaitGroup, src net.Conn, dst net.Conn) {
-		defer func() {
-			_ = src.Close()
-			_ = dst.Close()
-			wg.Done()
-		}()
-		if _, err := io.Copy(dst, src); err != nil {
-			if !strings.Contains(err.Error(), "use of closed network connection") {
-				log.Errorf("forward: io copy %s -> %s err: %v", src.RemoteAddr(), dst.RemoteAddr(), err)
+	// NOTE: Closing both connections unblocks the copies on idle timeout, max lifetime, drain timeout or copy error
+	go func() {
+		<-ctx.Done()
+		if errors.Is(context.Cause(ctx), errShapingReset) {
+			resetConn(sourceConn)
+			resetConn(targetConn)
+		}
+		_ = sourceConn.Close()
+		_ = targetConn.Close()
+	}()
+
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+	if r.idleTimeout > 0 {
+		go r.watchIdle(ctx, cancel, &lastActivity)
+	}
+
+	toTarget := &connWriter{Writer: targetConn, lastActivity: &lastActivity, shaping: &r.shaping, capture: capture, direction: agentapi.CaptureToTarget}
+	toClient := &connWriter{Writer: sourceConn, lastActivity: &lastActivity, shaping: &r.shaping, capture: capture, direction: agentapi.CaptureToClient}
+	defer toTarget.stop()
+	defer toClient.stop()
+
+	if r.spec.HTTP != nil {
+		conn := &httpConn{
+			client:       sourceConn,
+			target:       targetConn,
+			clientReader: bufio.NewReaderSize(sourceConn, r.bufferSize),
+			targetReader: bufio.NewReaderSize(targetConn, r.bufferSize),
+			toClient:     toClient,
+			toTarget:     toTarget,
+			connID:       capture.connID,
+			backend:      r.spec.Redact(b.addr),
+		}
+		err := r.forwardHTTP(ctx, cancel, conn)
+		if err == nil {
+			// NOTE: Delayed data must be written before both connections are closed
+			err = errors.Join(toClient.flush(), toTarget.flush())
+		}
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, errShapingReset) {
+				log.Warnf("forward http %s -> %s err: %s", sourceConn.RemoteAddr(), targetConn.RemoteAddr(), err)
 			}
+			cancel(err)
 		}
+	} else {
+		r.pipe(ctx, cancel, sourceConn, targetConn, sourceConn, targetConn, toClient, toTarget)
+	}
+	_ = targetConn.Close()
+
+	if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, context.Canceled) {
+		closeReason = cause.Error()
 	}
+}
 
+// pipe copies both directions of a connection until both are done. Readers are the connections themselves,
+// or buffered readers of them holding data already read.
+func (r *tcpForwarder) pipe(ctx context.Context, cancel context.CancelCauseFunc, clientReader, targetReader io.Reader, client, target net.Conn, toClient, toTarget io.Writer) {
 	var wg sync.WaitGroup
 	wg.Add(2)
-	go copyFn(&wg, sourceConn, targetConn)
-	go copyFn(&wg, targetConn, sourceConn)
-
+	go func() {
+		defer wg.Done()
+		r.copyHalf(ctx, cancel, clientReader, client, target, toTarget)
+	}()
+	go func() {
+		defer wg.Done()
+		r.copyHalf(ctx, cancel, targetReader, target, client, toClient)
+	}()
 	wg.Wait()
 }
+
+// flusher is a writer holding data back, connWriter with shaping latency.
+type flusher interface {
+	flush() error
+}
+
+// copyHalf copies src, read from srcConn, to dstConn through writer until src is done.
+func (r *tcpForwarder) copyHalf(ctx context.Context, cancel context.CancelCauseFunc, src io.Reader, srcConn, dstConn net.Conn, writer io.Writer) {
+	if _, err := io.CopyBuffer(writer, src, make([]byte, r.bufferSize)); err != nil {
+		if ctx.Err() == nil && !errors.Is(err, errShapingReset) && !strings.Contains(err.Error(), "use of closed network connection") {
+			log.Errorf("forward: io copy %s -> %s err: %v", srcConn.RemoteAddr(), dstConn.RemoteAddr(), err)
+		}
+		cancel(err)
+		return
+	}
+
+	if f, ok := writer.(flusher); ok {
+		if err := f.flush(); err != nil {
+			cancel(err)
+			return
+		}
+	}
+
+	// NOTE: src is done sending, propagate the half-close so dst peer reads EOF
+	// while the other direction keeps flowing until it's done as well
+	// tls connections send close_notify before closing the write side
+	closer, ok := dstConn.(interface{ CloseWrite() error })
+	if !ok {
+		cancel(nil)
+		return
+	}
+	if err := closer.CloseWrite(); err != nil {
+		cancel(err)
+	}
+}
+
+// watchIdle cancels the connection once no data went through in either direction for idleTimeout.
+func (r *tcpForwarder) watchIdle(ctx context.Context, cancel context.CancelCauseFunc, lastActivity *atomic.Int64) {
+	ticker := time.NewTicker(r.idleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(time.Unix(0, lastActivity.Load())) >= r.idleTimeout {
+			cancel(errIdleTimeout)
+			return
+		}
+	}
+}
+
+func (r *tcpForwarder) trackConnection(conn net.Conn, backendAddr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connections[conn] = agentapi.Connection{
+		RemoteAddr: conn.RemoteAddr().String(),
+		Backend:    backendAddr,
+		Since:      time.Now(),
+	}
+}
+
+func (r *tcpForwarder) untrackConnection(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.connections, conn)
+}
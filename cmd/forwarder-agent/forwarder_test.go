@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TCPForwarderInfoWhileStarting(t *testing.T) {
+	fwd := newTCPForwarder(agentapi.ForwardSpec{SourceAddr: "127.0.0.1:0", TargetAddr: "127.0.0.1:1", HealthCheck: agentapi.HealthCheck{Mode: agentapi.HealthCheckModeNone}}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	readyCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, fwd.Start(ctx, readyCh))
+	}()
+	// NOTE: The api reports forwarders while they start, run with -race
+	go func() {
+		defer wg.Done()
+		for fwd.info(true).SourceAddr == "" {
+			runtime.Gosched()
+		}
+	}()
+
+	<-readyCh
+	assert.Regexp(t, `^127\.0\.0\.1:\d+$`, fwd.info(false).SourceAddr)
+	cancel()
+	wg.Wait()
+}
+
+func Test_TCPForwarderRedactsSecretValues(t *testing.T) {
+	output := &bytes.Buffer{}
+	fwd := newTCPForwarder(agentapi.ForwardSpec{
+		SourceAddr:   "127.0.0.1:0",
+		TargetAddr:   "db-7f3a.internal:5432",
+		SecretValues: []string{"db-7f3a.internal"},
+	}, newEventEmitter(output))
+
+	info := fwd.info(true)
+	assert.Equal(t, "REDACTED:5432", info.TargetAddr)
+	assert.Equal(t, "REDACTED:5432", info.Spec.TargetAddr)
+	assert.Empty(t, info.Spec.SecretValues)
+	assert.Equal(t, "REDACTED:5432", info.Backends[0].Addr)
+	// NOTE: The forwarder still dials the actual target
+	assert.Equal(t, "db-7f3a.internal:5432", fwd.balancer.list()[0].addr)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	fwd.refuse(server, "target db-7f3a.internal:5432 is unhealthy")
+	fwd.events.close()
+
+	var event agentapi.Event
+	assert.NoError(t, json.Unmarshal(output.Bytes(), &event))
+	assert.Equal(t, "target REDACTED:5432 is unhealthy", event.Reason)
+	assert.Equal(t, "REDACTED:5432", event.Forwarder.TargetAddr)
+	assert.NotContains(t, output.String(), "db-7f3a")
+}
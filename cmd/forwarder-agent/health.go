@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"golang.org/x/net/http2"
+)
+
+// checkTarget runs a single health check against targetAddr following given policy,
+// tlsConfig is used by https checks, see healthCheckTLSConfig.
+func checkTarget(ctx context.Context, policy agentapi.HealthCheck, targetAddr string, tlsConfig *tls.Config) error {
+	ctx, cancel := context.WithTimeout(ctx, policy.Timeout)
+	defer cancel()
+
+	switch policy.Protocol {
+	case agentapi.HealthCheckProtocolHTTP:
+		return checkHTTP(ctx, "http://"+targetAddr+policy.Path, nil)
+	case agentapi.HealthCheckProtocolHTTPS:
+		return checkHTTP(ctx, "https://"+targetAddr+policy.Path, tlsConfig)
+	case agentapi.HealthCheckProtocolPostgres:
+		return checkConn(ctx, targetAddr, checkPostgres)
+	case agentapi.HealthCheckProtocolMySQL:
+		return checkConn(ctx, targetAddr, checkMySQL)
+	case agentapi.HealthCheckProtocolRedis:
+		return checkConn(ctx, targetAddr, checkRedis)
+	case agentapi.HealthCheckProtocolGRPC:
+		return checkGRPC(ctx, targetAddr, policy.Service)
+	default:
+		return checkConn(ctx, targetAddr, nil)
+	}
+}
+
+// checkConn dials targetAddr and runs check on the connection, a nil check only makes sure target accepts TCP.
+func checkConn(ctx context.Context, targetAddr string, check func(conn net.Conn) error) error {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", targetAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if check == nil {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	return check(conn)
+}
+
+// healthCheckTLSConfig returns the TLS config of https checks: the one of the forward when it originates TLS,
+// verifying the host of targetAddr otherwise. Verification is only skipped with policy InsecureSkipVerify.
+func healthCheckTLSConfig(policy agentapi.HealthCheck, forwardTLS *tls.Config, targetAddr string) *tls.Config {
+	var cfg *tls.Config
+	if forwardTLS != nil {
+		cfg = forwardTLS.Clone()
+	} else {
+		// NOTE: Resolved backends are dialed by ip, the certificate is still verified against the target host
+		host, _, _ := net.SplitHostPort(targetAddr)
+		cfg = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+	if policy.InsecureSkipVerify {
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg
+}
+
+func checkHTTP(ctx context.Context, url string, tlsConfig *tls.Config) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("GET %s got status code: %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// checkPostgres sends an SSLRequest, a serving PostgreSQL server answers 'S' or 'N'.
+func checkPostgres(conn net.Conn) error {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], 80877103)
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("postgres ssl request: %w", err)
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return fmt.Errorf("postgres ssl response: %w", err)
+	}
+	if response[0] != 'S' && response[0] != 'N' {
+		return fmt.Errorf("postgres unexpected ssl response: %q", response[0])
+	}
+	return nil
+}
+
+// checkMySQL reads the initial handshake packet sent by the server, protocol version 10 means it's serving.
+func checkMySQL(conn net.Conn) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("mysql handshake: %w", err)
+	}
+
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if length == 0 {
+		return fmt.Errorf("mysql handshake: empty packet")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return fmt.Errorf("mysql handshake: %w", err)
+	}
+
+	switch payload[0] {
+	case 0x0a:
+		return nil
+	case 0xff:
+		// NOTE: Error packet: 0xff, 2 bytes error code, message
+		if len(payload) >= 3 {
+			return fmt.Errorf("mysql error %d: %s", binary.LittleEndian.Uint16(payload[1:3]), payload[3:])
+		}
+		return fmt.Errorf("mysql error packet")
+	default:
+		return fmt.Errorf("mysql unexpected protocol version: %d", payload[0])
+	}
+}
+
+// checkRedis sends PING, a server requiring authentication is still considered serving.
+func checkRedis(conn net.Conn) error {
+	if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+		return fmt.Errorf("redis ping: %w", err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("redis ping response: %w", err)
+	}
+	line = strings.TrimSpace(line)
+	if line == "+PONG" || strings.HasPrefix(line, "-NOAUTH") {
+		return nil
+	}
+	return fmt.Errorf("redis ping response: %s", line)
+}
+
+// grpcCheckClient speaks plaintext HTTP/2 (h2c) to the target.
+var grpcCheckClient = &http.Client{
+	Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			dialer := &net.Dialer{}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	},
+}
+
+// grpcHealthServing is grpc.health.v1.HealthCheckResponse.ServingStatus SERVING.
+const grpcHealthServing = 1
+
+// checkGRPC calls grpc.health.v1.Health/Check, protobuf messages are encoded by hand to keep the agent small.
+func checkGRPC(ctx context.Context, targetAddr, service string) error {
+	// HealthCheckRequest{service: field 1, string}
+	var message []byte
+	if service != "" {
+		message = append([]byte{0x0a}, binary.AppendUvarint(nil, uint64(len(service)))...)
+		message = append(message, service...)
+	}
+
+	body := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(body[1:5], uint32(len(message)))
+	body = append(body, message...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+targetAddr+"/grpc.health.v1.Health/Check", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := grpcCheckClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("grpc health response: %w", err)
+	}
+
+	grpcStatus := resp.Trailer.Get("Grpc-Status")
+	if grpcStatus == "" {
+		// NOTE: Trailers-only response puts status in headers
+		grpcStatus = resp.Header.Get("Grpc-Status")
+	}
+	if grpcStatus != "0" {
+		return fmt.Errorf("grpc health check status %s: %s", grpcStatus, resp.Trailer.Get("Grpc-Message"))
+	}
+
+	// HealthCheckResponse{status: field 1, varint}
+	if len(data) < 5 {
+		return fmt.Errorf("grpc health response too short")
+	}
+	message = data[5:]
+	status := uint64(0)
+	if len(message) >= 2 && message[0] == 0x08 {
+		status, _ = binary.Uvarint(message[1:])
+	}
+	if status != grpcHealthServing {
+		return fmt.Errorf("grpc health status: %d, expect SERVING", status)
+	}
+	return nil
+}
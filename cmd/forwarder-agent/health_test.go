@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CheckTargetHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	targetAddr := strings.TrimPrefix(server.URL, "https://")
+
+	policy := agentapi.HealthCheck{Protocol: agentapi.HealthCheckProtocolHTTPS, Timeout: time.Second * 5}
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	tests := []struct {
+		Name       string
+		Insecure   bool
+		ForwardTLS *tls.Config
+		Valid      bool
+	}{
+		{Name: "verified by default", Valid: false},
+		{Name: "insecureSkipVerify", Insecure: true, Valid: true},
+		{Name: "forward tls settings", ForwardTLS: &tls.Config{RootCAs: roots, ServerName: "example.com"}, Valid: true},
+		{Name: "forward tls settings wrong name", ForwardTLS: &tls.Config{RootCAs: roots, ServerName: "other.internal"}, Valid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			policy := policy
+			policy.InsecureSkipVerify = tt.Insecure
+			err := checkTarget(context.Background(), policy, targetAddr, healthCheckTLSConfig(policy, tt.ForwardTLS, targetAddr))
+			if tt.Valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, "certificate")
+			}
+		})
+	}
+}
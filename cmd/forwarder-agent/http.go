@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+)
+
+const (
+	// httpExchangeLogSize is the number of recent exchanges kept by an inspected forward.
+	httpExchangeLogSize = 200
+	// httpBodyRecordLimit is how much of request and response bodies is recorded.
+	httpBodyRecordLimit = 16 * 1024
+)
+
+var errExchangeNotFound = errors.New("exchange not found")
+
+// httpConn is a forwarded connection of an HTTP forward.
+type httpConn struct {
+	client, target             net.Conn
+	clientReader, targetReader *bufio.Reader
+	toClient, toTarget         io.Writer
+	connID                     uint64
+	backend                    string
+}
+
+// forwardHTTP forwards HTTP/1.1 requests of conn one by one until either side closes the connection.
+// Upgraded connections (e.g. websocket) are piped as raw bytes after the upgrade response.
+func (r *tcpForwarder) forwardHTTP(ctx context.Context, cancel context.CancelCauseFunc, conn *httpConn) error {
+	for {
+		req, err := http.ReadRequest(conn.clientReader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("unable to read http request: %w", err)
+		}
+
+		r.rewriteRequest(req)
+
+		exchange, resp, err := r.roundTrip(req, conn.targetReader, conn.toTarget, conn.toClient)
+		exchange.ConnID = conn.connID
+		exchange.ClientAddr = conn.client.RemoteAddr().String()
+		exchange.Backend = conn.backend
+		r.recordExchange(exchange)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			r.pipe(ctx, cancel, conn.clientReader, conn.targetReader, conn.client, conn.target, conn.toClient, conn.toTarget)
+			return nil
+		}
+		if req.Close || resp.Close {
+			return nil
+		}
+	}
+}
+
+// rewriteRequest applies the forward http rewriting options to req, before it's recorded and sent.
+func (r *tcpForwarder) rewriteRequest(req *http.Request) {
+	opts := r.spec.HTTP
+	if opts.RewriteHost != "" {
+		req.Host = opts.RewriteHost
+	}
+
+	for name, value := range opts.AddHeaders {
+		req.Header.Set(name, value)
+	}
+
+	if hasPathPrefix(req.URL.Path, opts.StripPathPrefix) {
+		req.URL.Path = stripPathPrefix(req.URL.Path, opts.StripPathPrefix)
+		if req.URL.RawPath != "" {
+			req.URL.RawPath = stripPathPrefix(req.URL.RawPath, opts.StripPathPrefix)
+		}
+	}
+}
+
+// hasPathPrefix reports whether path starts with prefix path segments, /shop matches /shop and /shop/cart but not /shopping.
+func hasPathPrefix(path, prefix string) bool {
+	if prefix == "" || !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func stripPathPrefix(path, prefix string) string {
+	path = strings.TrimPrefix(path, prefix)
+	if !strings.HasPrefix(path, "/") {
+		return "/" + path
+	}
+	return path
+}
+
+// roundTrip writes req to target, reads the response from targetReader and writes it to client.
+// The returned exchange describes both, also when it failed halfway.
+func (r *tcpForwarder) roundTrip(req *http.Request, targetReader *bufio.Reader, target, client io.Writer) (agentapi.HTTPExchange, *http.Response, error) {
+	start := time.Now()
+	exchange := agentapi.HTTPExchange{
+		Time:          start,
+		Method:        req.Method,
+		Host:          req.Host,
+		URL:           req.URL.RequestURI(),
+		Proto:         req.Proto,
+		RequestHeader: req.Header.Clone(),
+	}
+
+	// NOTE: Request.Write adds a default User-Agent when missing, an empty value keeps the request as it was sent
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""}
+	}
+
+	// NOTE: Only wrap actual bodies, Request.Write probes bodies of unknown length otherwise
+	var reqBody *recordingBody
+	if req.Body != nil && req.Body != http.NoBody {
+		reqBody = &recordingBody{ReadCloser: req.Body}
+		req.Body = reqBody
+	}
+
+	err := req.Write(target)
+	if reqBody != nil {
+		exchange.RequestSize, exchange.RequestBody, exchange.RequestBodyTruncated = reqBody.size, reqBody.recorded.Bytes(), reqBody.truncated
+	}
+	if err != nil {
+		return r.failExchange(exchange, start, fmt.Errorf("unable to write http request: %w", err))
+	}
+
+	var resp *http.Response
+	for {
+		resp, err = http.ReadResponse(targetReader, req)
+		if err != nil {
+			return r.failExchange(exchange, start, fmt.Errorf("unable to read http response: %w", err))
+		}
+
+		// NOTE: Pass informational responses (e.g. 100 Continue) through, the final response follows them
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			if err := resp.Write(client); err != nil {
+				return r.failExchange(exchange, start, fmt.Errorf("unable to write http response: %w", err))
+			}
+			continue
+		}
+		break
+	}
+
+	exchange.Latency = time.Since(start)
+	exchange.Status = resp.StatusCode
+	exchange.ResponseHeader = resp.Header.Clone()
+
+	var respBody *recordingBody
+	if resp.Body != nil && resp.Body != http.NoBody {
+		respBody = &recordingBody{ReadCloser: resp.Body}
+		resp.Body = respBody
+	}
+
+	err = resp.Write(client)
+	exchange.Duration = time.Since(start)
+	if respBody != nil {
+		exchange.ResponseSize, exchange.ResponseBody, exchange.ResponseBodyTruncated = respBody.size, respBody.recorded.Bytes(), respBody.truncated
+	}
+	if err != nil {
+		exchange.Error = fmt.Sprintf("unable to write http response: %s", err)
+		return exchange, resp, errors.New(exchange.Error)
+	}
+	return exchange, resp, nil
+}
+
+func (r *tcpForwarder) failExchange(exchange agentapi.HTTPExchange, start time.Time, err error) (agentapi.HTTPExchange, *http.Response, error) {
+	exchange.Duration = time.Since(start)
+	exchange.Error = err.Error()
+	return exchange, nil, err
+}
+
+// inspecting reports whether the forwarder records http exchanges.
+func (r *tcpForwarder) inspecting() bool {
+	return r.spec.HTTP != nil && r.spec.HTTP.Inspect
+}
+
+// recordExchange keeps exchange in the forwarder exchange log and reports it through events, only when inspecting.
+func (r *tcpForwarder) recordExchange(exchange agentapi.HTTPExchange) agentapi.HTTPExchange {
+	if !r.inspecting() {
+		return exchange
+	}
+
+	exchange = r.exchanges.add(exchange)
+	summary := exchange.Summary()
+	r.emit(agentapi.Event{Type: agentapi.EventHTTPExchange, RemoteAddr: exchange.ClientAddr, Backend: exchange.Backend, HTTP: &summary})
+	return exchange
+}
+
+// replay sends the recorded request of exchange id again to a target, the response is recorded but not sent anywhere.
+func (r *tcpForwarder) replay(ctx context.Context, id uint64) (agentapi.HTTPExchange, error) {
+	recorded, ok := r.exchanges.get(id)
+	if !ok {
+		return agentapi.HTTPExchange{}, errExchangeNotFound
+	}
+	if recorded.RequestBodyTruncated {
+		return agentapi.HTTPExchange{}, fmt.Errorf("request body of exchange %d is larger than %d bytes, unable to replay", id, httpBodyRecordLimit)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, recorded.Method, "http://"+recorded.Host+recorded.URL, bytes.NewReader(recorded.RequestBody))
+	if err != nil {
+		return agentapi.HTTPExchange{}, fmt.Errorf("unable to create replay request: %w", err)
+	}
+	req.Header = recorded.RequestHeader.Clone()
+	req.Close = true
+
+	targetConn, b, err := r.dialTarget(ctx, "")
+	if err != nil {
+		return agentapi.HTTPExchange{}, err
+	}
+	defer targetConn.Close()
+
+	exchange, _, err := r.roundTrip(req, bufio.NewReader(targetConn), targetConn, io.Discard)
+	exchange.Backend = b.addr
+	exchange.Replay = true
+	return r.recordExchange(exchange), err
+}
+
+// recordingBody counts bytes read from a body and records the first httpBodyRecordLimit of them.
+type recordingBody struct {
+	io.ReadCloser
+	size      int64
+	recorded  bytes.Buffer
+	truncated bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	if room := httpBodyRecordLimit - b.recorded.Len(); room > 0 {
+		b.recorded.Write(p[:min(n, room)])
+	}
+	if b.size > httpBodyRecordLimit {
+		b.truncated = true
+	}
+	return n, err
+}
+
+// httpExchangeLog keeps the most recent exchanges of a forwarder.
+type httpExchangeLog struct {
+	mu        sync.Mutex
+	lastID    uint64
+	exchanges []agentapi.HTTPExchange
+}
+
+// add assigns exchange an id and keeps it, the oldest exchange is dropped when the log is full.
+func (l *httpExchangeLog) add(exchange agentapi.HTTPExchange) agentapi.HTTPExchange {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastID++
+	exchange.ID = l.lastID
+	l.exchanges = append(l.exchanges, exchange)
+	if len(l.exchanges) > httpExchangeLogSize {
+		l.exchanges = l.exchanges[len(l.exchanges)-httpExchangeLogSize:]
+	}
+	return exchange
+}
+
+// list returns exchange summaries, oldest first.
+func (l *httpExchangeLog) list() []agentapi.HTTPExchange {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := make([]agentapi.HTTPExchange, 0, len(l.exchanges))
+	for _, exchange := range l.exchanges {
+		result = append(result, exchange.Summary())
+	}
+	return result
+}
+
+func (l *httpExchangeLog) get(id uint64) (agentapi.HTTPExchange, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, exchange := range l.exchanges {
+		if exchange.ID == id {
+			return exchange, true
+		}
+	}
+	return agentapi.HTTPExchange{}, false
+}
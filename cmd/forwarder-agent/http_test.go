@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/stretchr/testify/assert"
+)
+
+// httpForwardTest runs forwardHTTP between a client end of a net.Pipe and a connection to target.
+type httpForwardTest struct {
+	fwd    *tcpForwarder
+	client net.Conn
+	reader *bufio.Reader
+	done   chan error
+}
+
+func newHTTPForwardTest(t *testing.T, target *httptest.Server, opts agentapi.HTTPOptions) *httpForwardTest {
+	targetAddr := strings.TrimPrefix(target.URL, "http://")
+	fwd := newTCPForwarder(agentapi.ForwardSpec{TargetAddr: targetAddr, HTTP: &opts, HealthCheck: agentapi.HealthCheck{Mode: agentapi.HealthCheckModeNone}}, nil)
+
+	targetConn, err := net.Dial("tcp", targetAddr)
+	assert.NoError(t, err)
+	client, agentSide := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = agentSide.Close()
+		_ = targetConn.Close()
+	})
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	t.Cleanup(func() { cancel(nil) })
+	conn := &httpConn{
+		client:       agentSide,
+		target:       targetConn,
+		clientReader: bufio.NewReader(agentSide),
+		targetReader: bufio.NewReader(targetConn),
+		toClient:     agentSide,
+		toTarget:     targetConn,
+	}
+	done := make(chan error, 1)
+	go func() { done <- fwd.forwardHTTP(ctx, cancel, conn) }()
+	return &httpForwardTest{fwd: fwd, client: client, reader: bufio.NewReader(client), done: done}
+}
+
+// do writes a raw request and reads its response.
+func (f *httpForwardTest) do(t *testing.T, rawRequest string) (*http.Response, string) {
+	go func() { _, _ = io.WriteString(f.client, rawRequest) }()
+	resp, err := http.ReadResponse(f.reader, nil)
+	if !assert.NoError(t, err) {
+		return nil, ""
+	}
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return resp, string(body)
+}
+
+// exchanges waits until count exchanges are recorded, they are recorded once the response is sent.
+func (f *httpForwardTest) exchanges(t *testing.T, count int) []agentapi.HTTPExchange {
+	assert.Eventually(t, func() bool { return len(f.fwd.exchanges.list()) == count }, time.Second, time.Millisecond*5)
+	return f.fwd.exchanges.list()
+}
+
+// finished reports whether forwardHTTP returned, without error, within timeout.
+func (f *httpForwardTest) finished(t *testing.T, timeout time.Duration) bool {
+	select {
+	case err := <-f.done:
+		assert.NoError(t, err)
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func Test_ForwardHTTPChunked(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		// NOTE: Flushing before the end makes the response chunked
+		_, _ = w.Write(body[:5])
+		w.(http.Flusher).Flush()
+		_, _ = w.Write(body[5:])
+	}))
+	defer target.Close()
+
+	f := newHTTPForwardTest(t, target, agentapi.HTTPOptions{Inspect: true})
+	resp, body := f.do(t, "POST /echo HTTP/1.1\r\nHost: api.internal\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, "hello world", body)
+
+	exchange, _ := f.fwd.exchanges.get(f.exchanges(t, 1)[0].ID)
+	assert.Equal(t, "/echo", exchange.URL)
+	assert.Equal(t, int64(11), exchange.RequestSize)
+	assert.Equal(t, "hello world", string(exchange.RequestBody))
+	assert.Equal(t, int64(11), exchange.ResponseSize)
+	assert.Equal(t, "hello world", string(exchange.ResponseBody))
+}
+
+func Test_ForwardHTTPConnectionClose(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bye" {
+			w.Header().Set("Connection", "close")
+		}
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer target.Close()
+
+	// keep-alive requests go one after the other on the same connection
+	f := newHTTPForwardTest(t, target, agentapi.HTTPOptions{Inspect: true})
+	for _, path := range []string{"/a", "/b"} {
+		_, body := f.do(t, "GET "+path+" HTTP/1.1\r\nHost: api.internal\r\n\r\n")
+		assert.Equal(t, path, body)
+	}
+	assert.False(t, f.finished(t, time.Millisecond*100))
+
+	// the client closing the connection ends the forward once the response is sent
+	resp, body := f.do(t, "GET /c HTTP/1.1\r\nHost: api.internal\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "/c", body)
+	assert.True(t, resp.Close)
+	assert.True(t, f.finished(t, time.Second))
+
+	// so does the target
+	f = newHTTPForwardTest(t, target, agentapi.HTTPOptions{})
+	resp, _ = f.do(t, "GET /bye HTTP/1.1\r\nHost: api.internal\r\n\r\n")
+	assert.True(t, resp.Close)
+	assert.True(t, f.finished(t, time.Second))
+}
+
+func Test_ReplayHTTPExchange(t *testing.T) {
+	var requests atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, r.Header.Get("X-Request")+":"+string(body))
+	}))
+	defer target.Close()
+
+	f := newHTTPForwardTest(t, target, agentapi.HTTPOptions{Inspect: true})
+	_, body := f.do(t, "POST /orders HTTP/1.1\r\nHost: api.internal\r\nX-Request: 1\r\nContent-Length: 7\r\n\r\n{\"a\":1}")
+	assert.Equal(t, `1:{"a":1}`, body)
+	recorded := f.exchanges(t, 1)[0]
+
+	replayed, err := f.fwd.replay(context.Background(), recorded.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+	assert.True(t, replayed.Replay)
+	assert.NotEqual(t, recorded.ID, replayed.ID)
+	assert.Equal(t, "POST", replayed.Method)
+	assert.Equal(t, "/orders", replayed.URL)
+	assert.Equal(t, http.StatusCreated, replayed.Status)
+	assert.Equal(t, `{"a":1}`, string(replayed.RequestBody))
+	assert.Equal(t, `1:{"a":1}`, string(replayed.ResponseBody))
+	assert.Len(t, f.exchanges(t, 2), 2)
+
+	_, err = f.fwd.replay(context.Background(), 42)
+	assert.ErrorIs(t, err, errExchangeNotFound)
+}
+
+func Test_StripPathPrefix(t *testing.T) {
+	tests := []struct {
+		Path     string
+		Prefix   string
+		Expected string
+	}{
+		{Path: "/api", Prefix: "/api", Expected: "/"},
+		{Path: "/api/", Prefix: "/api", Expected: "/"},
+		{Path: "/api/users", Prefix: "/api", Expected: "/users"},
+		{Path: "/apix", Prefix: "/api", Expected: "/apix"},
+		{Path: "/apix/users", Prefix: "/api", Expected: "/apix/users"},
+		{Path: "/api/users", Prefix: "/api/", Expected: "/users"},
+		{Path: "/v1/api/users", Prefix: "/api", Expected: "/v1/api/users"},
+		{Path: "/api/users", Prefix: "", Expected: "/api/users"},
+	}
+
+	fwd := newTCPForwarder(agentapi.ForwardSpec{TargetAddr: "api:80", HTTP: &agentapi.HTTPOptions{}}, nil)
+	for _, tt := range tests {
+		t.Run(tt.Prefix+" "+tt.Path, func(t *testing.T) {
+			fwd.spec.HTTP.StripPathPrefix = tt.Prefix
+			req := httptest.NewRequest(http.MethodGet, tt.Path+"?q=1", nil)
+			fwd.rewriteRequest(req)
+			assert.Equal(t, tt.Expected, req.URL.Path)
+			assert.Equal(t, "q=1", req.URL.RawQuery)
+		})
+	}
+}
+
+func Test_RewriteRequest(t *testing.T) {
+	var received *http.Request
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer target.Close()
+
+	f := newHTTPForwardTest(t, target, agentapi.HTTPOptions{
+		RewriteHost:     "api.staging.svc",
+		AddHeaders:      map[string]string{"X-Env": "dev", "Authorization": "Bearer dev"},
+		StripPathPrefix: "/api",
+	})
+	resp, _ := f.do(t, "GET /api/users%2Fall?page=2 HTTP/1.1\r\nHost: localhost:8080\r\nAuthorization: Bearer local\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "api.staging.svc", received.Host)
+	assert.Equal(t, "/users%2Fall", received.URL.EscapedPath())
+	assert.Equal(t, "page=2", received.URL.RawQuery)
+	assert.Equal(t, "dev", received.Header.Get("X-Env"))
+	assert.Equal(t, "Bearer dev", received.Header.Get("Authorization"))
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,6 +19,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/abdularis/kportfwd/internal/agentapi"
 	"github.com/abdularis/kportfwd/internal/log"
 )
 
@@ -26,14 +32,28 @@ const processTimeoutDuration = time.Second * 30
 // This program will also expose http ping endpoint that should be called by local machine (kportfwd)
 // to indicate that this agent is being used otherwise this program will exit and clean up
 // if no ping for 30 seconds period time (configured from processTimeoutDuration).
+//
+// The agent registers itself (pid, session id and api port) into its state dir, so that
+// other kportfwd sessions forwarding the same targets can attach to it instead of starting a new one.
 func main() {
 	log.SetComponentName("forwarder-agent")
 
 	var addresses addressList
 	flag.Var(&addresses, "address", "TCP address pair to forward, example: 'sourcehost:port->targethost:port', forwarder will create listener for sourcehost:port and forward any network traffic to targethost:port")
+	var forwardSpecs addressList
+	flag.Var(&forwardSpecs, "forward", "Forward spec as JSON, example: '{\"sourceAddr\":\":0\",\"targetAddr\":\"postgres:5432\",\"healthCheck\":{\"mode\":\"tcp\"}}'")
+	session := flag.String("session", strconv.Itoa(os.Getpid()), "Session id of this agent, used to register the agent so other kportfwd sessions can attach to it")
+	stateDir := flag.String("state-dir", os.TempDir(), "Directory where the agent registration file is written")
+	bootstrapStdin := flag.Bool("bootstrap-stdin", false, "Read the session token and forward specs as a JSON line from stdin, keeping them out of the process arguments")
 	flag.Parse()
 
-	forwarderConfigList, err := parseForwarderConfigList(addresses)
+	bootstrap, err := loadBootstrap(*bootstrapStdin, os.Stdin)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	token := bootstrap.Token
+
+	forwarderConfigList, err := parseForwarderConfigList(addresses, forwardSpecs, bootstrap.Forwards)
 	if err != nil {
 		log.Fatalf("unable to parse forwarder config: %s", err)
 	}
@@ -41,18 +61,30 @@ func main() {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 
+	// NOTE: stdout is dedicated to structured events consumed by kportfwd, logs are written to stderr.
+	// Both are pipes of the session that started the agent, writing them once it's gone must fail
+	// with EPIPE rather than kill the agent.
+	signal.Ignore(syscall.SIGPIPE)
+	events := newEventEmitter(os.Stdout)
+
+	var shutdownOnce sync.Once
+	shutdownReason := "exit"
+	shutdown := func(reason string) {
+		shutdownOnce.Do(func() { shutdownReason = reason })
+		cancelFunc()
+	}
+	defer func() {
+		events.emit(agentapi.Event{Type: agentapi.EventShutdown, Reason: shutdownReason})
+		events.close()
+	}()
+
 	forwarderList := []*tcpForwarder{}
 
 	wg := sync.WaitGroup{}
 
 	forwarderReadyCh := make(chan struct{}, 1)
 	for _, cfg := range forwarderConfigList {
-		f := &tcpForwarder{
-			healthCheckInterval: time.Second * 15,
-			targetAddr:          cfg.TargetAddr,
-			sourceAddr:          cfg.SourceAddr,
-			bufferSize:          4096,
-		}
+		f := newTCPForwarder(cfg, events)
 
 		forwarderList = append(forwarderList, f)
 
@@ -62,26 +94,51 @@ func main() {
 
 			err := fwd.Start(ctx, forwarderReadyCh)
 			if err != nil {
-				log.Errorf("error starting port forward: %s", err)
+				log.Errorf("error starting port forward: %s", fwd.spec.Redact(err.Error()))
 			}
 		}(f)
 
 		select {
 		case <-forwarderReadyCh:
 		case <-time.NewTimer(time.Second * 10).C:
-			log.Errorf("timeout waiting for forwarder %s to be ready", f.targetAddr)
+			log.Errorf("timeout waiting for forwarder %s to be ready", cfg.Redact(f.targetAddr))
+			shutdownReason = "forwarder start timeout"
 			return
 		}
 	}
 
-	log.Infof("FORWARDERS READY. count: %d", len(forwarderConfigList))
-
 	processTimer := time.NewTimer(processTimeoutDuration)
 	httpApi := api{
+		session:       *session,
+		token:         token,
 		forwarderList: forwarderList,
 		processTimer:  processTimer,
+		events:        events,
+	}
+	apiServer, apiPort, err := httpApi.start(func() { shutdown("http api error") })
+	if err != nil {
+		log.Errorf("unable to start http api: %s", err)
+		shutdownReason = "http api error"
+		return
+	}
+
+	registrationFile := agentapi.RegistrationFilePath(*stateDir, *session)
+	reg := httpApi.registration(apiPort)
+	reg.Token = token
+	if err := writeRegistration(registrationFile, reg); err != nil {
+		log.Warnf("unable to register agent, other sessions won't be able to attach: %s", err)
+	} else {
+		defer os.Remove(registrationFile)
 	}
-	apiServer := httpApi.start(cancelFunc)
+
+	log.Infof("FORWARDERS READY. count: %d api port: %d", len(forwarderConfigList), apiPort)
+	events.emit(agentapi.Event{
+		Type:       agentapi.EventReady,
+		Session:    *session,
+		APIPort:    apiPort,
+		Forwarders: httpApi.forwarders(false),
+	})
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -97,42 +154,59 @@ func main() {
 				return
 			case <-processTimer.C:
 				log.Infof("process timeout, exit.")
-				cancelFunc()
+				shutdown("ping timeout")
 				return
 			}
 		}
 	}()
 
+	// NOTE: Keep running when the kportfwd session that started this agent is gone,
+	// other sessions might be attached, the agent exits anyway once nobody pings it.
+	signal.Ignore(syscall.SIGHUP)
+
 	go func() {
 		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-		<-sig
-		cancelFunc()
+		s := <-sig
+		shutdown("signal " + s.String())
 	}()
 
 	wg.Wait()
 }
 
 type api struct {
+	session       string
+	token         string
 	forwarderList []*tcpForwarder
 	processTimer  *time.Timer
+	events        *eventEmitter
+	// shutdownCh is closed once the api server shuts down, to end long-lived streams
+	shutdownCh chan struct{}
 }
 
-func (a *api) start(cancelFn context.CancelFunc) *http.Server {
-	listenAddr := ":8181"
+// start starts the http api listener and returns the server and the port it's listening on.
+// The api listens on a random free loopback port unless FORWARDER_API_PORT is set,
+// it is only meant to be reached through kubernetes port forward.
+func (a *api) start(cancelFn context.CancelFunc) (*http.Server, int, error) {
+	listenAddr := "127.0.0.1:0"
 	if portStr := os.Getenv("FORWARDER_API_PORT"); portStr != "" {
 		_, err := strconv.ParseUint(portStr, 10, 16)
 		if err == nil {
-			listenAddr = ":" + portStr
+			listenAddr = "127.0.0.1:" + portStr
 		}
 	}
 
-	http.HandleFunc("/ping", a.pingHandler)
-	http.HandleFunc("/forwarders", a.getForwardersHandler)
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to listen tcp %s: %w", listenAddr, err)
+	}
 
-	srv := &http.Server{Addr: listenAddr}
+	srv := &http.Server{Handler: a.handler()}
+	srv.RegisterOnShutdown(a.events.closeSubscribers)
+	var shutdownOnce sync.Once
+	srv.RegisterOnShutdown(func() { shutdownOnce.Do(func() { close(a.shutdownCh) }) })
 	go func() {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
 			log.Errorf("http api listener error: %s", err)
 			cancelFn()
 		} else {
@@ -140,7 +214,57 @@ func (a *api) start(cancelFn context.CancelFunc) *http.Server {
 		}
 	}()
 
-	return srv
+	return srv, listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// handler returns the api handler, every endpoint requires the session token.
+func (a *api) handler() http.Handler {
+	if a.shutdownCh == nil {
+		a.shutdownCh = make(chan struct{})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", a.authorized(a.pingHandler))
+	mux.HandleFunc("/info", a.authorized(a.getInfoHandler))
+	mux.HandleFunc("/forwarders", a.authorized(a.getForwardersHandler))
+	mux.HandleFunc("/events", a.authorized(a.getEventsHandler))
+	mux.HandleFunc("/shaping", a.authorized(a.shapingHandler))
+	mux.HandleFunc("/capture", a.authorized(a.getCaptureHandler))
+	mux.HandleFunc("/http/exchanges", a.authorized(a.getHTTPExchangesHandler))
+	mux.HandleFunc("/http/replay", a.authorized(a.replayHTTPExchangeHandler))
+	return mux
+}
+
+// forwarders returns forwarders description, backends and active connections are included when detailed is true.
+func (a *api) forwarders(detailed bool) []agentapi.Forwarder {
+	result := []agentapi.Forwarder{}
+	for _, fwd := range a.forwarderList {
+		result = append(result, fwd.info(detailed))
+	}
+	return result
+}
+
+func (a *api) registration(apiPort int) agentapi.Registration {
+	return agentapi.Registration{
+		Session:    a.session,
+		Version:    agentapi.Version,
+		Pid:        os.Getpid(),
+		APIPort:    apiPort,
+		Forwarders: a.forwarders(true),
+	}
+}
+
+// authorized rejects requests not having the session token as bearer token.
+func (a *api) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Unauthorized")
+			return
+		}
+		handler(w, r)
+	}
 }
 
 func (a *api) pingHandler(w http.ResponseWriter, r *http.Request) {
@@ -158,23 +282,294 @@ func (a *api) getForwardersHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		fmt.Fprintln(w, "Method not allowed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(a.forwarders(true))
+}
+
+func (a *api) getInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "Method not allowed")
+		return
+	}
+
+	apiPort := 0
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		apiPort = addr.Port
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(a.registration(apiPort))
+}
+
+// getEventsHandler streams agent events as server-sent events until the client or the agent goes away.
+func (a *api) getEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "Method not allowed")
+		return
 	}
 
-	response := []map[string]interface{}{}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Streaming not supported")
+		return
+	}
+
+	ch := a.events.subscribe()
+	defer a.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+// findForwarder returns the forwarder with given name, or target address (as reported) for unnamed forwarders.
+func (a *api) findForwarder(name string) *tcpForwarder {
 	for _, fwd := range a.forwarderList {
-		item := map[string]interface{}{
-			"targetAddr": fwd.targetAddr,
-			"sourceAddr": fwd.sourceAddr,
+		if fwd.name == name || (fwd.name == "" && fwd.spec.Redact(fwd.targetAddr) == name) {
+			return fwd
 		}
-		if fwd.lastErr != nil {
-			item["error"] = fwd.lastErr.Error()
+	}
+	return nil
+}
+
+// shapingHandler returns (GET) or replaces (PUT) traffic shaping of the forwarder given by `forwarder` query param,
+// PUT with an empty shaping object disables it.
+func (a *api) shapingHandler(w http.ResponseWriter, r *http.Request) {
+	fwd := a.findForwarder(r.URL.Query().Get("forwarder"))
+	if fwd == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "Forwarder not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var shaping agentapi.Shaping
+		if err := json.NewDecoder(r.Body).Decode(&shaping); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid shaping: %s\n", err)
+			return
 		}
-		response = append(response, item)
+		if err := shaping.Validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid shaping: %s\n", err)
+			return
+		}
+		fwd.setShaping(shaping)
+		log.Infof("traffic shaping of %s changed: %+v", fwd.spec.Redact(fwd.targetAddr), shaping)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "Method not allowed")
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(fwd.shaping.Load())
+}
+
+// getCaptureHandler streams capture records of the forwarder given by `forwarder` query param as JSON lines,
+// the capture runs until the client goes away.
+func (a *api) getCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "Method not allowed")
+		return
+	}
+
+	fwd := a.findForwarder(r.URL.Query().Get("forwarder"))
+	if fwd == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "Forwarder not found")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Streaming not supported")
+		return
+	}
+
+	ch := fwd.captures.subscribe()
+	defer fwd.captures.unsubscribe(ch)
+	log.Infof("capture of %s started", fwd.spec.Redact(fwd.targetAddr))
+	defer log.Infof("capture of %s stopped", fwd.spec.Redact(fwd.targetAddr))
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-a.shutdownCh:
+			return
+		case record := <-ch:
+			if err := encoder.Encode(record); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// inspectedForwarder returns the inspected http forwarder given by `forwarder` query param,
+// an error response is written when there is none.
+func (a *api) inspectedForwarder(w http.ResponseWriter, r *http.Request) *tcpForwarder {
+	fwd := a.findForwarder(r.URL.Query().Get("forwarder"))
+	if fwd == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "Forwarder not found")
+		return nil
+	}
+	if !fwd.inspecting() {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "Forwarder is not inspecting http")
+		return nil
+	}
+	return fwd
+}
+
+// getHTTPExchangesHandler returns recent http exchanges summaries of an inspected forwarder,
+// or a single exchange with headers and bodies when `id` query param is given.
+func (a *api) getHTTPExchangesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "Method not allowed")
+		return
+	}
+
+	fwd := a.inspectedForwarder(w, r)
+	if fwd == nil {
+		return
+	}
+
+	var result any = fwd.exchanges.list()
+	if idStr := r.URL.Query().Get("id"); idStr != "" {
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "Invalid exchange id")
+			return
+		}
+		exchange, ok := fwd.exchanges.get(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "Exchange not found")
+			return
+		}
+		result = exchange
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// replayHTTPExchangeHandler sends the request of exchange `id` again and returns the new exchange.
+func (a *api) replayHTTPExchangeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "Method not allowed")
+		return
+	}
+
+	fwd := a.inspectedForwarder(w, r)
+	if fwd == nil {
+		return
+	}
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "Invalid exchange id")
+		return
+	}
+
+	exchange, err := fwd.replay(r.Context(), id)
+	if errors.Is(err, errExchangeNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "Exchange not found")
+		return
+	}
+	if err != nil && exchange.ID == 0 {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "Replay failed: %s\n", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(exchange)
+}
+
+// readBootstrap reads the bootstrap JSON line written by kportfwd on stdin.
+// loadBootstrap reads the bootstrap from stdin with bootstrapStdin, or takes the session token from the environment.
+// The session token is required, the http api is never served unauthenticated.
+func loadBootstrap(bootstrapStdin bool, stdin io.Reader) (agentapi.Bootstrap, error) {
+	bootstrap := agentapi.Bootstrap{Token: os.Getenv(agentapi.TokenEnv)}
+	if bootstrapStdin {
+		var err error
+		bootstrap, err = readBootstrap(stdin)
+		if err != nil {
+			return agentapi.Bootstrap{}, fmt.Errorf("unable to read bootstrap from stdin: %w", err)
+		}
+	}
+	if bootstrap.Token == "" {
+		return agentapi.Bootstrap{}, fmt.Errorf("session token is required, the http api is never served unauthenticated (-bootstrap-stdin or %s)", agentapi.TokenEnv)
+	}
+	return bootstrap, nil
+}
+
+func readBootstrap(r io.Reader) (agentapi.Bootstrap, error) {
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return agentapi.Bootstrap{}, err
+	}
+	var bootstrap agentapi.Bootstrap
+	if err := json.Unmarshal(line, &bootstrap); err != nil {
+		return agentapi.Bootstrap{}, fmt.Errorf("invalid bootstrap: %w", err)
+	}
+	return bootstrap, nil
+}
+
+// writeRegistration writes agent registration file, readable only by the agent user.
+func writeRegistration(fileName string, reg agentapi.Registration) error {
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0600)
 }
 
 type addressList []string
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAPI(t *testing.T, token string) (*api, *httptest.Server) {
+	events := newEventEmitter(io.Discard)
+	t.Cleanup(events.close)
+
+	a := &api{
+		session: "s1",
+		token:   token,
+		forwarderList: []*tcpForwarder{newTCPForwarder(agentapi.ForwardSpec{
+			Name:         "db",
+			SourceAddr:   "127.0.0.1:0",
+			TargetAddr:   "db-7f3a.internal:5432",
+			SecretValues: []string{"db-7f3a.internal"},
+			OriginateTLS: &agentapi.OriginateTLS{CertData: []byte("cert"), KeyData: []byte("key")},
+		}, events)},
+		processTimer: time.NewTimer(processTimeoutDuration),
+		events:       events,
+	}
+	srv := httptest.NewServer(a.handler())
+	t.Cleanup(srv.Close)
+	return a, srv
+}
+
+func Test_APIAuthorized(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Token         string
+		Authorization string
+		Expected      int
+	}{
+		{Name: "session token", Token: "t0k", Authorization: "Bearer t0k", Expected: http.StatusOK},
+		{Name: "no authorization", Token: "t0k", Authorization: "", Expected: http.StatusUnauthorized},
+		{Name: "wrong token", Token: "t0k", Authorization: "Bearer t0k2", Expected: http.StatusUnauthorized},
+		{Name: "token prefix", Token: "t0k", Authorization: "Bearer t0", Expected: http.StatusUnauthorized},
+		{Name: "not a bearer token", Token: "t0k", Authorization: "Basic t0k", Expected: http.StatusUnauthorized},
+		{Name: "bare token", Token: "t0k", Authorization: "t0k", Expected: http.StatusUnauthorized},
+		{Name: "no session token", Token: "", Authorization: "Bearer ", Expected: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			_, srv := newTestAPI(t, tt.Token)
+			for _, path := range []string{"/ping", "/info", "/forwarders", "/shaping?forwarder=db", "/http/exchanges?forwarder=db"} {
+				req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+				assert.NoError(t, err)
+				if tt.Authorization != "" {
+					req.Header.Set("Authorization", tt.Authorization)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				assert.NoError(t, err)
+				resp.Body.Close()
+
+				if tt.Expected == http.StatusOK {
+					assert.NotEqual(t, http.StatusUnauthorized, resp.StatusCode, path)
+				} else {
+					assert.Equal(t, tt.Expected, resp.StatusCode, path)
+				}
+			}
+		})
+	}
+}
+
+func Test_LoadBootstrap(t *testing.T) {
+	t.Setenv(agentapi.TokenEnv, "")
+
+	bootstrap, err := loadBootstrap(true, strings.NewReader(`{"token":"t0k","forwards":[{"sourceAddr":":0","targetAddr":"postgres:5432"}]}`+"\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "t0k", bootstrap.Token)
+	assert.Equal(t, "postgres:5432", bootstrap.Forwards[0].TargetAddr)
+
+	// the http api is never served without a session token
+	_, err = loadBootstrap(true, strings.NewReader(`{"forwards":[]}`))
+	assert.ErrorContains(t, err, "session token is required")
+	_, err = loadBootstrap(false, strings.NewReader(""))
+	assert.ErrorContains(t, err, "session token is required")
+	_, err = loadBootstrap(true, strings.NewReader("not json\n"))
+	assert.ErrorContains(t, err, "invalid bootstrap")
+
+	t.Setenv(agentapi.TokenEnv, "env-t0k")
+	bootstrap, err = loadBootstrap(false, strings.NewReader(""))
+	assert.NoError(t, err)
+	assert.Equal(t, "env-t0k", bootstrap.Token)
+	// NOTE: The environment is ignored with -bootstrap-stdin
+	_, err = loadBootstrap(true, strings.NewReader(`{}`))
+	assert.Error(t, err)
+}
+
+func Test_WriteRegistration(t *testing.T) {
+	a, srv := newTestAPI(t, "t0k")
+	reg := a.registration(4242)
+	reg.Token = "t0k"
+
+	fileName := agentapi.RegistrationFilePath(t.TempDir(), "s1")
+	assert.Equal(t, "kportfwd-agent-s1.json", filepath.Base(fileName))
+	assert.NoError(t, writeRegistration(fileName, reg))
+
+	stat, err := os.Stat(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	data, err := os.ReadFile(fileName)
+	assert.NoError(t, err)
+	var written agentapi.Registration
+	assert.NoError(t, json.Unmarshal(data, &written))
+	assert.Equal(t, "s1", written.Session)
+	assert.Equal(t, "t0k", written.Token)
+	assert.Equal(t, agentapi.Version, written.Version)
+	assert.Equal(t, os.Getpid(), written.Pid)
+	assert.Equal(t, 4242, written.APIPort)
+
+	// forwarders are written without secret material, the list of secret values included
+	assert.Len(t, written.Forwarders, 1)
+	assert.Equal(t, "REDACTED:5432", written.Forwarders[0].TargetAddr)
+	assert.Equal(t, "REDACTED:5432", written.Forwarders[0].Spec.TargetAddr)
+	assert.Nil(t, written.Forwarders[0].Spec.OriginateTLS.KeyData)
+	assert.Equal(t, []byte("cert"), written.Forwarders[0].Spec.OriginateTLS.CertData)
+	assert.NotContains(t, string(data), "db-7f3a")
+
+	// the api never serves the token
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/info", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer t0k")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	var info agentapi.Registration
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	assert.Equal(t, "s1", info.Session)
+	assert.Empty(t, info.Token)
+}
+
+// subscribeEvents opens an /events stream and returns a reader of its lines.
+func subscribeEvents(t *testing.T, ctx context.Context, srv *httptest.Server) *bufio.Reader {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer t0k")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return bufio.NewReader(resp.Body)
+}
+
+// readEvent reads the next server-sent event.
+func readEvent(t *testing.T, reader *bufio.Reader) (string, agentapi.Event) {
+	var eventType string
+	var event agentapi.Event
+	for {
+		line, err := reader.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return "", event
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return eventType, event
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+		}
+	}
+}
+
+func (e *eventEmitter) subscriberCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.subscribers)
+}
+
+func Test_APIEvents(t *testing.T) {
+	a, srv := newTestAPI(t, "t0k")
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	defer cancelFirst()
+	first := subscribeEvents(t, firstCtx, srv)
+	second := subscribeEvents(t, context.Background(), srv)
+	assert.Eventually(t, func() bool { return a.events.subscriberCount() == 2 }, time.Second, time.Millisecond*10)
+
+	// every subscriber gets every event
+	a.events.emit(agentapi.Event{Type: agentapi.EventReady, Session: "s1", APIPort: 4242})
+	for _, reader := range []*bufio.Reader{first, second} {
+		eventType, event := readEvent(t, reader)
+		assert.Equal(t, agentapi.EventReady, eventType)
+		assert.Equal(t, agentapi.EventVersion, event.Version)
+		assert.Equal(t, "s1", event.Session)
+		assert.Equal(t, 4242, event.APIPort)
+	}
+
+	// a subscriber going away is unsubscribed, the others keep streaming
+	cancelFirst()
+	assert.Eventually(t, func() bool { return a.events.subscriberCount() == 1 }, time.Second, time.Millisecond*10)
+
+	a.forwarderList[0].emit(agentapi.Event{Type: agentapi.EventHealthCheckFailure, Backend: "db-7f3a.internal:5432"})
+	eventType, event := readEvent(t, second)
+	assert.Equal(t, agentapi.EventHealthCheckFailure, eventType)
+	assert.Equal(t, "REDACTED:5432", event.Backend)
+	assert.Equal(t, "db", event.Forwarder.Name)
+
+	// streams end once the agent shuts down
+	a.events.closeSubscribers()
+	_, err := second.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, 0, a.events.subscriberCount())
+}
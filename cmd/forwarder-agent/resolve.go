@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+)
+
+// resolveInterval is how often target hosts are resolved again, so that scaled or rescheduled pods
+// behind a headless service are picked up.
+const resolveInterval = time.Second * 30
+
+// lookupIPFunc resolves host into its addresses, net.Resolver.LookupIPAddr.
+type lookupIPFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// resolveTargets resolves every target host of spec into one target per A/AAAA record keeping the target weight.
+// When spec has an ordinal the StatefulSet pod with that ordinal is resolved instead, see ordinalHost.
+func resolveTargets(ctx context.Context, lookup lookupIPFunc, spec agentapi.ForwardSpec) ([]agentapi.Target, error) {
+	var result []agentapi.Target
+	for _, target := range spec.TargetList() {
+		host, port, err := net.SplitHostPort(target.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target address %s: %w", target.Addr, err)
+		}
+		if spec.Ordinal != nil {
+			host = ordinalHost(host, spec.StatefulSet, *spec.Ordinal)
+		}
+
+		ipAddrs, err := lookup(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve %s: %w", host, err)
+		}
+
+		var addrs []string
+		for _, ipAddr := range ipAddrs {
+			addrs = append(addrs, ipAddr.IP.String())
+		}
+		// NOTE: DNS servers usually shuffle records, keep a stable order so failover picks the same address
+		sort.Strings(addrs)
+
+		for _, addr := range addrs {
+			result = append(result, agentapi.Target{Addr: net.JoinHostPort(addr, port), Weight: target.Weight})
+		}
+	}
+	return result, nil
+}
+
+// ordinalHost returns the DNS name cluster DNS serves for the StatefulSet pod with given ordinal behind
+// headless service host, <statefulSet>-<ordinal>.<host>. statefulSet defaults to the service name.
+func ordinalHost(host, statefulSet string, ordinal int) string {
+	if statefulSet == "" {
+		statefulSet, _, _ = strings.Cut(host, ".")
+	}
+	return fmt.Sprintf("%s-%d.%s", statefulSet, ordinal, host)
+}
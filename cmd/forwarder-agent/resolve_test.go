@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ResolveTargets(t *testing.T) {
+	records := map[string][]string{
+		"kafka-headless":                  {"10.1.0.12", "10.1.0.10", "10.1.0.11"},
+		"kafka-2.kafka-headless":          {"10.1.0.12"},
+		"kafka-headless-1.kafka-headless": {"10.1.0.11"},
+		"db-0.db.staging.svc":             {"10.2.0.5"},
+	}
+	lookup := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		ips, ok := records[host]
+		if !ok {
+			return nil, fmt.Errorf("no such host")
+		}
+		var result []net.IPAddr
+		for _, ip := range ips {
+			result = append(result, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return result, nil
+	}
+	ordinal := func(n int) *int { return &n }
+
+	tests := []struct {
+		Name     string
+		Spec     agentapi.ForwardSpec
+		Expected []agentapi.Target
+		Error    bool
+	}{
+		{
+			Name:     "every record sorted",
+			Spec:     agentapi.ForwardSpec{TargetAddr: "kafka-headless:9092", ResolveAll: true},
+			Expected: []agentapi.Target{{Addr: "10.1.0.10:9092"}, {Addr: "10.1.0.11:9092"}, {Addr: "10.1.0.12:9092"}},
+		},
+		{
+			Name:     "weights are kept",
+			Spec:     agentapi.ForwardSpec{Targets: []agentapi.Target{{Addr: "db-0.db.staging.svc:5432", Weight: 3}}, ResolveAll: true},
+			Expected: []agentapi.Target{{Addr: "10.2.0.5:5432", Weight: 3}},
+		},
+		{
+			Name:     "ordinal of statefulSet",
+			Spec:     agentapi.ForwardSpec{TargetAddr: "kafka-headless:9092", Ordinal: ordinal(2), StatefulSet: "kafka"},
+			Expected: []agentapi.Target{{Addr: "10.1.0.12:9092"}},
+		},
+		{
+			Name:     "ordinal defaults to the service name",
+			Spec:     agentapi.ForwardSpec{TargetAddr: "kafka-headless:9092", Ordinal: ordinal(1)},
+			Expected: []agentapi.Target{{Addr: "10.1.0.11:9092"}},
+		},
+		{
+			Name:     "ordinal of a qualified service",
+			Spec:     agentapi.ForwardSpec{TargetAddr: "db.staging.svc:5432", Ordinal: ordinal(0)},
+			Expected: []agentapi.Target{{Addr: "10.2.0.5:5432"}},
+		},
+		{
+			Name:  "missing ordinal",
+			Spec:  agentapi.ForwardSpec{TargetAddr: "kafka-headless:9092", Ordinal: ordinal(7), StatefulSet: "kafka"},
+			Error: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			targets, err := resolveTargets(context.Background(), lookup, tt.Spec)
+			if tt.Error {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.Expected, targets)
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+)
+
+var errShapingReset = errors.New("connection reset by traffic shaping")
+
+// connWriter writes one direction of a forwarded connection, it records the time of the last write
+// (used to detect idle connections) and applies the forwarder traffic shaping, read on every write
+// so that shaping changes through the api apply to connections already open.
+type connWriter struct {
+	io.Writer
+	lastActivity *atomic.Int64
+	shaping      *atomic.Pointer[agentapi.Shaping]
+	capture      *connCapture
+	direction    string
+
+	// delayed releases written data once latency is over, it's started by the first delayed write.
+	delayed *delayQueue
+	// next is the earliest time the next chunk can be written without exceeding the bandwidth cap.
+	next time.Time
+}
+
+func (w *connWriter) Write(p []byte) (int, error) {
+	w.lastActivity.Store(time.Now().UnixNano())
+
+	n, err := w.write(p)
+	if n > 0 {
+		w.capture.record(agentapi.CaptureData, w.direction, p[:n])
+	}
+	return n, err
+}
+
+func (w *connWriter) write(p []byte) (int, error) {
+	var shaping agentapi.Shaping
+	if current := w.shaping.Load(); current != nil {
+		shaping = *current
+	}
+
+	if shaping.ResetProbability > 0 && rand.Float64() < shaping.ResetProbability {
+		return 0, errShapingReset
+	}
+
+	// NOTE: Once delayed, data keeps going through the queue so that it stays in order when latency changes
+	delay := shapingDelay(shaping.Latency, shaping.Jitter)
+	if w.delayed == nil && delay > 0 {
+		w.delayed = newDelayQueue(w.limit)
+	}
+	if w.delayed != nil {
+		return w.delayed.push(p, time.Now().Add(delay))
+	}
+	return w.limit(p)
+}
+
+// limit writes p following the bandwidth cap of the current shaping.
+func (w *connWriter) limit(p []byte) (int, error) {
+	shaping := w.shaping.Load()
+	if shaping == nil || shaping.BandwidthBytesPerSec <= 0 {
+		return w.Writer.Write(p)
+	}
+
+	// NOTE: Write in chunks of at most 1/10 of the rate, so that throughput is smooth rather than bursty
+	chunkSize := int(max(shaping.BandwidthBytesPerSec/10, 1))
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(written+chunkSize, len(p))]
+
+		now := time.Now()
+		if w.next.After(now) {
+			time.Sleep(w.next.Sub(now))
+		} else {
+			w.next = now
+		}
+		w.next = w.next.Add(time.Duration(int64(len(chunk)) * int64(time.Second) / shaping.BandwidthBytesPerSec))
+
+		n, err := w.Writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// flush waits until delayed data is written, before the connection is half-closed or closed.
+func (w *connWriter) flush() error {
+	if w.delayed == nil {
+		return nil
+	}
+	return w.delayed.flush()
+}
+
+// stop drops delayed data not written yet, once the connection is done.
+func (w *connWriter) stop() {
+	if w.delayed != nil {
+		w.delayed.stop()
+	}
+}
+
+// maxDelayedBytes bounds data held by a delayQueue, writes block once it's reached so that
+// the delayed side keeps applying backpressure.
+const maxDelayedBytes = 4 << 20
+
+type delayedChunk struct {
+	data []byte
+	due  time.Time
+}
+
+// delayQueue writes chunks in order, each one once it's due: data is delayed as on a slow network link,
+// without throughput dropping to a chunk per latency as sleeping on every write would.
+type delayQueue struct {
+	write  func(p []byte) (int, error)
+	stopCh chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	chunks  []delayedChunk
+	size    int
+	err     error
+	stopped bool
+}
+
+func newDelayQueue(write func(p []byte) (int, error)) *delayQueue {
+	q := &delayQueue{write: write, stopCh: make(chan struct{})}
+	q.cond = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// push queues a copy of p to be written at due, never before the chunks queued earlier.
+func (q *delayQueue) push(p []byte, due time.Time) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.err == nil && !q.stopped && q.size > 0 && q.size+len(p) > maxDelayedBytes {
+		q.cond.Wait()
+	}
+	if q.err != nil {
+		return 0, q.err
+	}
+	if q.stopped {
+		return 0, io.ErrClosedPipe
+	}
+
+	if last := len(q.chunks) - 1; last >= 0 && due.Before(q.chunks[last].due) {
+		due = q.chunks[last].due
+	}
+	q.chunks = append(q.chunks, delayedChunk{data: append([]byte(nil), p...), due: due})
+	q.size += len(p)
+	q.cond.Broadcast()
+	return len(p), nil
+}
+
+// run writes queued chunks once due until the queue is stopped or a write fails.
+func (q *delayQueue) run() {
+	for {
+		q.mu.Lock()
+		for len(q.chunks) == 0 && !q.stopped {
+			q.cond.Wait()
+		}
+		if q.stopped {
+			q.mu.Unlock()
+			return
+		}
+		chunk := q.chunks[0]
+		q.mu.Unlock()
+
+		if wait := time.Until(chunk.due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-q.stopCh:
+				timer.Stop()
+				return
+			}
+		}
+
+		// NOTE: The chunk stays queued while it's written, flush waits for it
+		_, err := q.write(chunk.data)
+
+		q.mu.Lock()
+		if q.stopped {
+			q.mu.Unlock()
+			return
+		}
+		q.chunks = q.chunks[1:]
+		q.size -= len(chunk.data)
+		if err != nil {
+			q.err = err
+			q.chunks, q.size = nil, 0
+		}
+		q.cond.Broadcast()
+		q.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// flush waits until every queued chunk is written, it returns the write error if any.
+func (q *delayQueue) flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.chunks) > 0 && q.err == nil && !q.stopped {
+		q.cond.Wait()
+	}
+	return q.err
+}
+
+// stop drops chunks not written yet and ends the queue.
+func (q *delayQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return
+	}
+	q.stopped = true
+	q.chunks, q.size = nil, 0
+	close(q.stopCh)
+	q.cond.Broadcast()
+}
+
+// shapingDelay returns latency shifted by a random duration between -jitter and +jitter, never negative.
+func shapingDelay(latency, jitter time.Duration) time.Duration {
+	delay := latency
+	if jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(jitter)*2+1)) - jitter
+	}
+	return max(delay, 0)
+}
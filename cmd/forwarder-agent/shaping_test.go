@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/stretchr/testify/assert"
+)
+
+// timedWriter records when each write happened.
+type timedWriter struct {
+	mu     sync.Mutex
+	buff   bytes.Buffer
+	writes []time.Time
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, time.Now())
+	return w.buff.Write(p)
+}
+
+func newShapedWriter(dst *timedWriter, shaping agentapi.Shaping) *connWriter {
+	w := &connWriter{Writer: dst, lastActivity: &atomic.Int64{}, shaping: &atomic.Pointer[agentapi.Shaping]{}}
+	w.shaping.Store(&shaping)
+	return w
+}
+
+func Test_ConnWriterLatency(t *testing.T) {
+	latency := time.Millisecond * 100
+	dst := &timedWriter{}
+	w := newShapedWriter(dst, agentapi.Shaping{Latency: latency})
+	defer w.stop()
+
+	// writes return right away, every chunk is released latency after it was written, not latency after the previous one
+	start := time.Now()
+	var expected bytes.Buffer
+	for i := 0; i < 10; i++ {
+		chunk := []byte("chunk" + strconv.Itoa(i) + ";")
+		expected.Write(chunk)
+		n, err := w.Write(chunk)
+		assert.NoError(t, err)
+		assert.Equal(t, len(chunk), n)
+	}
+	assert.Less(t, time.Since(start), latency)
+
+	assert.NoError(t, w.flush())
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, latency)
+	assert.Less(t, elapsed, latency*3)
+
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	assert.Equal(t, expected.String(), dst.buff.String())
+	assert.Len(t, dst.writes, 10)
+	assert.GreaterOrEqual(t, dst.writes[0].Sub(start), latency)
+}
+
+func Test_ConnWriterJitterKeepsOrder(t *testing.T) {
+	dst := &timedWriter{}
+	w := newShapedWriter(dst, agentapi.Shaping{Latency: time.Millisecond * 20, Jitter: time.Millisecond * 20})
+	defer w.stop()
+
+	var expected bytes.Buffer
+	for i := 0; i < 50; i++ {
+		chunk := []byte(strconv.Itoa(i) + ",")
+		expected.Write(chunk)
+		_, err := w.Write(chunk)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.flush())
+	assert.Equal(t, expected.String(), dst.buff.String())
+}
+
+func Test_ConnWriterBandwidth(t *testing.T) {
+	dst := &timedWriter{}
+	w := newShapedWriter(dst, agentapi.Shaping{BandwidthBytesPerSec: 1000})
+
+	// 300 bytes at 1000B/s are written in 100 bytes chunks over ~200ms, without any latency queue
+	start := time.Now()
+	n, err := w.Write(make([]byte, 300))
+	assert.NoError(t, err)
+	assert.Equal(t, 300, n)
+	assert.Nil(t, w.delayed)
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*190)
+	assert.Len(t, dst.writes, 3)
+}
+
+func Test_ConnWriterStop(t *testing.T) {
+	dst := &timedWriter{}
+	w := newShapedWriter(dst, agentapi.Shaping{Latency: time.Hour})
+
+	_, err := w.Write([]byte("never"))
+	assert.NoError(t, err)
+	w.stop()
+	assert.NoError(t, w.flush())
+	_, err = w.Write([]byte("closed"))
+	assert.Error(t, err)
+	assert.Empty(t, dst.writes)
+}
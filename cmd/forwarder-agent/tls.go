@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+)
+
+// newOriginateTLSConfig builds the client TLS config used to connect to targets, SNI defaults to targetAddr host.
+func newOriginateTLSConfig(opts agentapi.OriginateTLS, targetAddr string) (*tls.Config, error) {
+	serverName := opts.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(targetAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target address %s: %w", targetAddr, err)
+		}
+		serverName = host
+	}
+
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	caData := opts.CAData
+	if opts.CAFile != "" {
+		data, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+		caData = append(append([]byte{}, caData...), data...)
+	}
+	if len(caData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no CA certificate found in CA bundle")
+		}
+		cfg.RootCAs = pool
+	}
+
+	switch {
+	case opts.CertFile != "":
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	case len(opts.CertData) > 0:
+		cert, err := tls.X509KeyPair(opts.CertData, opts.KeyData)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// originateTLS performs the TLS handshake over the target connection conn, closing it on failure.
+func originateTLS(ctx context.Context, conn net.Conn, cfg *tls.Config) (net.Conn, error) {
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("tls handshake with %s: %w", conn.RemoteAddr(), err)
+	}
+	return tlsConn, nil
+}
@@ -6,7 +6,6 @@ import (
 	"os/signal"
 	"syscall"
 
-	"github.com/abdularis/kportfwd/internal/etchosts"
 	"github.com/abdularis/kportfwd/internal/log"
 
 	"github.com/abdularis/kportfwd/internal/cli"
@@ -14,7 +13,6 @@ import (
 
 func main() {
 	log.SetComponentName("kportfwd")
-	etchosts.Init()
 
 	ctx, cancelFn := context.WithCancel(context.Background())
 	defer cancelFn()
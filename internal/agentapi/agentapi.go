@@ -0,0 +1,124 @@
+// Package agentapi contains types shared between kportfwd and the forwarder agent running on the target pod.
+package agentapi
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// Version is the forwarder agent protocol version, kportfwd only attaches to running agents with the same version.
+const Version = "13"
+
+// TokenEnv is the environment variable holding the session token of a forwarder agent started by hand,
+// every agent api call must present it as a bearer token in the Authorization header.
+// kportfwd passes the token through Bootstrap instead.
+const TokenEnv = "FORWARDER_API_TOKEN"
+
+// Bootstrap is written by kportfwd as a single JSON line on the forwarder agent stdin (`-bootstrap-stdin` argument).
+// It holds secret material which must stay out of the exec command: the command is visible in the pod process
+// list and is sent as pods/exec query parameters, which end up in apiserver audit and proxy logs.
+type Bootstrap struct {
+	Token string `json:"token"`
+	// Forwards are started after the ones given by arguments, in order. Specs may hold client keys (OriginateTLS).
+	Forwards []ForwardSpec `json:"forwards,omitempty"`
+}
+
+// RegistrationFilePrefix is the file name prefix of agent registration files written to the agent state dir.
+const RegistrationFilePrefix = "kportfwd-agent-"
+
+// Registration describes a running forwarder agent, it is written by the agent as JSON
+// into its state dir so that other kportfwd sessions can discover and attach to it.
+// Token is only written to the registration file (readable by the agent user), never served by the api.
+type Registration struct {
+	Session    string      `json:"session"`
+	Token      string      `json:"token,omitempty"`
+	Version    string      `json:"version"`
+	Pid        int         `json:"pid"`
+	APIPort    int         `json:"apiPort"`
+	Forwarders []Forwarder `json:"forwarders"`
+}
+
+// Forwarder describes a single forwarder running on the agent.
+type Forwarder struct {
+	Name       string `json:"name,omitempty"`
+	SourceAddr string `json:"sourceAddr"`
+	TargetAddr string `json:"targetAddr"`
+	// State is ForwarderStateHealthy or ForwarderStateDegraded (every backend is failing health checks),
+	// Error holds the last health check error.
+	State string `json:"state,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	// Spec, Shaping (current traffic shaping), Backends and Connections are only reported by the api and registration, not in events.
+	// Backends are the resolved addresses when Spec resolves targets, Spec.Targets otherwise.
+	// Spec is redacted, it holds no secret material.
+	Spec        *ForwardSpec `json:"spec,omitempty"`
+	Shaping     *Shaping     `json:"shaping,omitempty"`
+	Backends    []Backend    `json:"backends,omitempty"`
+	Connections []Connection `json:"connections,omitempty"`
+}
+
+// Backend is one of the target addresses of a forwarder.
+type Backend struct {
+	Addr              string `json:"addr"`
+	Weight            int    `json:"weight,omitempty"`
+	State             string `json:"state"`
+	Error             string `json:"error,omitempty"`
+	ActiveConnections int    `json:"activeConnections"`
+}
+
+// Connection is an active forwarded connection and the backend it went to.
+type Connection struct {
+	RemoteAddr string    `json:"remoteAddr"`
+	Backend    string    `json:"backend"`
+	Since      time.Time `json:"since"`
+}
+
+// RegistrationFilePath returns registration file path of given session inside stateDir.
+func RegistrationFilePath(stateDir, session string) string {
+	return path.Join(stateDir, fmt.Sprintf("%s%s.json", RegistrationFilePrefix, session))
+}
+
+// EventVersion is the version of the agent event protocol. Events are written by the agent
+// as JSON lines on its stdout (logs go to stderr) and streamed by the /events api as server-sent events.
+const EventVersion = 1
+
+// Event types emitted by the forwarder agent.
+const (
+	EventReady              = "ready"
+	EventForwarderStarted   = "forwarder_started"
+	EventForwarderStopped   = "forwarder_stopped"
+	EventConnectionOpened   = "connection_opened"
+	EventConnectionClosed   = "connection_closed"
+	EventHealthCheckFailure = "health_check_failure"
+	EventHealthCheckRecover = "health_check_recover"
+	EventHTTPExchange       = "http_exchange"
+	EventShutdown           = "shutdown"
+)
+
+// Event is a single structured event emitted by the forwarder agent.
+type Event struct {
+	Version int       `json:"version"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+
+	// Session and APIPort are set on EventReady.
+	Session string `json:"session,omitempty"`
+	APIPort int    `json:"apiPort,omitempty"`
+
+	// Forwarders are set on EventReady, Forwarder on forwarder, connection and health check events.
+	Forwarders []Forwarder `json:"forwarders,omitempty"`
+	Forwarder  *Forwarder  `json:"forwarder,omitempty"`
+
+	// RemoteAddr is the client address of connection events.
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	// Backend is the target address of connection and health check events.
+	Backend string `json:"backend,omitempty"`
+
+	// HTTP is the exchange summary of EventHTTPExchange.
+	HTTP *HTTPExchange `json:"http,omitempty"`
+
+	// Reason describes why the forwarder, connection or agent stopped.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
@@ -0,0 +1,33 @@
+package agentapi
+
+import "time"
+
+// Capture record types.
+const (
+	CaptureOpen  = "open"
+	CaptureData  = "data"
+	CaptureClose = "close"
+)
+
+// Capture directions of data records.
+const (
+	CaptureToTarget = "toTarget"
+	CaptureToClient = "toClient"
+)
+
+// CaptureRecord is a single captured connection event of a forwarder, streamed by the agent `/capture` api as JSON lines
+// while the request is open. Connections already open when the capture started have no open record.
+type CaptureRecord struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// ConnID identifies the connection within the forwarder.
+	ConnID uint64 `json:"connId"`
+	// ClientAddr and TargetAddr are the ip:port of both ends as seen by the agent.
+	ClientAddr string `json:"clientAddr"`
+	TargetAddr string `json:"targetAddr"`
+	// Direction and Data are set on data records.
+	Direction string `json:"direction,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+	// Dropped is the number of records dropped before this one because the capture client was too slow.
+	Dropped int `json:"dropped,omitempty"`
+}
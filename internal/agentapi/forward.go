@@ -0,0 +1,333 @@
+package agentapi
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Health check modes.
+const (
+	HealthCheckModeTCP  = "tcp"
+	HealthCheckModeHTTP = "http"
+	HealthCheckModeNone = "none"
+)
+
+// Health check protocols, HealthCheckProtocolTCP and HealthCheckProtocolHTTP are the same checks as their mode counterpart.
+const (
+	HealthCheckProtocolTCP      = "tcp"
+	HealthCheckProtocolHTTP     = "http"
+	HealthCheckProtocolHTTPS    = "https"
+	HealthCheckProtocolPostgres = "postgres"
+	HealthCheckProtocolMySQL    = "mysql"
+	HealthCheckProtocolRedis    = "redis"
+	HealthCheckProtocolGRPC     = "grpc"
+)
+
+// Forwarder health states.
+const (
+	ForwarderStateHealthy  = "healthy"
+	ForwarderStateDegraded = "degraded"
+)
+
+// Balance strategies used to pick a target when a forward has multiple targets.
+const (
+	// BalanceFailover dials targets in order, skipping the ones failing health checks.
+	BalanceFailover = "failover"
+	// BalanceRoundRobin spreads connections across healthy targets following their weight.
+	BalanceRoundRobin = "roundRobin"
+	// BalanceLeastConnections picks the healthy target with the fewest active connections.
+	BalanceLeastConnections = "leastConnections"
+	// BalanceSticky always picks the same healthy target for a client address.
+	BalanceSticky = "sticky"
+)
+
+// ForwardSpec is a single forward passed by kportfwd to the forwarder agent, encoded as JSON in Bootstrap.Forwards
+// on the agent stdin. Agents started by hand take them as `-forward` arguments as well.
+type ForwardSpec struct {
+	Name       string `json:"name,omitempty"`
+	SourceAddr string `json:"sourceAddr"`
+	TargetAddr string `json:"targetAddr"`
+	// Targets, when set, replaces TargetAddr with a list of targets picked following Balance.
+	Targets []Target `json:"targets,omitempty"`
+	Balance string   `json:"balance,omitempty"`
+	// ResolveAll makes the agent resolve every A/AAAA record of the target hosts (e.g. a headless service)
+	// and balance connections across all of them instead of dialing whatever DNS returns first.
+	ResolveAll bool `json:"resolveAll,omitempty"`
+	// Ordinal pins the forward to a single StatefulSet pod behind a headless service target,
+	// dialed as <StatefulSet>-<Ordinal>.<target host>. It implies ResolveAll.
+	Ordinal *int `json:"ordinal,omitempty"`
+	// StatefulSet is the name of the StatefulSet of Ordinal, defaults to the target service name.
+	StatefulSet string      `json:"statefulSet,omitempty"`
+	HealthCheck HealthCheck `json:"healthCheck"`
+	// ProxyProtocol makes every connection start with a PROXY protocol v1 header written by kportfwd,
+	// carrying the address of the local client. BalanceSticky hashes it, the agent only sees 127.0.0.1.
+	ProxyProtocol bool `json:"proxyProtocol,omitempty"`
+
+	// MaxConnections limits concurrent connections, further connections are refused. Zero means unlimited.
+	MaxConnections int `json:"maxConnections,omitempty"`
+	// IdleTimeout closes connections without traffic in either direction for that long. Zero disables it.
+	IdleTimeout time.Duration `json:"idleTimeout,omitempty"`
+	// MaxConnectionLifetime closes connections open for that long. Zero disables it.
+	MaxConnectionLifetime time.Duration `json:"maxConnectionLifetime,omitempty"`
+	// DrainTimeout is how long active connections are given to finish once the agent shuts down
+	// (SIGTERM or ping timeout) before being closed, defaults to 5s.
+	DrainTimeout time.Duration `json:"drainTimeout,omitempty"`
+
+	// OriginateTLS, when set, wraps connections to targets in TLS.
+	OriginateTLS *OriginateTLS `json:"originateTLS,omitempty"`
+
+	// HTTP, when set, forwards HTTP/1.1 requests one by one instead of copying raw bytes.
+	HTTP *HTTPOptions `json:"http,omitempty"`
+
+	// Shaping is the initial traffic shaping of the forward, it can be changed at runtime through the agent api.
+	Shaping Shaping `json:"shaping,omitempty"`
+
+	// SecretValues are values of Secrets rendered into the target addresses. The agent replaces them with Redacted
+	// in the addresses, backends and errors it logs and reports, they are never reported themselves.
+	SecretValues []string `json:"secretValues,omitempty"`
+}
+
+// Target is one of the forward target addresses, Weight is only used by BalanceRoundRobin and defaults to 1.
+type Target struct {
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// Validate returns an error on invalid forward options.
+func (s ForwardSpec) Validate() error {
+	switch s.Balance {
+	case "", BalanceFailover, BalanceRoundRobin, BalanceLeastConnections, BalanceSticky:
+	default:
+		return fmt.Errorf("unknown balance strategy: %s (expected '%s', '%s', '%s' or '%s')",
+			s.Balance, BalanceFailover, BalanceRoundRobin, BalanceLeastConnections, BalanceSticky)
+	}
+
+	if s.Ordinal != nil && *s.Ordinal < 0 {
+		return fmt.Errorf("ordinal must not be negative")
+	}
+	if s.StatefulSet != "" && s.Ordinal == nil {
+		return fmt.Errorf("statefulSet requires an ordinal")
+	}
+
+	if s.MaxConnections < 0 || s.IdleTimeout < 0 || s.MaxConnectionLifetime < 0 || s.DrainTimeout < 0 {
+		return fmt.Errorf("maxConnections, idleTimeout, maxConnectionLifetime and drainTimeout must not be negative")
+	}
+
+	if err := s.Shaping.Validate(); err != nil {
+		return err
+	}
+
+	if s.HTTP != nil {
+		if err := s.HTTP.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if s.OriginateTLS != nil {
+		if err := s.OriginateTLS.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, target := range s.Targets {
+		if target.Addr == "" {
+			return fmt.Errorf("target address must not be empty")
+		}
+		if target.Weight < 0 {
+			return fmt.Errorf("target %s weight must not be negative", target.Addr)
+		}
+	}
+
+	return s.HealthCheck.Validate()
+}
+
+// Resolve reports whether target hosts are resolved into one target per address.
+func (s ForwardSpec) Resolve() bool {
+	return s.ResolveAll || s.Ordinal != nil
+}
+
+// TargetList returns Targets, or TargetAddr as the single target when Targets is empty.
+func (s ForwardSpec) TargetList() []Target {
+	if len(s.Targets) > 0 {
+		return s.Targets
+	}
+	return []Target{{Addr: s.TargetAddr}}
+}
+
+// HealthCheck defines how the forwarder agent checks a forward target.
+// A target failing FailureThreshold consecutive checks is marked degraded, connections to it
+// are refused while it's degraded and it's marked healthy again on the first successful check.
+type HealthCheck struct {
+	// Mode is one of HealthCheckModeTCP (default, dial the target), HealthCheckModeHTTP (GET Path
+	// expecting 2xx or 3xx status) or HealthCheckModeNone (target is always considered healthy).
+	Mode string `json:"mode,omitempty" yaml:"mode"`
+	// Protocol selects a protocol-aware check telling whether the target actually serves rather than only accepting TCP:
+	// HealthCheckProtocolPostgres (SSL request), HealthCheckProtocolMySQL (handshake packet), HealthCheckProtocolRedis (PING),
+	// HealthCheckProtocolHTTP / HealthCheckProtocolHTTPS (GET Path status code) or HealthCheckProtocolGRPC (grpc.health.v1 over h2c).
+	// Defaults to the check of Mode.
+	Protocol string `json:"protocol,omitempty" yaml:"protocol"`
+	// Path requested on http(s) checks, defaults to "/".
+	Path string `json:"path,omitempty" yaml:"path"`
+	// Service is the service name sent on grpc health check, empty checks the server overall health.
+	Service string `json:"service,omitempty" yaml:"service"`
+	// InsecureSkipVerify skips certificate verification of https checks. Certificates are verified as the forward
+	// does when it originates TLS, against the target host with the system roots otherwise.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty" yaml:"insecureSkipVerify"`
+	// Interval between checks, defaults to 15s.
+	Interval time.Duration `json:"interval,omitempty" yaml:"interval"`
+	// Timeout of a single check, defaults to 5s.
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout"`
+	// FailureThreshold is the number of consecutive failed checks before target is marked degraded, defaults to 3.
+	FailureThreshold int `json:"failureThreshold,omitempty" yaml:"failureThreshold"`
+}
+
+// Validate returns an error on unknown mode or negative values.
+func (h HealthCheck) Validate() error {
+	switch h.Mode {
+	case "", HealthCheckModeTCP, HealthCheckModeHTTP, HealthCheckModeNone:
+	default:
+		return fmt.Errorf("unknown health check mode: %s (expected '%s', '%s' or '%s')", h.Mode, HealthCheckModeTCP, HealthCheckModeHTTP, HealthCheckModeNone)
+	}
+
+	switch h.Protocol {
+	case "", HealthCheckProtocolTCP, HealthCheckProtocolHTTP, HealthCheckProtocolHTTPS, HealthCheckProtocolPostgres,
+		HealthCheckProtocolMySQL, HealthCheckProtocolRedis, HealthCheckProtocolGRPC:
+	default:
+		return fmt.Errorf("unknown health check protocol: %s", h.Protocol)
+	}
+	if h.Mode == HealthCheckModeNone && h.Protocol != "" {
+		return fmt.Errorf("health check protocol %s can't be used with mode %s", h.Protocol, HealthCheckModeNone)
+	}
+	// NOTE: Mode http is a GET request and protocols http and https are the same check, any other protocol conflicts
+	// with it. Mode tcp only dials the target, protocols http and https contradict it
+	httpProtocol := h.Protocol == HealthCheckProtocolHTTP || h.Protocol == HealthCheckProtocolHTTPS
+	if h.Protocol != "" && ((h.Mode == HealthCheckModeHTTP && !httpProtocol) || (h.Mode == HealthCheckModeTCP && httpProtocol)) {
+		return fmt.Errorf("health check protocol %s can't be used with mode %s", h.Protocol, h.Mode)
+	}
+	if h.InsecureSkipVerify && h.Protocol != HealthCheckProtocolHTTPS {
+		return fmt.Errorf("health check insecureSkipVerify only applies to protocol %s", HealthCheckProtocolHTTPS)
+	}
+
+	if h.Interval < 0 || h.Timeout < 0 || h.FailureThreshold < 0 {
+		return fmt.Errorf("health check interval, timeout and failure threshold must not be negative")
+	}
+	return nil
+}
+
+// WithDefaults returns a copy of the health check with unset fields set to their default value.
+func (h HealthCheck) WithDefaults() HealthCheck {
+	if h.Mode == "" {
+		h.Mode = HealthCheckModeTCP
+	}
+	if h.Protocol == "" && h.Mode != HealthCheckModeNone {
+		h.Protocol = h.Mode
+	}
+	if h.Path == "" {
+		h.Path = "/"
+	}
+	if h.Interval == 0 {
+		h.Interval = time.Second * 15
+	}
+	if h.Timeout == 0 {
+		h.Timeout = time.Second * 5
+	}
+	if h.FailureThreshold == 0 {
+		h.FailureThreshold = 3
+	}
+	return h
+}
+
+// Shaping degrades forwarded traffic, to test how clients behave against a slow or flaky target.
+// Every option applies to each direction of a connection on its own, zero values disable them.
+type Shaping struct {
+	// BandwidthBytesPerSec caps throughput of each direction.
+	BandwidthBytesPerSec int64 `json:"bandwidthBytesPerSec,omitempty" yaml:"bandwidthBytesPerSec"`
+	// Latency delays every forwarded chunk of data, by a random extra delay up to Jitter in either way.
+	// Chunks are delayed as on a slow link, throughput is only capped by BandwidthBytesPerSec.
+	Latency time.Duration `json:"latency,omitempty" yaml:"latency"`
+	Jitter  time.Duration `json:"jitter,omitempty" yaml:"jitter"`
+	// ResetProbability is the probability (0 to 1) of resetting the connection on every forwarded chunk of data.
+	ResetProbability float64 `json:"resetProbability,omitempty" yaml:"resetProbability"`
+}
+
+// Validate returns an error on invalid shaping options.
+func (s Shaping) Validate() error {
+	if s.BandwidthBytesPerSec < 0 || s.Latency < 0 || s.Jitter < 0 {
+		return fmt.Errorf("shaping bandwidthBytesPerSec, latency and jitter must not be negative")
+	}
+	if s.ResetProbability < 0 || s.ResetProbability > 1 {
+		return fmt.Errorf("shaping resetProbability must be between 0 and 1, got %v", s.ResetProbability)
+	}
+	return nil
+}
+
+// Enabled reports whether any shaping option is set.
+func (s Shaping) Enabled() bool {
+	return s != Shaping{}
+}
+
+// OriginateTLS makes the forwarder agent connect to targets over TLS, clients keep connecting in plaintext.
+type OriginateTLS struct {
+	// ServerName is sent as SNI and verified against the target certificate, defaults to TargetAddr host.
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+	// CA bundle used to verify the target (system roots by default) and optional client certificate,
+	// either as file paths in the agent container or PEM data.
+	CAFile   string `json:"caFile,omitempty"`
+	CAData   []byte `json:"caData,omitempty"`
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	CertData []byte `json:"certData,omitempty"`
+	KeyData  []byte `json:"keyData,omitempty"`
+}
+
+// Validate returns an error on invalid TLS options.
+func (t OriginateTLS) Validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("originateTLS certFile and keyFile must be set together")
+	}
+	if (len(t.CertData) == 0) != (len(t.KeyData) == 0) {
+		return fmt.Errorf("originateTLS client certificate and key must be set together")
+	}
+	return nil
+}
+
+// Redacted replaces secret values in reported addresses.
+const Redacted = "REDACTED"
+
+// RedactSecrets returns s with every non empty value of secrets replaced by Redacted.
+func RedactSecrets(s string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, Redacted)
+		}
+	}
+	return s
+}
+
+// Redact returns s with SecretValues replaced by Redacted.
+func (s ForwardSpec) Redact(str string) string {
+	return RedactSecrets(str, s.SecretValues)
+}
+
+// Redacted returns spec without secret material, as reported by the agent.
+func (s ForwardSpec) Redacted() ForwardSpec {
+	if s.OriginateTLS != nil && len(s.OriginateTLS.KeyData) > 0 {
+		originateTLS := *s.OriginateTLS
+		originateTLS.KeyData = nil
+		s.OriginateTLS = &originateTLS
+	}
+	if len(s.SecretValues) > 0 {
+		s.TargetAddr = s.Redact(s.TargetAddr)
+		targets := make([]Target, len(s.Targets))
+		for idx, target := range s.Targets {
+			targets[idx] = Target{Addr: s.Redact(target.Addr), Weight: target.Weight}
+		}
+		if len(targets) > 0 {
+			s.Targets = targets
+		}
+		s.SecretValues = nil
+	}
+	return s
+}
@@ -0,0 +1,81 @@
+package agentapi
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTPOptions enables the HTTP/1.1 aware layer of a forward with an http:// target,
+// requests are read and forwarded one by one instead of copying raw bytes.
+type HTTPOptions struct {
+	// Inspect records request/response exchanges, served by the agent `/http/exchanges` api.
+	Inspect bool `json:"inspect,omitempty"`
+
+	// RewriteHost replaces the Host header of requests, e.g. for ingresses and virtual-host based services
+	// rejecting `Host: 127.0.0.1:8080`.
+	RewriteHost string `json:"rewriteHost,omitempty"`
+	// AddHeaders are set on requests, replacing headers with the same name.
+	AddHeaders map[string]string `json:"addHeaders,omitempty"`
+	// StripPathPrefix is removed from request paths starting with it.
+	StripPathPrefix string `json:"stripPathPrefix,omitempty"`
+}
+
+// Validate returns an error on invalid http options.
+func (o HTTPOptions) Validate() error {
+	if o.StripPathPrefix != "" && !strings.HasPrefix(o.StripPathPrefix, "/") {
+		return fmt.Errorf("stripPathPrefix must start with /, got %s", o.StripPathPrefix)
+	}
+	for name := range o.AddHeaders {
+		if name == "" || strings.ContainsAny(name, " :\t\r\n") {
+			return fmt.Errorf("invalid header name in addHeaders: %q", name)
+		}
+	}
+	return nil
+}
+
+// Rewrite reports whether requests are rewritten.
+func (o HTTPOptions) Rewrite() bool {
+	return o.RewriteHost != "" || len(o.AddHeaders) > 0 || o.StripPathPrefix != ""
+}
+
+// HTTPExchange is a request/response exchange recorded by an inspected HTTP forward.
+type HTTPExchange struct {
+	ID         uint64    `json:"id"`
+	Time       time.Time `json:"time"`
+	ConnID     uint64    `json:"connId,omitempty"`
+	ClientAddr string    `json:"clientAddr,omitempty"`
+	Backend    string    `json:"backend"`
+	// Replay is set on exchanges made by replaying a recorded request.
+	Replay bool `json:"replay,omitempty"`
+
+	Method string `json:"method"`
+	Host   string `json:"host"`
+	URL    string `json:"url"`
+	Proto  string `json:"proto"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// Latency is the time until response headers were received, Duration until the whole response was sent back.
+	Latency  time.Duration `json:"latency"`
+	Duration time.Duration `json:"duration"`
+	// RequestSize and ResponseSize are body sizes in bytes.
+	RequestSize  int64 `json:"requestSize"`
+	ResponseSize int64 `json:"responseSize"`
+
+	// Headers and bodies are only served when getting a single exchange, bodies are truncated to the first 16KiB.
+	RequestHeader         http.Header `json:"requestHeader,omitempty"`
+	ResponseHeader        http.Header `json:"responseHeader,omitempty"`
+	RequestBody           []byte      `json:"requestBody,omitempty"`
+	RequestBodyTruncated  bool        `json:"requestBodyTruncated,omitempty"`
+	ResponseBody          []byte      `json:"responseBody,omitempty"`
+	ResponseBodyTruncated bool        `json:"responseBodyTruncated,omitempty"`
+}
+
+// Summary returns exchange without headers and bodies.
+func (e HTTPExchange) Summary() HTTPExchange {
+	e.RequestHeader, e.ResponseHeader = nil, nil
+	e.RequestBody, e.ResponseBody = nil, nil
+	return e
+}
@@ -0,0 +1,60 @@
+package agentapi
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// maxProxyHeaderLen is the longest PROXY protocol v1 header, including the trailing CRLF.
+const maxProxyHeaderLen = 107
+
+// WriteProxyHeader writes a PROXY protocol v1 header telling the agent the address of the local client,
+// which is otherwise lost through the kubernetes port forward. Non TCP addresses are sent as UNKNOWN.
+func WriteProxyHeader(w io.Writer, client, local net.Addr) error {
+	header := "PROXY UNKNOWN\r\n"
+	clientAddr, clientOK := client.(*net.TCPAddr)
+	localAddr, localOK := local.(*net.TCPAddr)
+	if clientOK && localOK {
+		family := "TCP6"
+		if clientAddr.IP.To4() != nil && localAddr.IP.To4() != nil {
+			family = "TCP4"
+		}
+		header = fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, clientAddr.IP, localAddr.IP, clientAddr.Port, localAddr.Port)
+	}
+	_, err := io.WriteString(w, header)
+	return err
+}
+
+// ReadProxyHeader reads a PROXY protocol v1 header and returns the client address it carries as host:port,
+// empty for UNKNOWN. It reads byte by byte so that nothing after the header is consumed.
+func ReadProxyHeader(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for !strings.HasSuffix(string(line), "\r\n") {
+		if len(line) >= maxProxyHeaderLen {
+			return "", fmt.Errorf("proxy header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", fmt.Errorf("unable to read proxy header: %w", err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return "", fmt.Errorf("invalid proxy header: %q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return "", nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 || net.ParseIP(fields[2]) == nil {
+			return "", fmt.Errorf("invalid proxy header: %q", line)
+		}
+		return net.JoinHostPort(fields[2], fields[4]), nil
+	default:
+		return "", fmt.Errorf("invalid proxy header: %q", line)
+	}
+}
@@ -0,0 +1,64 @@
+package agentapi
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ProxyHeader(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Client   net.Addr
+		Local    net.Addr
+		Header   string
+		Expected string
+	}{
+		{
+			Name:     "tcp4",
+			Client:   &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 51234},
+			Local:    &net.TCPAddr{IP: net.ParseIP("10.0.0.10"), Port: 5432},
+			Header:   "PROXY TCP4 192.168.1.20 10.0.0.10 51234 5432\r\n",
+			Expected: "192.168.1.20:51234",
+		},
+		{
+			Name:     "tcp6",
+			Client:   &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 40000},
+			Local:    &net.TCPAddr{IP: net.ParseIP("::1"), Port: 6379},
+			Header:   "PROXY TCP6 fd00::1 ::1 40000 6379\r\n",
+			Expected: "[fd00::1]:40000",
+		},
+		{
+			Name:     "unknown",
+			Client:   &net.UnixAddr{Name: "/tmp/client.sock", Net: "unix"},
+			Local:    &net.UnixAddr{Name: "/tmp/server.sock", Net: "unix"},
+			Header:   "PROXY UNKNOWN\r\n",
+			Expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			buff := &bytes.Buffer{}
+			assert.NoError(t, WriteProxyHeader(buff, tt.Client, tt.Local))
+			assert.Equal(t, tt.Header, buff.String())
+
+			// the connection data following the header is left unread
+			buff.WriteString("payload")
+			addr, err := ReadProxyHeader(buff)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.Expected, addr)
+			rest, _ := io.ReadAll(buff)
+			assert.Equal(t, "payload", string(rest))
+		})
+	}
+
+	for _, header := range []string{"GET / HTTP/1.1\r\n", "PROXY TCP4 nope 10.0.0.10 1 2\r\n", "PROXY TCP4 1.2.3.4\r\n", strings.Repeat("A", 200)} {
+		_, err := ReadProxyHeader(strings.NewReader(header))
+		assert.Error(t, err, header)
+	}
+}
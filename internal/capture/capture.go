@@ -0,0 +1,32 @@
+// Package capture writes forwarder agent capture records as pcapng files or readable hexdumps.
+package capture
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+)
+
+// Capture formats.
+const (
+	FormatPcapng  = "pcapng"
+	FormatHexdump = "hexdump"
+)
+
+// Writer writes capture records in a capture format.
+type Writer interface {
+	WriteRecord(record agentapi.CaptureRecord) error
+}
+
+// NewWriter returns a Writer of given format writing to w.
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case FormatPcapng:
+		return NewPcapngWriter(w)
+	case FormatHexdump:
+		return NewHexdumpWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown capture format: %s (expected '%s' or '%s')", format, FormatPcapng, FormatHexdump)
+	}
+}
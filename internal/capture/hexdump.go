@@ -0,0 +1,43 @@
+package capture
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+)
+
+// HexdumpWriter writes capture records as readable text, data as `hexdump -C` does.
+type HexdumpWriter struct {
+	w io.Writer
+}
+
+func NewHexdumpWriter(w io.Writer) *HexdumpWriter {
+	return &HexdumpWriter{w: w}
+}
+
+func (h *HexdumpWriter) WriteRecord(record agentapi.CaptureRecord) error {
+	timestamp := record.Time.UTC().Format(time.RFC3339Nano)
+	if record.Dropped > 0 {
+		if _, err := fmt.Fprintf(h.w, "%s %d records dropped, capture is too slow\n", timestamp, record.Dropped); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch record.Type {
+	case agentapi.CaptureOpen:
+		_, err = fmt.Fprintf(h.w, "%s conn %d %s -> %s opened\n", timestamp, record.ConnID, record.ClientAddr, record.TargetAddr)
+	case agentapi.CaptureClose:
+		_, err = fmt.Fprintf(h.w, "%s conn %d %s -> %s closed\n", timestamp, record.ConnID, record.ClientAddr, record.TargetAddr)
+	case agentapi.CaptureData:
+		src, dst := record.ClientAddr, record.TargetAddr
+		if record.Direction == agentapi.CaptureToClient {
+			src, dst = dst, src
+		}
+		_, err = fmt.Fprintf(h.w, "%s conn %d %s -> %s (%d bytes)\n%s\n", timestamp, record.ConnID, src, dst, len(record.Data), hex.Dump(record.Data))
+	}
+	return err
+}
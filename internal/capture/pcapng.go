@@ -0,0 +1,239 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+)
+
+const (
+	pcapngBlockSectionHeader  = 0x0A0D0D0A
+	pcapngBlockInterface      = 0x00000001
+	pcapngBlockEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic      = 0x1A2B3C4D
+	pcapngLinkTypeRaw         = 101 // raw IPv4 or IPv6 packets, no link layer header
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	// tcpClientISN and tcpTargetISN are the synthesized initial sequence numbers
+	tcpClientISN = 1000
+	tcpTargetISN = 2000
+
+	// tcpMaxSegmentPayload keeps synthesized segments within the IP packet length limit
+	tcpMaxSegmentPayload = 65000
+	ipv4HeaderLen        = 20
+	ipv6HeaderLen        = 40
+	tcpHeaderLen         = 20
+)
+
+// PcapngWriter writes capture records as a pcapng file readable by Wireshark or tcpdump. The agent only sees
+// connection payloads, so every record is wrapped into synthesized IP and TCP headers: a handshake for each
+// connection (also for connections captured mid-way), a segment per data record and FINs once closed.
+type PcapngWriter struct {
+	w     io.Writer
+	conns map[uint64]*tcpStream
+	ipID  uint16
+}
+
+// tcpStream is the synthesized TCP state of a captured connection.
+type tcpStream struct {
+	client, target       netip.AddrPort
+	clientSeq, targetSeq uint32
+}
+
+// NewPcapngWriter writes pcapng section header and interface description to w and returns the writer.
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	header := &bytes.Buffer{}
+	// section header block: byte order magic, version 1.0, unknown section length
+	_ = binary.Write(header, binary.LittleEndian, uint32(pcapngByteOrderMagic))
+	_ = binary.Write(header, binary.LittleEndian, uint16(1))
+	_ = binary.Write(header, binary.LittleEndian, uint16(0))
+	_ = binary.Write(header, binary.LittleEndian, int64(-1))
+	if err := writePcapngBlock(w, pcapngBlockSectionHeader, header.Bytes()); err != nil {
+		return nil, err
+	}
+
+	iface := &bytes.Buffer{}
+	// interface description block: link type, reserved, no snap length, microseconds timestamps (default)
+	_ = binary.Write(iface, binary.LittleEndian, uint16(pcapngLinkTypeRaw))
+	_ = binary.Write(iface, binary.LittleEndian, uint16(0))
+	_ = binary.Write(iface, binary.LittleEndian, uint32(0))
+	if err := writePcapngBlock(w, pcapngBlockInterface, iface.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return &PcapngWriter{w: w, conns: map[uint64]*tcpStream{}}, nil
+}
+
+func (p *PcapngWriter) WriteRecord(record agentapi.CaptureRecord) error {
+	stream, err := p.stream(record)
+	if err != nil {
+		return err
+	}
+
+	switch record.Type {
+	case agentapi.CaptureData:
+		for data := record.Data; len(data) > 0; {
+			segment := data[:min(len(data), tcpMaxSegmentPayload)]
+			data = data[len(segment):]
+
+			if record.Direction == agentapi.CaptureToClient {
+				err = p.writeSegment(record, stream.target, stream.client, stream.targetSeq, stream.clientSeq, tcpFlagPSH|tcpFlagACK, segment)
+				stream.targetSeq += uint32(len(segment))
+			} else {
+				err = p.writeSegment(record, stream.client, stream.target, stream.clientSeq, stream.targetSeq, tcpFlagPSH|tcpFlagACK, segment)
+				stream.clientSeq += uint32(len(segment))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case agentapi.CaptureClose:
+		delete(p.conns, record.ConnID)
+		if err := p.writeSegment(record, stream.client, stream.target, stream.clientSeq, stream.targetSeq, tcpFlagFIN|tcpFlagACK, nil); err != nil {
+			return err
+		}
+		if err := p.writeSegment(record, stream.target, stream.client, stream.targetSeq, stream.clientSeq+1, tcpFlagFIN|tcpFlagACK, nil); err != nil {
+			return err
+		}
+		return p.writeSegment(record, stream.client, stream.target, stream.clientSeq+1, stream.targetSeq+1, tcpFlagACK, nil)
+	}
+	return nil
+}
+
+// stream returns TCP state of record connection, a handshake is written for connections not seen yet.
+func (p *PcapngWriter) stream(record agentapi.CaptureRecord) (*tcpStream, error) {
+	if stream, ok := p.conns[record.ConnID]; ok {
+		return stream, nil
+	}
+
+	client, err := netip.ParseAddrPort(record.ClientAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client address %s: %w", record.ClientAddr, err)
+	}
+	target, err := netip.ParseAddrPort(record.TargetAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target address %s: %w", record.TargetAddr, err)
+	}
+	client, target = sameAddrFamily(client, target)
+
+	stream := &tcpStream{client: client, target: target, clientSeq: tcpClientISN + 1, targetSeq: tcpTargetISN + 1}
+	p.conns[record.ConnID] = stream
+
+	if err := p.writeSegment(record, client, target, tcpClientISN, 0, tcpFlagSYN, nil); err != nil {
+		return nil, err
+	}
+	if err := p.writeSegment(record, target, client, tcpTargetISN, stream.clientSeq, tcpFlagSYN|tcpFlagACK, nil); err != nil {
+		return nil, err
+	}
+	if err := p.writeSegment(record, client, target, stream.clientSeq, stream.targetSeq, tcpFlagACK, nil); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// sameAddrFamily maps both addresses to IPv6 unless both are IPv4, so that they fit a single IP header.
+func sameAddrFamily(a, b netip.AddrPort) (netip.AddrPort, netip.AddrPort) {
+	a = netip.AddrPortFrom(a.Addr().Unmap(), a.Port())
+	b = netip.AddrPortFrom(b.Addr().Unmap(), b.Port())
+	if a.Addr().Is4() && b.Addr().Is4() {
+		return a, b
+	}
+	return netip.AddrPortFrom(netip.AddrFrom16(a.Addr().As16()), a.Port()),
+		netip.AddrPortFrom(netip.AddrFrom16(b.Addr().As16()), b.Port())
+}
+
+func (p *PcapngWriter) writeSegment(record agentapi.CaptureRecord, src, dst netip.AddrPort, seq, ack uint32, flags byte, payload []byte) error {
+	tcp := make([]byte, tcpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = (tcpHeaderLen / 4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	copy(tcp[tcpHeaderLen:], payload)
+
+	pseudo := &bytes.Buffer{}
+	pseudo.Write(src.Addr().AsSlice())
+	pseudo.Write(dst.Addr().AsSlice())
+	var packet []byte
+	if src.Addr().Is4() {
+		pseudo.Write([]byte{0, 6})
+		_ = binary.Write(pseudo, binary.BigEndian, uint16(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(append(pseudo.Bytes(), tcp...)))
+
+		p.ipID++
+		packet = make([]byte, ipv4HeaderLen, ipv4HeaderLen+len(tcp))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(ipv4HeaderLen+len(tcp)))
+		binary.BigEndian.PutUint16(packet[4:], p.ipID)
+		binary.BigEndian.PutUint16(packet[6:], 0x4000) // don't fragment
+		packet[8] = 64                                 // ttl
+		packet[9] = 6                                  // tcp
+		copy(packet[12:], src.Addr().AsSlice())
+		copy(packet[16:], dst.Addr().AsSlice())
+		binary.BigEndian.PutUint16(packet[10:], checksum(packet))
+	} else {
+		_ = binary.Write(pseudo, binary.BigEndian, uint32(len(tcp)))
+		pseudo.Write([]byte{0, 0, 0, 6})
+		binary.BigEndian.PutUint16(tcp[16:], checksum(append(pseudo.Bytes(), tcp...)))
+
+		packet = make([]byte, ipv6HeaderLen, ipv6HeaderLen+len(tcp))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = 6  // tcp
+		packet[7] = 64 // hop limit
+		copy(packet[8:], src.Addr().AsSlice())
+		copy(packet[24:], dst.Addr().AsSlice())
+	}
+	packet = append(packet, tcp...)
+
+	// enhanced packet block: interface 0, timestamp in microseconds, captured and original length, padded packet
+	timestamp := uint64(record.Time.UnixMicro())
+	body := &bytes.Buffer{}
+	_ = binary.Write(body, binary.LittleEndian, uint32(0))
+	_ = binary.Write(body, binary.LittleEndian, uint32(timestamp>>32))
+	_ = binary.Write(body, binary.LittleEndian, uint32(timestamp))
+	_ = binary.Write(body, binary.LittleEndian, uint32(len(packet)))
+	_ = binary.Write(body, binary.LittleEndian, uint32(len(packet)))
+	body.Write(packet)
+	body.Write(make([]byte, (4-len(packet)%4)%4))
+	return writePcapngBlock(p.w, pcapngBlockEnhancedPacket, body.Bytes())
+}
+
+// writePcapngBlock writes a pcapng block, body must be padded to 32 bits.
+func writePcapngBlock(w io.Writer, blockType uint32, body []byte) error {
+	totalLen := uint32(12 + len(body))
+	block := &bytes.Buffer{}
+	_ = binary.Write(block, binary.LittleEndian, blockType)
+	_ = binary.Write(block, binary.LittleEndian, totalLen)
+	block.Write(body)
+	_ = binary.Write(block, binary.LittleEndian, totalLen)
+	_, err := w.Write(block.Bytes())
+	return err
+}
+
+// checksum returns the internet checksum (RFC 1071) of data.
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,71 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PcapngWriter(t *testing.T) {
+	output := &bytes.Buffer{}
+	writer, err := NewPcapngWriter(output)
+	assert.NoError(t, err)
+
+	record := agentapi.CaptureRecord{
+		Time:       time.Unix(1700000000, 0),
+		ConnID:     1,
+		ClientAddr: "127.0.0.1:40000",
+		TargetAddr: "10.0.0.5:5432",
+	}
+	for _, r := range []agentapi.CaptureRecord{
+		{Type: agentapi.CaptureOpen},
+		{Type: agentapi.CaptureData, Direction: agentapi.CaptureToTarget, Data: []byte("hello")},
+		{Type: agentapi.CaptureData, Direction: agentapi.CaptureToClient, Data: []byte("world!")},
+		{Type: agentapi.CaptureClose},
+	} {
+		record.Type, record.Direction, record.Data = r.Type, r.Direction, r.Data
+		assert.NoError(t, writer.WriteRecord(record))
+	}
+
+	var blockTypes []uint32
+	var packets [][]byte
+	data := output.Bytes()
+	for len(data) > 0 {
+		blockType := binary.LittleEndian.Uint32(data)
+		blockLen := binary.LittleEndian.Uint32(data[4:])
+		assert.Equal(t, uint32(0), blockLen%4)
+		assert.Equal(t, blockLen, binary.LittleEndian.Uint32(data[blockLen-4:]))
+
+		blockTypes = append(blockTypes, blockType)
+		if blockType == pcapngBlockEnhancedPacket {
+			capturedLen := binary.LittleEndian.Uint32(data[20:])
+			packets = append(packets, data[28:28+capturedLen])
+		}
+		data = data[blockLen:]
+	}
+
+	// section header, interface, handshake (3), data (2), close (3)
+	assert.Equal(t, 10, len(blockTypes))
+	assert.Equal(t, uint32(pcapngBlockSectionHeader), blockTypes[0])
+	assert.Equal(t, uint32(pcapngBlockInterface), blockTypes[1])
+
+	for _, packet := range packets {
+		// valid ipv4 header and tcp checksums sum up to zero
+		assert.Equal(t, uint16(0), checksum(packet[:ipv4HeaderLen]))
+		pseudo := append(append([]byte{}, packet[12:20]...), 0, 6, 0, byte(len(packet)-ipv4HeaderLen))
+		assert.Equal(t, uint16(0), checksum(append(pseudo, packet[ipv4HeaderLen:]...)))
+	}
+
+	hello := packets[3]
+	assert.Equal(t, []byte("hello"), hello[ipv4HeaderLen+tcpHeaderLen:])
+	assert.Equal(t, uint32(tcpClientISN+1), binary.BigEndian.Uint32(hello[ipv4HeaderLen+4:]))
+
+	world := packets[4]
+	assert.Equal(t, []byte("world!"), world[ipv4HeaderLen+tcpHeaderLen:])
+	// target acknowledges the 5 bytes sent by the client
+	assert.Equal(t, uint32(tcpClientISN+1+5), binary.BigEndian.Uint32(world[ipv4HeaderLen+8:]))
+}
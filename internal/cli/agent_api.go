@@ -0,0 +1,201 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/abdularis/kportfwd/internal/k8s"
+	"github.com/abdularis/kportfwd/internal/log"
+)
+
+// agentAPIClient calls forwarder agent http api through its local port forward.
+type agentAPIClient struct {
+	baseURL string
+	token   string
+	client  http.Client
+}
+
+func newAgentAPIClient(localAddr, token string) *agentAPIClient {
+	return &agentAPIClient{
+		baseURL: "http://" + localAddr,
+		token:   token,
+		client: http.Client{
+			Timeout: time.Second * 10,
+		},
+	}
+}
+
+// connectAgentAPI port forwards the agent api port to a free local port and returns a client calling it,
+// the port forward runs until ctx is done, onClosed (optional) is called once it stopped.
+func connectAgentAPI(ctx context.Context, k8sClient *k8s.ClientConfig, ns, pod string, apiPort int, token string, onClosed func()) (*agentAPIClient, error) {
+	localAPIPort, err := freeLocalPort()
+	if err != nil {
+		return nil, fmt.Errorf("forwarder agent api port err: %w", err)
+	}
+
+	readyCh := make(chan struct{})
+	go func() {
+		if onClosed != nil {
+			defer onClosed()
+		}
+		err := k8s.PortForward(ctx, k8sClient, readyCh, ns, pod, "127.0.0.1", localAPIPort, strconv.Itoa(apiPort), true)
+		if err != nil {
+			log.Printf("port forwarding relay-agent api: %s", err)
+		}
+	}()
+	if err := waitReady(readyCh); err != nil {
+		return nil, fmt.Errorf("forwarder agent api port err: %w", err)
+	}
+
+	return newAgentAPIClient(net.JoinHostPort("127.0.0.1", localAPIPort), token), nil
+}
+
+func (a *agentAPIClient) get(ctx context.Context, path string) (*http.Response, error) {
+	return a.do(ctx, &a.client, http.MethodGet, path, nil)
+}
+
+func (a *agentAPIClient) do(ctx context.Context, client *http.Client, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, a.baseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %s request: %w", path, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to call %s: %w", path, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s got status code: %d, expect %d", path, resp.StatusCode, http.StatusOK)
+	}
+
+	return resp, nil
+}
+
+func (a *agentAPIClient) ping(ctx context.Context) error {
+	resp, err := a.get(ctx, "/ping")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (a *agentAPIClient) info(ctx context.Context) (agentapi.Registration, error) {
+	var reg agentapi.Registration
+	err := a.getJSON(ctx, http.MethodGet, "/info", &reg)
+	return reg, err
+}
+
+// setShaping replaces traffic shaping of the agent forwarder with given name.
+func (a *agentAPIClient) setShaping(ctx context.Context, forwarder string, shaping agentapi.Shaping) error {
+	data, err := json.Marshal(shaping)
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.do(ctx, &a.client, http.MethodPut, "/shaping?forwarder="+url.QueryEscape(forwarder), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// getJSON calls path and decodes its JSON response into v.
+func (a *agentAPIClient) getJSON(ctx context.Context, method, path string, v any) error {
+	resp, err := a.do(ctx, &a.client, method, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("unable to decode %s response: %w", path, err)
+	}
+	return nil
+}
+
+// httpExchanges returns recent http exchanges summaries of the agent forwarder with given name.
+func (a *agentAPIClient) httpExchanges(ctx context.Context, forwarder string) ([]agentapi.HTTPExchange, error) {
+	var result []agentapi.HTTPExchange
+	err := a.getJSON(ctx, http.MethodGet, "/http/exchanges?forwarder="+url.QueryEscape(forwarder), &result)
+	return result, err
+}
+
+// httpExchange returns a single http exchange with headers and bodies.
+func (a *agentAPIClient) httpExchange(ctx context.Context, forwarder string, id uint64) (agentapi.HTTPExchange, error) {
+	var result agentapi.HTTPExchange
+	err := a.getJSON(ctx, http.MethodGet, fmt.Sprintf("/http/exchanges?forwarder=%s&id=%d", url.QueryEscape(forwarder), id), &result)
+	return result, err
+}
+
+// replayHTTPExchange sends the request of exchange id again and returns the new exchange.
+func (a *agentAPIClient) replayHTTPExchange(ctx context.Context, forwarder string, id uint64) (agentapi.HTTPExchange, error) {
+	var result agentapi.HTTPExchange
+	err := a.getJSON(ctx, http.MethodPost, fmt.Sprintf("/http/replay?forwarder=%s&id=%d", url.QueryEscape(forwarder), id), &result)
+	return result, err
+}
+
+// capture streams capture records of the agent forwarder with given name to onRecord until ctx is done or the agent is gone.
+func (a *agentAPIClient) capture(ctx context.Context, forwarder string, onRecord func(record agentapi.CaptureRecord) error) error {
+	// NOTE: Capture stream is long-lived, don't use the client with request timeout
+	resp, err := a.do(ctx, &http.Client{}, http.MethodGet, "/capture?forwarder="+url.QueryEscape(forwarder), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var record agentapi.CaptureRecord
+		if err := decoder.Decode(&record); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("unable to decode capture record: %w", err)
+		}
+		if err := onRecord(record); err != nil {
+			return err
+		}
+	}
+}
+
+// events follows agent server-sent events and calls onEvent for each of them until ctx is done or the agent is gone.
+func (a *agentAPIClient) events(ctx context.Context, onEvent func(event agentapi.Event)) error {
+	// NOTE: Event stream is long-lived, don't use the client with request timeout
+	resp, err := a.do(ctx, &http.Client{}, http.MethodGet, "/events", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var event agentapi.Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return fmt.Errorf("unable to decode agent event: %w", err)
+		}
+		onEvent(event)
+	}
+	return scanner.Err()
+}
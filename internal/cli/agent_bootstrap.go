@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/abdularis/kportfwd/internal/config"
+	"github.com/abdularis/kportfwd/internal/k8s"
+)
+
+// memfdPythonCheck succeeds when python3 is available with os.memfd_create (python >= 3.8).
+const memfdPythonCheck = `python3 -c 'import os; os.memfd_create' >/dev/null 2>&1`
+
+// memfdInterpreterScript prints the interpreter memfdLauncherScript runs with, nothing when there is none.
+const memfdInterpreterScript = `if ` + memfdPythonCheck + `; then echo python3
+elif command -v perl >/dev/null 2>&1; then echo perl
+fi`
+
+// memfdLauncherScript is a tiny launcher executed with `sh -c` on the target container.
+// It reads the forwarder agent binary from stdin into an anonymous memory file (memfd_create)
+// and execve's it, so the agent runs without touching the container filesystem.
+//
+// Positional arguments: $1 python launcher, $2 perl launcher, then the launcher arguments: the agent binary size
+// and the agent arguments. Exactly the binary size is read, the rest of stdin is left to the agent.
+const memfdLauncherScript = `py="$1"; pl="$2"; shift 2
+if ` + memfdPythonCheck + `; then exec python3 -c "$py" "$@"; fi
+if command -v perl >/dev/null 2>&1; then exec perl -e "$pl" "$@"; fi
+echo "memfd launcher requires python3 (>= 3.8) or perl on the target container" >&2
+exit 127`
+
+// memfdLauncherPython requires python >= 3.8 for os.memfd_create.
+const memfdLauncherPython = `import os, sys
+size = int(sys.argv[1])
+fd = os.memfd_create("forwarder-agent", 0)
+while size > 0:
+    data = os.read(0, min(size, 65536))
+    if not data:
+        sys.exit("agent binary truncated")
+    os.write(fd, data)
+    size -= len(data)
+os.execv("/proc/self/fd/%d" % fd, ["forwarder-agent"] + sys.argv[2:])`
+
+// memfdLauncherPerl calls memfd_create through its syscall number, which depends on the architecture
+// of the container perl, and fails clearly on architectures it doesn't know.
+const memfdLauncherPerl = `use POSIX ();
+my %memfd_create = (x86_64 => 319, aarch64 => 279, riscv64 => 279, i686 => 356, armv7l => 385, ppc64le => 360, s390x => 350);
+my $arch = (POSIX::uname())[4];
+my $nr = $memfd_create{$arch} or die "memfd launcher: unsupported architecture $arch\n";
+my $size = shift @ARGV;
+my $name = "forwarder-agent";
+my $fd = syscall($nr, $name, 0);
+die "memfd_create failed: $!" if $fd < 0;
+$^F = $fd; # keep the memfd open across exec, perl sets close-on-exec above $^F
+open(my $fh, ">&=", $fd) or die "open memfd: $!";
+binmode STDIN; binmode $fh;
+while ($size > 0) {
+  my $n = sysread(STDIN, my $data, $size > 65536 ? 65536 : $size);
+  die "read agent binary: $!" unless defined $n;
+  die "agent binary truncated" if $n == 0;
+  syswrite($fh, $data) == $n or die "write memfd: $!";
+  $size -= $n;
+}
+exec { "/proc/self/fd/$fd" } "forwarder-agent", @ARGV or die "exec: $!";`
+
+// checkMemfdInterpreter returns the interpreter the memfd launcher runs with on the target container. Distroless
+// and hardened images often ship neither python3 nor perl (or even sh), it's checked before streaming the agent binary.
+func checkMemfdInterpreter(ctx context.Context, k8sClient *k8s.ClientConfig, ns, pod, container string) (string, error) {
+	output := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := []string{"sh", "-c", memfdInterpreterScript}
+	if err := k8s.ExecOnPodWithStdin(ctx, k8sClient, ns, pod, container, nil, output, stderr, cmd); err != nil {
+		return "", fmt.Errorf("memfd bootstrap requires sh, and python3 (>= 3.8) or perl on the target container, unable to run sh: %w (stderr: %s)",
+			err, strings.TrimSpace(stderr.String()))
+	}
+	return memfdInterpreter(output.String())
+}
+
+// memfdInterpreter parses the output of memfdInterpreterScript.
+func memfdInterpreter(output string) (string, error) {
+	interpreter := strings.TrimSpace(output)
+	if interpreter == "" {
+		return "", fmt.Errorf("memfd bootstrap requires python3 (>= 3.8) or perl on the target container, neither of them is available")
+	}
+	return interpreter, nil
+}
+
+// agentCommand builds the remote command to start the forwarder agent using given bootstrap mode.
+// agentPath is only used for config.AgentBootstrapCopy where the binary already exists on the container,
+// agentSize for config.AgentBootstrapMemfd where the binary is streamed first on stdin.
+// The command must not hold secrets, see agentBootstrap.
+func agentCommand(bootstrap, agentPath string, agentSize int64, args []string) []string {
+	var cmd []string
+	if bootstrap == config.AgentBootstrapMemfd {
+		cmd = []string{"sh", "-c", memfdLauncherScript, "sh", memfdLauncherPython, memfdLauncherPerl, strconv.FormatInt(agentSize, 10)}
+	} else {
+		cmd = []string{agentPath}
+	}
+	return append(cmd, args...)
+}
+
+// agentBootstrap returns the bootstrap written on the forwarder agent stdin (`-bootstrap-stdin` argument): the session
+// token and the forward specs of configs, in order. They are kept out of the exec command, which is visible in the pod
+// process list and sent as pods/exec query parameters (ending up in apiserver audit logs), as specs may hold client keys.
+func agentBootstrap(token string, configs []config.ForwardConfig) agentapi.Bootstrap {
+	bootstrap := agentapi.Bootstrap{Token: token}
+	for _, rc := range configs {
+		bootstrap.Forwards = append(bootstrap.Forwards, rc.AgentSpec())
+	}
+	return bootstrap
+}
+
+func validateAgentBootstrap(bootstrap string) error {
+	switch bootstrap {
+	case "", config.AgentBootstrapCopy, config.AgentBootstrapMemfd:
+		return nil
+	}
+	return fmt.Errorf("unknown agent bootstrap mode: %s (expected '%s' or '%s')", bootstrap, config.AgentBootstrapCopy, config.AgentBootstrapMemfd)
+}
@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/abdularis/kportfwd/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AgentCommand(t *testing.T) {
+	args := []string{"-session", "abc", "-bootstrap-stdin"}
+
+	assert.Equal(t, []string{"/tmp/kportfwd/forwarder-agent", "-session", "abc", "-bootstrap-stdin"},
+		agentCommand(config.AgentBootstrapCopy, "/tmp/kportfwd/forwarder-agent", 1024, args))
+	assert.Equal(t, []string{"/tmp/kportfwd/forwarder-agent", "-session", "abc", "-bootstrap-stdin"},
+		agentCommand("", "/tmp/kportfwd/forwarder-agent", 1024, args))
+
+	assert.Equal(t, []string{"sh", "-c", memfdLauncherScript, "sh", memfdLauncherPython, memfdLauncherPerl, "1024", "-session", "abc", "-bootstrap-stdin"},
+		agentCommand(config.AgentBootstrapMemfd, "/tmp/kportfwd/forwarder-agent", 1024, args))
+}
+
+func Test_AgentBootstrap(t *testing.T) {
+	forwards := []config.ForwardConfig{
+		{TargetAddr: "postgres:5432", OriginateTLS: &config.OriginateTLS{CertData: []byte("client-cert"), KeyData: []byte("client-key")}},
+		{TargetAddr: "redis:6379"},
+	}
+	assert.NoError(t, config.ParseConfigAddresses(&config.Config{Rootless: true, Forwards: forwards}, map[string]string{}))
+
+	bootstrap := agentBootstrap("token", forwards)
+	assert.Equal(t, "token", bootstrap.Token)
+	assert.Len(t, bootstrap.Forwards, 2)
+	assert.Equal(t, "postgres:5432", bootstrap.Forwards[0].TargetAddr)
+	assert.Equal(t, []byte("client-key"), bootstrap.Forwards[0].OriginateTLS.KeyData)
+	assert.Equal(t, "redis:6379", bootstrap.Forwards[1].TargetAddr)
+
+	for _, arg := range agentCommand(config.AgentBootstrapMemfd, "", 0, []string{"-bootstrap-stdin"}) {
+		assert.NotContains(t, arg, "client-key")
+		assert.NotContains(t, arg, "token")
+	}
+}
+
+// Test_MemfdLauncher runs the memfd launchers with a script as agent binary, it must only read the binary
+// from stdin and leave the bootstrap line to the agent.
+func Test_MemfdLauncher(t *testing.T) {
+	agent := []byte("#!/bin/sh\necho \"args: $*\"\ncat\n")
+	bootstrap := `{"token":"x"}` + "\n"
+
+	for _, launcher := range []string{"python3", "perl"} {
+		t.Run(launcher, func(t *testing.T) {
+			if _, err := exec.LookPath(launcher); err != nil {
+				t.Skipf("%s not available", launcher)
+			}
+
+			cmd := agentCommand(config.AgentBootstrapMemfd, "", int64(len(agent)), []string{"-session", "abc"})
+			if launcher == "perl" {
+				cmd[2] = strings.Replace(cmd[2], memfdPythonCheck, "false", 1)
+			}
+			output := &bytes.Buffer{}
+			process := exec.Command(cmd[0], cmd[1:]...)
+			process.Stdin = io.MultiReader(bytes.NewReader(agent), strings.NewReader(bootstrap))
+			process.Stdout = output
+			process.Stderr = output
+			assert.NoError(t, process.Run(), output.String())
+			assert.Equal(t, "args: -session abc\n"+bootstrap, output.String())
+		})
+	}
+}
+
+func Test_MemfdInterpreter(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Binaries []string
+		Expected string
+	}{
+		// NOTE: sh only, as in a busybox based image
+		{Name: "neither python3 nor perl", Binaries: []string{"sh"}},
+		{Name: "perl", Binaries: []string{"sh", "perl"}, Expected: "perl"},
+		{Name: "python3 first", Binaries: []string{"sh", "perl", "python3"}, Expected: "python3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			// NOTE: Interpreters are wrapped rather than linked, they may be shims relying on PATH themselves
+			bin := t.TempDir()
+			for _, name := range tt.Binaries {
+				path, err := exec.LookPath(name)
+				if err != nil {
+					t.Skipf("%s not available", name)
+				}
+				if name == "sh" {
+					assert.NoError(t, os.Symlink(path, filepath.Join(bin, name)))
+					continue
+				}
+				wrapper := fmt.Sprintf("#!/bin/sh\nPATH=%q exec %q \"$@\"\n", os.Getenv("PATH"), path)
+				assert.NoError(t, os.WriteFile(filepath.Join(bin, name), []byte(wrapper), 0700))
+			}
+
+			process := exec.Command(filepath.Join(bin, "sh"), "-c", memfdInterpreterScript)
+			process.Env = []string{"PATH=" + bin}
+			output, err := process.Output()
+			assert.NoError(t, err)
+
+			interpreter, err := memfdInterpreter(string(output))
+			if tt.Expected == "" {
+				assert.ErrorContains(t, err, "requires python3 (>= 3.8) or perl")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.Expected, interpreter)
+		})
+	}
+}
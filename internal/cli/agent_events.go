@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/abdularis/kportfwd/internal/log"
+)
+
+// agentEventWriter parses forwarder agent stdout as JSON lines events, lines which are not events
+// are passed through to output. Partial lines are buffered until complete, so chunked output is fine.
+type agentEventWriter struct {
+	output  io.Writer
+	onEvent func(event agentapi.Event)
+	buff    []byte
+}
+
+func newAgentEventWriter(output io.Writer, onEvent func(event agentapi.Event)) *agentEventWriter {
+	return &agentEventWriter{output: output, onEvent: onEvent}
+}
+
+func (w *agentEventWriter) Write(p []byte) (int, error) {
+	w.buff = append(w.buff, p...)
+	for {
+		idx := bytes.IndexByte(w.buff, '\n')
+		if idx < 0 {
+			break
+		}
+		line := w.buff[:idx+1]
+		w.buff = w.buff[idx+1:]
+
+		var event agentapi.Event
+		if err := json.Unmarshal(line, &event); err != nil || event.Type == "" {
+			_, _ = w.output.Write(line)
+			continue
+		}
+		w.onEvent(event)
+	}
+	return len(p), nil
+}
+
+// logAgentEvent reports forwarder agent status changes to the user.
+func logAgentEvent(event agentapi.Event) {
+	if event.Version > agentapi.EventVersion {
+		log.Debugf("agent event version %d is newer than supported version %d", event.Version, agentapi.EventVersion)
+	}
+
+	fwd := agentapi.Forwarder{}
+	if event.Forwarder != nil {
+		fwd = *event.Forwarder
+	}
+
+	switch event.Type {
+	case agentapi.EventReady:
+		log.Printf("forwarder agent session %s ready, forwarders: %d", event.Session, len(event.Forwarders))
+	case agentapi.EventForwarderStarted:
+		log.Debugf("agent forwarder started %s -> %s", fwd.SourceAddr, fwd.TargetAddr)
+	case agentapi.EventForwarderStopped:
+		log.Warnf("agent forwarder stopped %s -> %s %s", fwd.SourceAddr, fwd.TargetAddr, fwd.Error)
+	case agentapi.EventConnectionOpened:
+		log.Debugf("agent connection opened %s -> %s", event.RemoteAddr, event.Backend)
+	case agentapi.EventConnectionClosed:
+		log.Debugf("agent connection closed %s -> %s %s", event.RemoteAddr, event.Backend, event.Reason)
+	case agentapi.EventHealthCheckFailure:
+		if fwd.State == agentapi.ForwarderStateDegraded {
+			log.Warnf("agent target %s degraded, refusing connections: %s", event.Backend, event.Error)
+		} else {
+			log.Warnf("agent target %s degraded, skipped until it recovers: %s", event.Backend, event.Error)
+		}
+	case agentapi.EventHealthCheckRecover:
+		log.Printf("agent target %s recovered", event.Backend)
+	case agentapi.EventHTTPExchange:
+		if event.HTTP != nil {
+			logHTTPExchange(fwd, *event.HTTP)
+		}
+	case agentapi.EventShutdown:
+		log.Printf("forwarder agent shutdown: %s", event.Reason)
+	default:
+		log.Debugf("unknown agent event: %s", event.Type)
+	}
+}
+
+func logHTTPExchange(fwd agentapi.Forwarder, exchange agentapi.HTTPExchange) {
+	name := fwd.Name
+	if name == "" {
+		name = fwd.TargetAddr
+	}
+	if exchange.Error != "" {
+		log.Warnf("[%s #%d] %s %s failed after %s: %s", name, exchange.ID, exchange.Method, exchange.URL, exchange.Duration, exchange.Error)
+		return
+	}
+	log.Printf("[%s #%d] %s %s %d %s (req %dB, resp %dB)", name, exchange.ID, exchange.Method, exchange.URL,
+		exchange.Status, exchange.Latency.Round(time.Millisecond), exchange.RequestSize, exchange.ResponseSize)
+}
@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/abdularis/kportfwd/internal/config"
+	"github.com/abdularis/kportfwd/internal/k8s"
+)
+
+// agentStateDir is where the forwarder agent is installed on the target container and registers itself.
+const agentStateDir = "/tmp"
+
+// listRegistrationsScript prints registration files of forwarder agents whose process is still alive
+// and removes the stale ones. $1 is the agent state dir.
+const listRegistrationsScript = `for f in "$1"/` + agentapi.RegistrationFilePrefix + `*.json; do
+  [ -f "$f" ] || continue
+  pid=$(sed -n 's/.*"pid":\([0-9]*\).*/\1/p' "$f")
+  if [ -n "$pid" ] && [ -d "/proc/$pid" ]; then cat "$f"; echo; else rm -f "$f" 2>/dev/null; fi
+done`
+
+// listAgentRegistrations returns registrations of forwarder agents currently running on target pod container.
+func listAgentRegistrations(ctx context.Context, k8sClient *k8s.ClientConfig, ns, pod, container, stateDir string) ([]agentapi.Registration, error) {
+	output := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := []string{"sh", "-c", listRegistrationsScript, "sh", stateDir}
+	if err := k8s.ExecOnPodWithStdin(ctx, k8sClient, ns, pod, container, nil, output, stderr, cmd); err != nil {
+		return nil, fmt.Errorf("list agent registrations err: %w (stderr: %s)", err, stderr.String())
+	}
+
+	var result []agentapi.Registration
+	decoder := json.NewDecoder(output)
+	for {
+		var reg agentapi.Registration
+		if err := decoder.Decode(&reg); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("unable to decode agent registration: %w", err)
+		}
+		result = append(result, reg)
+	}
+	return result, nil
+}
+
+// findCompatibleAgent returns a running healthy agent having the same version and forwarding the same targets as configs.
+// Forwards rendered from Secrets are never attached to, agents only report their targets redacted.
+func findCompatibleAgent(regs []agentapi.Registration, configs []config.ForwardConfig) (agentapi.Registration, bool) {
+	for _, cfg := range configs {
+		if len(cfg.SecretValues) > 0 {
+			return agentapi.Registration{}, false
+		}
+	}
+
+	for _, reg := range regs {
+		if reg.Version != agentapi.Version || len(reg.Forwarders) != len(configs) {
+			continue
+		}
+
+		compatible := true
+		for idx, fwd := range reg.Forwarders {
+			if fwd.Name != configs[idx].Name || fwd.TargetAddr != configs[idx].TargetAddr ||
+				!sameTargets(fwd, configs[idx].AgentSpec()) || fwd.State == agentapi.ForwarderStateDegraded {
+				compatible = false
+				break
+			}
+		}
+
+		if compatible {
+			return reg, true
+		}
+	}
+	return agentapi.Registration{}, false
+}
+
+// sameTargets reports whether agent forwarder was started with the same targets, balancing, http and tls options as spec.
+func sameTargets(fwd agentapi.Forwarder, spec agentapi.ForwardSpec) bool {
+	if fwd.Spec == nil {
+		return false
+	}
+
+	running, wanted := fwd.Spec.TargetList(), spec.TargetList()
+	if len(running) != len(wanted) {
+		return false
+	}
+	for idx := range wanted {
+		if running[idx] != wanted[idx] {
+			return false
+		}
+	}
+
+	sameOrdinal := (fwd.Spec.Ordinal == nil && spec.Ordinal == nil) ||
+		(fwd.Spec.Ordinal != nil && spec.Ordinal != nil && *fwd.Spec.Ordinal == *spec.Ordinal)
+	return fwd.Spec.Balance == spec.Balance && fwd.Spec.ResolveAll == spec.ResolveAll && sameOrdinal &&
+		fwd.Spec.StatefulSet == spec.StatefulSet &&
+		reflect.DeepEqual(fwd.Spec.HTTP, spec.HTTP) && reflect.DeepEqual(fwd.Spec.OriginateTLS, spec.Redacted().OriginateTLS)
+}
+
+// useAgentForwarders points forward configs to the source addresses reported by the running agent.
+func useAgentForwarders(configs []config.ForwardConfig, forwarders []agentapi.Forwarder) error {
+	if len(forwarders) != len(configs) {
+		return fmt.Errorf("agent reported %d forwarders, expect %d", len(forwarders), len(configs))
+	}
+
+	for idx, fwd := range forwarders {
+		if err := configs[idx].SetSourceAddr(fwd.SourceAddr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newSessionID() (string, error) {
+	return randomHex(8)
+}
+
+// newSessionToken generates the secret used to authenticate agent api calls.
+func newSessionToken() (string, error) {
+	return randomHex(32)
+}
+
+func randomHex(size int) (string, error) {
+	buff := make([]byte, size)
+	if _, err := rand.Read(buff); err != nil {
+		return "", fmt.Errorf("unable to generate random bytes: %w", err)
+	}
+	return hex.EncodeToString(buff), nil
+}
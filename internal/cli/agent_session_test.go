@@ -0,0 +1,146 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/abdularis/kportfwd/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// runningForwarder returns the forwarder reported by an agent started with cfg.
+func runningForwarder(cfg config.ForwardConfig) agentapi.Forwarder {
+	spec := cfg.AgentSpec().Redacted()
+	return agentapi.Forwarder{
+		Name:       cfg.Name,
+		SourceAddr: "127.0.0.1:40001",
+		TargetAddr: spec.TargetAddr,
+		State:      agentapi.ForwarderStateHealthy,
+		Spec:       &spec,
+	}
+}
+
+func Test_FindCompatibleAgent(t *testing.T) {
+	ordinal, otherOrdinal := 1, 2
+	base := []config.ForwardConfig{
+		{Name: "db", TargetAddr: "postgres:5432"},
+		{TargetAddr: "redis:6379", TargetAddrs: []config.TargetAddr{{Addr: "redis:6379"}, {Addr: "redis-replica:6379", Weight: 2}}, Balance: agentapi.BalanceRoundRobin},
+	}
+
+	tests := []struct {
+		Name string
+		// Running changes the config the agent was started with, Wanted the config of the new session.
+		Running    func(cfgs []config.ForwardConfig)
+		Wanted     func(cfgs []config.ForwardConfig)
+		Forwarders func(fwds []agentapi.Forwarder)
+		Version    string
+		Expected   bool
+	}{
+		{Name: "same forwards", Expected: true},
+		{Name: "other version", Version: "12", Expected: false},
+		{Name: "other name", Wanted: func(cfgs []config.ForwardConfig) { cfgs[0].Name = "primary" }},
+		{Name: "other target", Wanted: func(cfgs []config.ForwardConfig) { cfgs[0].TargetAddr = "postgres-replica:5432" }},
+		{Name: "fewer forwards", Wanted: func(cfgs []config.ForwardConfig) { cfgs[1] = cfgs[0] }},
+		{Name: "other targets", Wanted: func(cfgs []config.ForwardConfig) { cfgs[1].TargetAddrs[1].Addr = "redis-2:6379" }},
+		{Name: "other target weight", Wanted: func(cfgs []config.ForwardConfig) { cfgs[1].TargetAddrs[1].Weight = 3 }},
+		{Name: "other balance", Wanted: func(cfgs []config.ForwardConfig) { cfgs[1].Balance = agentapi.BalanceFailover }},
+		{Name: "resolve all", Wanted: func(cfgs []config.ForwardConfig) { cfgs[0].ResolveAll = true }},
+		{
+			Name:     "same ordinal",
+			Running:  func(cfgs []config.ForwardConfig) { cfgs[0].Ordinal = &ordinal },
+			Wanted:   func(cfgs []config.ForwardConfig) { cfgs[0].Ordinal = &ordinal },
+			Expected: true,
+		},
+		{
+			Name:    "other ordinal",
+			Running: func(cfgs []config.ForwardConfig) { cfgs[0].Ordinal = &ordinal },
+			Wanted:  func(cfgs []config.ForwardConfig) { cfgs[0].Ordinal = &otherOrdinal },
+		},
+		{Name: "ordinal added", Wanted: func(cfgs []config.ForwardConfig) { cfgs[0].Ordinal = &ordinal }},
+		{
+			Name:    "other statefulSet",
+			Running: func(cfgs []config.ForwardConfig) { cfgs[0].Ordinal, cfgs[0].StatefulSet = &ordinal, "postgres" },
+			Wanted:  func(cfgs []config.ForwardConfig) { cfgs[0].Ordinal, cfgs[0].StatefulSet = &ordinal, "pg" },
+		},
+		{Name: "http rewrite", Wanted: func(cfgs []config.ForwardConfig) { cfgs[0].RewriteHost = "db.example.com" }},
+		{
+			Name: "originate tls with client key",
+			Running: func(cfgs []config.ForwardConfig) {
+				cfgs[0].OriginateTLS = &config.OriginateTLS{CertData: []byte("cert"), KeyData: []byte("key")}
+			},
+			Wanted: func(cfgs []config.ForwardConfig) {
+				cfgs[0].OriginateTLS = &config.OriginateTLS{CertData: []byte("cert"), KeyData: []byte("key")}
+			},
+			Expected: true,
+		},
+		{
+			Name:    "other originate tls",
+			Running: func(cfgs []config.ForwardConfig) { cfgs[0].OriginateTLS = &config.OriginateTLS{ServerName: "db"} },
+			Wanted:  func(cfgs []config.ForwardConfig) { cfgs[0].OriginateTLS = &config.OriginateTLS{ServerName: "postgres"} },
+		},
+		{
+			Name:       "degraded forwarder",
+			Forwarders: func(fwds []agentapi.Forwarder) { fwds[1].State = agentapi.ForwarderStateDegraded },
+		},
+		{
+			Name:       "no spec reported",
+			Forwarders: func(fwds []agentapi.Forwarder) { fwds[0].Spec = nil },
+		},
+		{
+			// NOTE: Agents only report targets rendered from Secrets redacted, they can't be compared
+			Name:    "secret values",
+			Running: func(cfgs []config.ForwardConfig) { cfgs[0].SecretValues = []string{"postgres"} },
+			Wanted:  func(cfgs []config.ForwardConfig) { cfgs[0].SecretValues = []string{"postgres"} },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			running := cloneForwardConfigs(base)
+			if tt.Running != nil {
+				tt.Running(running)
+			}
+			wanted := cloneForwardConfigs(base)
+			if tt.Wanted != nil {
+				tt.Wanted(wanted)
+			}
+
+			reg := agentapi.Registration{Session: "s1", Version: agentapi.Version, APIPort: 4242}
+			if tt.Version != "" {
+				reg.Version = tt.Version
+			}
+			for _, cfg := range running {
+				reg.Forwarders = append(reg.Forwarders, runningForwarder(cfg))
+			}
+			if tt.Forwarders != nil {
+				tt.Forwarders(reg.Forwarders)
+			}
+
+			other := agentapi.Registration{Session: "s0", Version: agentapi.Version, Forwarders: reg.Forwarders[:1]}
+			found, ok := findCompatibleAgent([]agentapi.Registration{other, reg}, wanted)
+			assert.Equal(t, tt.Expected, ok)
+			if tt.Expected {
+				assert.Equal(t, "s1", found.Session)
+			}
+		})
+	}
+}
+
+func Test_UseAgentForwarders(t *testing.T) {
+	cfgs := []config.ForwardConfig{{TargetAddr: "postgres:5432"}, {TargetAddr: "redis:6379"}}
+	forwarders := []agentapi.Forwarder{{SourceAddr: "127.0.0.1:40001"}, {SourceAddr: "127.0.0.1:40002"}}
+	assert.NoError(t, useAgentForwarders(cfgs, forwarders))
+	assert.Equal(t, "40001", cfgs[0].SourceAddrParsed.Port())
+	assert.Equal(t, "40002", cfgs[1].SourceAddrParsed.Port())
+
+	assert.Error(t, useAgentForwarders(cfgs, forwarders[:1]))
+}
+
+func cloneForwardConfigs(cfgs []config.ForwardConfig) []config.ForwardConfig {
+	result := make([]config.ForwardConfig, len(cfgs))
+	for idx, cfg := range cfgs {
+		cfg.TargetAddrs = append([]config.TargetAddr(nil), cfg.TargetAddrs...)
+		result[idx] = cfg
+	}
+	return result
+}
@@ -1,10 +1,14 @@
 package cli
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"strings"
 
+	"github.com/abdularis/kportfwd/internal/agentapi"
 	"github.com/abdularis/kportfwd/internal/config"
+	"github.com/abdularis/kportfwd/internal/envfile"
 	"github.com/abdularis/kportfwd/internal/k8s"
 	"github.com/abdularis/kportfwd/internal/log"
 
@@ -12,13 +16,25 @@ import (
 )
 
 const (
-	flagNameConfigFile           = "config"
-	flagNameForwarderAgentScript = "forwarder-agent"
-	flagSaveTargetEnvarToFile    = "save-target-envar"
-	flagNameTarget               = "t"
-	flagNameNamespace            = "n"
-	flagNameContainer            = "c"
-	flagNameForwards             = "f"
+	flagNameConfigFile             = "config"
+	flagNameForwarderAgentScript   = "forwarder-agent"
+	flagNameAgentBootstrap         = "agent-bootstrap"
+	flagSaveTargetEnvarToFile      = "save-target-envar"
+	flagNameRewriteTargetEnvar     = "rewrite-target-envar"
+	flagNameTarget                 = "t"
+	flagNameNamespace              = "n"
+	flagNameContainer              = "c"
+	flagNameForwards               = "f"
+	flagNameRouter                 = "router"
+	flagNameRootless               = "rootless"
+	flagNameConnectionInfo         = "connection-info"
+	flagNameConnectionInfoFile     = "connection-info-file"
+	flagNameExportEnv              = "export-env"
+	flagNameExportEnvFile          = "export-env-file"
+	flagNameExportEnvInclude       = "export-env-include"
+	flagNameExportEnvExclude       = "export-env-exclude"
+	flagNameExportEnvRedact        = "export-env-redact"
+	flagNameExportEnvRedactSecrets = "export-env-redact-secrets"
 )
 
 const (
@@ -38,12 +54,22 @@ var (
 		Usage: "Custom forwarder agent binary (optional)",
 	}
 
+	FlagAgentBootstrap = &cli.StringFlag{
+		Name:  flagNameAgentBootstrap,
+		Usage: "How to start the forwarder agent on the target pod: 'copy' (copy binary to /tmp) or 'memfd' (run from memory, for read-only or noexec pods)",
+	}
+
 	FlagSaveTargetEnvar = &cli.BoolFlag{
 		Name:  flagSaveTargetEnvarToFile,
 		Value: false,
 		Usage: "Save target pod environment variables to .envs/ directory",
 	}
 
+	FlagRewriteTargetEnvar = &cli.BoolFlag{
+		Name:  flagNameRewriteTargetEnvar,
+		Usage: "Rewrite target pod environment variables pointing at forward targets to the local addresses (saved as .envs/<pod>.local, and given to exec commands)",
+	}
+
 	FlagTarget = &cli.StringFlag{
 		Name:  "t",
 		Usage: "Target resource with label selector. Format: 'pod/labelSelector' or just 'labelSelector' (defaults to pod). (e.g., 'pod/app=backend', 'app=backend')",
@@ -60,12 +86,85 @@ var (
 		Usage: "Container name within the pod (e.g., 'service')",
 	}
 
+	FlagRouter = &cli.BoolFlag{
+		Name:  flagNameRouter,
+		Usage: "Share 127.0.0.1:443 and 127.0.0.1:80 between forwards to port 443 and 80 by TLS SNI and HTTP Host, instead of adding loopback aliases",
+	}
+
+	FlagRootless = &cli.BoolFlag{
+		Name:  flagNameRootless,
+		Usage: "Never require root: only use 127.0.0.1 ports (remapping taken ones) and leave /etc/hosts and loopback aliases alone",
+	}
+
+	FlagConnectionInfo = &cli.StringFlag{
+		Name:  flagNameConnectionInfo,
+		Usage: "Print how to reach each forward locally: 'env' (shell exports), 'dotenv' or 'ssh-config'",
+	}
+
+	FlagConnectionInfoFile = &cli.StringFlag{
+		Name:  flagNameConnectionInfoFile,
+		Usage: "Write connection info to this file instead of stdout",
+	}
+
+	FlagExportEnv = &cli.StringFlag{
+		Name:  flagNameExportEnv,
+		Usage: "Export target pod environment variables as 'dotenv', 'shell', 'json', 'docker' (env-file) or 'envrc' (direnv)",
+	}
+
+	FlagExportEnvFile = &cli.StringFlag{
+		Name:  flagNameExportEnvFile,
+		Usage: "File to export environment variables to (mode 0600), defaults to .envs/<pod>.<format>",
+	}
+
+	FlagExportEnvInclude = &cli.StringSliceFlag{
+		Name:  flagNameExportEnvInclude,
+		Usage: "Only export variables matching these name patterns (e.g. 'DB_*,REDIS_*')",
+	}
+
+	FlagExportEnvExclude = &cli.StringSliceFlag{
+		Name:  flagNameExportEnvExclude,
+		Usage: "Don't export variables matching these name patterns",
+	}
+
+	FlagExportEnvRedact = &cli.StringSliceFlag{
+		Name:  flagNameExportEnvRedact,
+		Usage: "Export values of variables matching these name patterns as " + envfile.Redacted,
+	}
+
+	FlagExportEnvRedactSecrets = &cli.BoolFlag{
+		Name:  flagNameExportEnvRedactSecrets,
+		Usage: "Export values of variables named like secrets (" + strings.Join(envfile.SecretPatterns, ",") + ") as " + envfile.Redacted,
+	}
+
 	FlagForwards = &cli.StringFlag{
 		Name:  "f",
 		Usage: "Comma-separated list of target addresses to forwards (e.g., 'postgres:5432,{{.REDIS_HOST}}:{{.REDIS_PORT}}')",
 	}
 )
 
+// portForwardFlags are the flags of port forwarding, in foreground (root command) or background (up command).
+var portForwardFlags = []cli.Flag{
+	FlagConfigFile,
+	FlagForwarderAgentScript,
+	FlagAgentBootstrap,
+	FlagSaveTargetEnvar,
+	FlagRewriteTargetEnvar,
+	FlagTarget,
+	FlagNamespace,
+	FlagContainer,
+	FlagForwards,
+	FlagRouter,
+	FlagRootless,
+	FlagConnectionInfo,
+	FlagConnectionInfoFile,
+	FlagExportEnv,
+	FlagExportEnvFile,
+	FlagExportEnvInclude,
+	FlagExportEnvExclude,
+	FlagExportEnvRedact,
+	FlagExportEnvRedactSecrets,
+}
+
 func GetCLIApp() *cli.App {
 	return &cli.App{
 		Name:    "kportfwd",
@@ -73,7 +172,8 @@ func GetCLIApp() *cli.App {
 		Usage:   "Port forward internal Kubernetes services to your local machine",
 		Description: `Forward cluster-internal services and domains to your local machine without any cluster setup.
 
-Requires sudo to modify /etc/hosts and create network aliases for transparent access.
+Modifies /etc/hosts and creates network aliases for transparent access through a small helper
+started with sudo, use --rootless to run without it.
 
 EXAMPLES:
 
@@ -86,17 +186,31 @@ EXAMPLES:
 
 3. Multiple forwards with CLI:
    kportfwd -t pod/app=api -n staging -c service -f "db.internal:5432,cache.internal:6379,queue.internal:5672"
+
+4. In the background:
+   kportfwd up -d path/to/dev.yaml
+   kportfwd ls
+   kportfwd logs -f dev
+   kportfwd down dev
+
+5. Run a command with forwards ready and the target pod environment variables:
+   kportfwd exec --config path/to/dev.yaml -- go test ./...
 `,
-		Flags: []cli.Flag{
-			FlagConfigFile,
-			FlagForwarderAgentScript,
-			FlagSaveTargetEnvar,
-			FlagTarget,
-			FlagNamespace,
-			FlagContainer,
-			FlagForwards,
-		},
+		Flags:  portForwardFlags,
 		Action: handleActionPortForward,
+		Commands: []*cli.Command{
+			upCommand,
+			lsCommand,
+			downCommand,
+			logsCommand,
+			execCommand,
+			statusCommand,
+			shapeCommand,
+			captureCommand,
+			inspectCommand,
+			trustCommand,
+			privilegedHelperCommand,
+		},
 	}
 }
 
@@ -162,10 +276,31 @@ func parseTargetFlag(target string) (string, string, error) {
 
 // createConfigFromFlags creates a Config struct from CLI flags instead of YAML file
 func createConfigFromFlags(c *cli.Context) (*config.Config, error) {
+	cfg, err := createTargetConfigFromFlags(c)
+	if err != nil {
+		return nil, err
+	}
+
+	forwardsStr := c.String(flagNameForwards)
+	if forwardsStr == "" {
+		return nil, fmt.Errorf("forwards flag (-f) is required when not using config file")
+	}
+
+	// Parse forwards
+	forwards, err := parseForwardsFlag(forwardsStr)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing forwards: %w", err)
+	}
+	cfg.Forwards = forwards
+
+	return cfg, nil
+}
+
+// createTargetConfigFromFlags creates a Config struct having only target pod from CLI flags
+func createTargetConfigFromFlags(c *cli.Context) (*config.Config, error) {
 	target := c.String(flagNameTarget)
 	namespace := c.String(flagNameNamespace)
 	container := c.String(flagNameContainer)
-	forwardsStr := c.String(flagNameForwards)
 
 	// Validate required flags
 	if target == "" {
@@ -174,9 +309,6 @@ func createConfigFromFlags(c *cli.Context) (*config.Config, error) {
 	if container == "" {
 		return nil, fmt.Errorf("container flag (-c) is required when not using config file")
 	}
-	if forwardsStr == "" {
-		return nil, fmt.Errorf("forwards flag (-f) is required when not using config file")
-	}
 
 	// Parse and validate target flag
 	resType, labelSelector, err := parseTargetFlag(target)
@@ -184,16 +316,7 @@ func createConfigFromFlags(c *cli.Context) (*config.Config, error) {
 		return nil, fmt.Errorf("error parsing target: %w", err)
 	}
 
-	// Parse forwards
-	forwards, err := parseForwardsFlag(forwardsStr)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing forwards: %w", err)
-	}
-
-	// Create config
-	cfg := &config.Config{
-		Forwards: forwards,
-	}
+	cfg := &config.Config{}
 	if resType == resourceTypePod {
 		cfg.Target.Pod = &config.Pod{
 			LabelSelector: labelSelector,
@@ -206,6 +329,19 @@ func createConfigFromFlags(c *cli.Context) (*config.Config, error) {
 }
 
 func handleActionPortForward(c *cli.Context) error {
+	return runPortForward(c, portForwardHooks{})
+}
+
+// portForwardHooks are optional callbacks of runPortForward.
+type portForwardHooks struct {
+	// OnRunning is called once forward addresses and target pod environment variables are known, before forwarding starts
+	OnRunning func(cfg *config.Config, target config.AgentTarget, envvars map[string]string)
+	// OnReady is called once every forward is ready to accept connections
+	OnReady func()
+}
+
+// runPortForward runs port forwarding until c.Context is done.
+func runPortForward(c *cli.Context, hooks portForwardHooks) error {
 	configFileName := c.String(flagNameConfigFile)
 
 	var cfg *config.Config
@@ -231,6 +367,29 @@ func handleActionPortForward(c *cli.Context) error {
 	}
 
 	cfg.ForwarderAgentPath = c.String(flagNameForwarderAgentScript)
+	if c.Bool(flagNameRouter) {
+		cfg.Router = true
+	}
+	if c.Bool(flagNameRootless) {
+		cfg.Rootless = true
+	}
+	connectionInfo := c.String(flagNameConnectionInfo)
+	if connectionInfo == "" && c.String(flagNameConnectionInfoFile) != "" {
+		connectionInfo = config.ConnectionInfoDotenv
+	}
+	if !cfg.Rootless {
+		stopHelper, err := setupPrivilegedChanges(c)
+		if err != nil {
+			return err
+		}
+		defer stopHelper()
+	}
+	if c.IsSet(flagNameAgentBootstrap) {
+		cfg.AgentBootstrap = c.String(flagNameAgentBootstrap)
+	}
+	if err := validateAgentBootstrap(cfg.AgentBootstrap); err != nil {
+		return err
+	}
 
 	log.Printf("find target pod on cluster: %s", k8sClient.Context)
 
@@ -247,11 +406,65 @@ func handleActionPortForward(c *cli.Context) error {
 		return fmt.Errorf("unable to get environment variables from target pod: %w", err)
 	}
 
-	if err := config.ParseConfigAddresses(cfg, envvars); err != nil {
+	templateData := config.NewTemplateData(envvars, newK8sTemplateResolver(c.Context, k8sClient, target))
+	if err := config.ParseConfigAddressesWithData(cfg, templateData); err != nil {
 		return fmt.Errorf("unable to render environment variables to config: %w", err)
 	}
 
-	PortForwardFromConfig(c.Context, cfg, k8sClient, target)
+	if c.Bool(flagNameRewriteTargetEnvar) {
+		envvars = config.RewriteEnv(cfg.Forwards, envvars)
+		if saveTargetEnvarToFile {
+			if err := saveEnvar(target.Pod+".local", envvars); err != nil {
+				log.Warnf("unable to save envar: %s", err)
+			}
+		}
+	}
+
+	if c.String(flagNameExportEnv) != "" {
+		if err := exportEnv(c, target.Pod, envvars); err != nil {
+			return err
+		}
+	}
+
+	if connectionInfo != "" {
+		if err := writeConnectionInfo(c.String(flagNameConnectionInfoFile), connectionInfo, cfg.Forwards); err != nil {
+			return err
+		}
+	} else if cfg.Rootless {
+		var secretValues []string
+		for _, fwd := range cfg.Forwards {
+			secretValues = append(secretValues, fwd.SecretValues...)
+		}
+		for _, info := range config.GetConnectionInfo(cfg.Forwards) {
+			log.Printf("%s", agentapi.RedactSecrets(fmt.Sprintf("%s: %s:%s -> %s:%s", info.Name, info.TargetHost, info.TargetPort, info.Host, info.Port), secretValues))
+		}
+	}
 
+	if err := resolveOriginateTLSSecrets(c.Context, k8sClient, target.Namespace, cfg.Forwards); err != nil {
+		return err
+	}
+
+	if hooks.OnRunning != nil {
+		hooks.OnRunning(cfg, target, envvars)
+	}
+	PortForwardFromConfig(c.Context, cfg, k8sClient, target, hooks.OnReady)
+
+	return nil
+}
+
+// writeConnectionInfo writes connection info of forwards in format to path, or stdout when path is empty.
+func writeConnectionInfo(path, format string, forwards []config.ForwardConfig) error {
+	if path == "" {
+		return config.WriteConnectionInfo(os.Stdout, format, forwards)
+	}
+
+	output := &bytes.Buffer{}
+	if err := config.WriteConnectionInfo(output, format, forwards); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, output.Bytes(), 0600); err != nil {
+		return fmt.Errorf("unable to write connection info: %w", err)
+	}
+	log.Printf("connection info written to %s", path)
 	return nil
 }
@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/abdularis/kportfwd/internal/capture"
+	"github.com/abdularis/kportfwd/internal/k8s"
+	"github.com/abdularis/kportfwd/internal/log"
+
+	"github.com/urfave/cli/v2"
+)
+
+var captureCommand = &cli.Command{
+	Name:      "capture",
+	Usage:     "Capture traffic of a running forward until interrupted, as pcapng or hexdump",
+	ArgsUsage: "<forward name or target address>",
+	Flags: []cli.Flag{
+		FlagConfigFile,
+		FlagTarget,
+		FlagNamespace,
+		FlagContainer,
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Capture file path, '-' writes to stdout (e.g. to pipe into 'wireshark -k -i -')",
+			Value:   "-",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "Capture format: 'pcapng' or 'hexdump', defaults to pcapng for .pcapng files and hexdump otherwise",
+		},
+	},
+	Action: handleActionCapture,
+}
+
+func handleActionCapture(c *cli.Context) error {
+	forward := c.Args().First()
+	if forward == "" {
+		return fmt.Errorf("forward name or target address is required")
+	}
+
+	outputPath := c.String("output")
+	format := c.String("format")
+	if format == "" {
+		format = capture.FormatHexdump
+		if strings.HasSuffix(outputPath, ".pcapng") {
+			format = capture.FormatPcapng
+		}
+	}
+
+	cfg, err := loadTargetConfig(c)
+	if err != nil {
+		return err
+	}
+
+	k8sClient, err := k8s.NewKubeClientConfig()
+	if err != nil {
+		return err
+	}
+
+	target, err := FindTargetPod(c.Context, cfg, k8sClient)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelFn := context.WithCancel(c.Context)
+	defer cancelFn()
+
+	agents, err := connectForwardAgents(ctx, k8sClient, target, forward)
+	if err != nil {
+		return err
+	}
+
+	var output io.Writer = os.Stdout
+	if outputPath != "-" {
+		file, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("unable to create capture file: %w", err)
+		}
+		defer file.Close()
+		output = file
+	}
+
+	writer, err := capture.NewWriter(format, output)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: Connection ids are only unique within an agent session, offset them per session
+	var mu sync.Mutex
+	count := 0
+	writeRecord := func(session int, record agentapi.CaptureRecord) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		record.ConnID = record.ConnID<<8 | uint64(session)
+		if record.Dropped > 0 {
+			log.Warnf("%d capture records dropped, the agent produced them faster than they could be sent", record.Dropped)
+		}
+		count++
+		return writer.WriteRecord(record)
+	}
+
+	log.Printf("capturing %s, press Ctrl+C to stop", forward)
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(agents))
+	for idx, agentAPI := range agents {
+		wg.Add(1)
+		go func(session int, agentAPI *agentAPIClient) {
+			defer wg.Done()
+			err := agentAPI.capture(ctx, forward, func(record agentapi.CaptureRecord) error {
+				return writeRecord(session, record)
+			})
+			if err != nil {
+				errCh <- err
+				cancelFn()
+			}
+		}(idx, agentAPI)
+	}
+	wg.Wait()
+	close(errCh)
+
+	log.Printf("capture stopped, %d records written", count)
+	return <-errCh
+}
@@ -0,0 +1,380 @@
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/config"
+	"github.com/abdularis/kportfwd/internal/daemon"
+	"github.com/abdularis/kportfwd/internal/log"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	flagNameDetach        = "d"
+	flagNameSessionName   = "name"
+	flagNameDaemonSession = "daemon-session"
+	flagNameFollow        = "f"
+	flagNameAll           = "all"
+)
+
+// daemonStartTimeout is how long `up -d` waits for the background session to have its forwards running.
+const daemonStartTimeout = time.Minute * 2
+
+var upCommand = &cli.Command{
+	Name:      "up",
+	Usage:     "Start port forwarding, in the background with -d",
+	ArgsUsage: "[config file]",
+	Flags: append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:    flagNameDetach,
+			Aliases: []string{"detach"},
+			Usage:   "Run in the background, keeps running once the terminal is closed",
+		},
+		&cli.StringFlag{
+			Name:  flagNameSessionName,
+			Usage: "Session name used by ls, logs and down (defaults to the config file name)",
+		},
+		&cli.StringFlag{
+			Name:   flagNameDaemonSession,
+			Hidden: true,
+		},
+	}, portForwardFlags...),
+	Action: handleActionUp,
+}
+
+var lsCommand = &cli.Command{
+	Name:   "ls",
+	Usage:  "List port forwarding sessions running in the background",
+	Action: handleActionLs,
+}
+
+var downCommand = &cli.Command{
+	Name:      "down",
+	Usage:     "Stop a port forwarding session running in the background",
+	ArgsUsage: "<session>",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  flagNameAll,
+			Usage: "Stop all sessions",
+		},
+	},
+	Action: handleActionDown,
+}
+
+var logsCommand = &cli.Command{
+	Name:      "logs",
+	Usage:     "Show logs of a port forwarding session running in the background",
+	ArgsUsage: "<session>",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  flagNameFollow,
+			Usage: "Follow new log lines",
+		},
+	},
+	Action: handleActionLogs,
+}
+
+func handleActionUp(c *cli.Context) error {
+	if c.Args().Present() && !c.IsSet(flagNameConfigFile) {
+		if err := c.Set(flagNameConfigFile, c.Args().First()); err != nil {
+			return err
+		}
+	}
+
+	if id := c.String(flagNameDaemonSession); id != "" {
+		return runDaemonSession(c, id)
+	}
+	if c.Bool(flagNameDetach) {
+		return startDaemonSession(c)
+	}
+	return handleActionPortForward(c)
+}
+
+// startDaemonSession starts kportfwd up again as a detached process writing to the session log file,
+// and waits until its forwards are running.
+func startDaemonSession(c *cli.Context) error {
+	id := c.String(flagNameSessionName)
+	if id == "" {
+		id = defaultSessionID(c.String(flagNameConfigFile))
+	}
+	if err := daemon.ValidateSessionID(id); err != nil {
+		return err
+	}
+
+	dir, err := daemon.Dir()
+	if err != nil {
+		return err
+	}
+	if session, err := daemon.ReadSession(dir, id); err == nil {
+		if _, err := daemon.NewClient(daemon.SessionPaths(dir, id).Socket).Session(c.Context); err == nil {
+			return fmt.Errorf("session %s is already running (pid %d), stop it with `kportfwd down %s`", id, session.PID, id)
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to create session dir: %w", err)
+	}
+
+	paths := daemon.SessionPaths(dir, id)
+	logFile, err := os.OpenFile(paths.Log, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to create session log file: %w", err)
+	}
+	defer logFile.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find kportfwd executable: %w", err)
+	}
+
+	cmd := exec.Command(executable, daemonArgs(os.Args[1:], c.Command.Name, id)...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	daemon.Detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start session: %w", err)
+	}
+
+	exitCh := make(chan error, 1)
+	go func() { exitCh <- cmd.Wait() }()
+
+	client := daemon.NewClient(paths.Socket)
+	ticker := time.NewTicker(time.Millisecond * 200)
+	defer ticker.Stop()
+	timeout := time.NewTimer(daemonStartTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case err := <-exitCh:
+			return fmt.Errorf("session %s exited (%v), see logs with `kportfwd logs %s`", id, err, id)
+		case <-timeout.C:
+			fmt.Printf("session %s (pid %d) is still starting, see logs with `kportfwd logs -f %s`\n", id, cmd.Process.Pid, id)
+			return nil
+		case <-c.Context.Done():
+			return c.Context.Err()
+		case <-ticker.C:
+		}
+
+		session, err := client.Session(c.Context)
+		if err != nil || session.State != daemon.SessionStateRunning {
+			continue
+		}
+		fmt.Printf("session %s running in the background (pid %d)\n", id, session.PID)
+		printSessionForwards(session)
+		return nil
+	}
+}
+
+// daemonArgs returns arguments running the session id in the foreground, from arguments args of `kportfwd up -d`.
+func daemonArgs(args []string, command, id string) []string {
+	result := []string{}
+	idx := 0
+	for ; idx < len(args); idx++ {
+		result = append(result, args[idx])
+		if args[idx] == command {
+			break
+		}
+	}
+	result = append(result, "--"+flagNameDaemonSession, id)
+
+	for _, arg := range args[idx+1:] {
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && (name == flagNameDetach || name == "detach") {
+			continue
+		}
+		result = append(result, arg)
+	}
+	return result
+}
+
+func defaultSessionID(configFile string) string {
+	if configFile != "" {
+		return strings.TrimSuffix(filepath.Base(configFile), filepath.Ext(configFile))
+	}
+	suffix := make([]byte, 3)
+	_, _ = rand.Read(suffix)
+	return "kportfwd-" + hex.EncodeToString(suffix)
+}
+
+// runDaemonSession runs port forwarding of the background session id, with its control socket.
+func runDaemonSession(c *cli.Context, id string) error {
+	dir, err := daemon.Dir()
+	if err != nil {
+		return err
+	}
+
+	configFile := c.String(flagNameConfigFile)
+	if configFile != "" {
+		if configFile, err = filepath.Abs(configFile); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(c.Context)
+	defer cancel()
+
+	server := daemon.NewServer(dir, daemon.Session{
+		ID:         id,
+		PID:        os.Getpid(),
+		ConfigFile: configFile,
+		StartedAt:  time.Now(),
+		State:      daemon.SessionStateStarting,
+	}, cancel)
+	serveDoneCh := make(chan struct{})
+	go func() {
+		defer close(serveDoneCh)
+		if err := server.Serve(ctx); err != nil {
+			log.Errorf("session control socket: %s", err)
+			cancel()
+		}
+	}()
+
+	log.Printf("session %s started (pid %d)", id, os.Getpid())
+	c.Context = ctx
+	var sessionTarget string
+	var forwards []daemon.Forward
+	err = runPortForward(c, portForwardHooks{
+		OnRunning: func(cfg *config.Config, target config.AgentTarget, _ map[string]string) {
+			sessionTarget = fmt.Sprintf("%s/%s/%s", target.Namespace, target.Pod, target.Container)
+			for _, fwd := range cfg.Forwards {
+				forwards = append(forwards, daemon.Forward{Name: fwd.Name, LocalAddr: fwd.LocalAddrParsed.Host, TargetAddr: fwd.Redact(fwd.TargetAddr)})
+			}
+		},
+		OnReady: func() {
+			if err := server.SetRunning(sessionTarget, forwards); err != nil {
+				log.Errorf("unable to update session state: %s", err)
+			}
+		},
+	})
+
+	cancel()
+	<-serveDoneCh
+	log.Printf("session %s stopped", id)
+	return err
+}
+
+func handleActionLs(c *cli.Context) error {
+	dir, err := daemon.Dir()
+	if err != nil {
+		return err
+	}
+	sessions, err := daemon.List(dir)
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		fmt.Println("no session running in the background")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION\tPID\tSTATE\tUPTIME\tTARGET\tFORWARDS\tCONFIG")
+	for _, session := range sessions {
+		if session.State != daemon.SessionStateDead {
+			if live, err := daemon.NewClient(daemon.SessionPaths(dir, session.ID).Socket).Session(c.Context); err == nil {
+				session = live
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%d\t%s\n", session.ID, session.PID, session.State,
+			time.Since(session.StartedAt).Round(time.Second), session.Target, len(session.Forwards), session.ConfigFile)
+	}
+	return w.Flush()
+}
+
+func handleActionDown(c *cli.Context) error {
+	dir, err := daemon.Dir()
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	if c.Bool(flagNameAll) {
+		sessions, err := daemon.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			if session.State != daemon.SessionStateDead {
+				ids = append(ids, session.ID)
+			}
+		}
+	} else {
+		if !c.Args().Present() {
+			return fmt.Errorf("session is required, see `kportfwd ls`")
+		}
+		ids = c.Args().Slice()
+	}
+
+	var errs []string
+	for _, id := range ids {
+		if err := stopDaemonSession(c.Context, dir, id); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		fmt.Printf("session %s stopped\n", id)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// stopDaemonSession asks session id to stop and waits until its files are removed.
+func stopDaemonSession(ctx context.Context, dir, id string) error {
+	if _, err := daemon.ReadSession(dir, id); err != nil {
+		return err
+	}
+	if err := daemon.NewClient(daemon.SessionPaths(dir, id).Socket).Shutdown(ctx); err != nil {
+		return fmt.Errorf("unable to stop session %s: %w", id, err)
+	}
+
+	deadline := time.Now().Add(time.Second * 30)
+	for time.Now().Before(deadline) {
+		if _, err := daemon.ReadSession(dir, id); err != nil {
+			return nil
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+	return fmt.Errorf("session %s is still stopping", id)
+}
+
+func handleActionLogs(c *cli.Context) error {
+	id := c.Args().First()
+	if id == "" {
+		return fmt.Errorf("session is required, see `kportfwd ls`")
+	}
+	dir, err := daemon.Dir()
+	if err != nil {
+		return err
+	}
+
+	paths := daemon.SessionPaths(dir, id)
+	if _, err := daemon.ReadSession(dir, id); err != nil {
+		// NOTE: Logs of a stopped session are kept until the session name is reused
+		data, readErr := os.ReadFile(paths.Log)
+		if readErr != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return daemon.NewClient(paths.Socket).Logs(c.Context, c.Bool(flagNameFollow), os.Stdout)
+}
+
+func printSessionForwards(session daemon.Session) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tLOCAL\tTARGET")
+	for _, fwd := range session.Forwards {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", fwd.Name, fwd.LocalAddr, fwd.TargetAddr)
+	}
+	_ = w.Flush()
+}
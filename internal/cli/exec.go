@@ -0,0 +1,152 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/abdularis/kportfwd/internal/config"
+	"github.com/abdularis/kportfwd/internal/log"
+
+	"github.com/urfave/cli/v2"
+)
+
+// execSkippedEnvars are target pod environment variables describing the pod process itself,
+// the local command keeps its own values.
+var execSkippedEnvars = map[string]bool{
+	"PATH":     true,
+	"HOME":     true,
+	"HOSTNAME": true,
+	"PWD":      true,
+	"OLDPWD":   true,
+	"SHLVL":    true,
+	"TERM":     true,
+	"USER":     true,
+	"SHELL":    true,
+	"_":        true,
+}
+
+var execCommand = &cli.Command{
+	Name:      "exec",
+	Usage:     "Run a local command with forwards ready and the target pod environment variables",
+	ArgsUsage: "-- <command> [args...]",
+	Flags:     portForwardFlags,
+	Action:    handleActionExec,
+}
+
+func handleActionExec(c *cli.Context) error {
+	args := c.Args().Slice()
+	if len(args) == 0 {
+		return fmt.Errorf("command is required, e.g. `kportfwd exec --config cfg.yaml -- go test ./...`")
+	}
+
+	// NOTE: Forwarding is not stopped by interrupt/terminate while the command runs, the command is stopped
+	// instead and forwards are torn down once it exited
+	parentCtx := c.Context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.Context = ctx
+
+	readyCh := make(chan struct{})
+	forwardDoneCh := make(chan error, 1)
+	var envvars map[string]string
+	go func() {
+		forwardDoneCh <- runPortForward(c, portForwardHooks{
+			OnRunning: func(_ *config.Config, _ config.AgentTarget, podEnvvars map[string]string) {
+				envvars = podEnvvars
+			},
+			OnReady: func() { close(readyCh) },
+		})
+	}()
+
+	select {
+	case <-readyCh:
+	case err := <-forwardDoneCh:
+		if err == nil {
+			err = fmt.Errorf("forwarding stopped before being ready")
+		}
+		return err
+	case <-parentCtx.Done():
+		cancel()
+		<-forwardDoneCh
+		return parentCtx.Err()
+	}
+
+	log.Printf("forwards ready, running: %s", strings.Join(args, " "))
+	exitCode, err := runExecCommand(parentCtx, args, execEnv(os.Environ(), envvars))
+
+	cancel()
+	<-forwardDoneCh
+
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return cli.Exit("", exitCode)
+	}
+	return nil
+}
+
+// runExecCommand runs args with env attached to the terminal, and returns its exit code. The command
+// is terminated when ctx is done.
+func runExecCommand(ctx context.Context, args []string, env []string) (int, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("unable to run %s: %w", args[0], err)
+	}
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		case <-doneCh:
+		}
+	}()
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// execEnv returns environ with envvars of the target pod added, target pod values take precedence
+// except for execSkippedEnvars and the kubernetes in-cluster variables.
+func execEnv(environ []string, envvars map[string]string) []string {
+	env := make([]string, 0, len(environ)+len(envvars))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, ok := envvars[name]; ok && !skipExecEnvar(name) {
+			continue
+		}
+		env = append(env, kv)
+	}
+	for name, value := range envvars {
+		if skipExecEnvar(name) {
+			continue
+		}
+		env = append(env, name+"="+value)
+	}
+	return env
+}
+
+func skipExecEnvar(name string) bool {
+	return execSkippedEnvars[name] || strings.HasPrefix(name, "KUBERNETES_")
+}
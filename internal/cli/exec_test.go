@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ExecEnv(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/local/bin:/usr/bin",
+		"HOME=/home/dev",
+		"DB_HOST=localhost",
+		"EDITOR=vim",
+		"KUBERNETES_SERVICE_HOST=kind.local",
+		"NO_VALUE",
+	}
+	envvars := map[string]string{
+		"PATH":                    "/app/bin",
+		"HOME":                    "/app",
+		"HOSTNAME":                "api-7f9c-x2b",
+		"_":                       "/usr/bin/env",
+		"DB_HOST":                 "postgres",
+		"DB_PASSWORD":             "s3cret",
+		"KUBERNETES_SERVICE_HOST": "10.96.0.1",
+		"KUBERNETES_PORT":         "tcp://10.96.0.1:443",
+		"NO_VALUE":                "from-pod",
+	}
+
+	env := execEnv(environ, envvars)
+	sort.Strings(env)
+	assert.Equal(t, []string{
+		// pod values override local ones
+		"DB_HOST=postgres",
+		"DB_PASSWORD=s3cret",
+		"EDITOR=vim",
+		// the local process and in-cluster variables are kept
+		"HOME=/home/dev",
+		"KUBERNETES_SERVICE_HOST=kind.local",
+		"NO_VALUE=from-pod",
+		"PATH=/usr/local/bin:/usr/bin",
+	}, env)
+
+	assert.Equal(t, environ, execEnv(environ, nil))
+}
+
+func Test_RunExecCommand(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Args     []string
+		Env      []string
+		Expected int
+	}{
+		{Name: "success", Args: []string{"sh", "-c", "exit 0"}, Expected: 0},
+		{Name: "exit code", Args: []string{"sh", "-c", "exit 3"}, Expected: 3},
+		{Name: "terminated", Args: []string{"sh", "-c", "kill -TERM $$"}, Expected: 143},
+		{Name: "killed", Args: []string{"sh", "-c", "kill -KILL $$"}, Expected: 137},
+		{Name: "env", Args: []string{"sh", "-c", `test "$DB_HOST" = postgres`}, Env: []string{"DB_HOST=postgres"}, Expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			env := append(os.Environ(), tt.Env...)
+			exitCode, err := runExecCommand(context.Background(), tt.Args, env)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.Expected, exitCode)
+		})
+	}
+
+	_, err := runExecCommand(context.Background(), []string{filepath.Join(t.TempDir(), "missing")}, os.Environ())
+	assert.ErrorContains(t, err, "unable to run")
+
+	// the command is terminated once the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	exitCode, err := runExecCommand(ctx, []string{"sleep", "10"}, os.Environ())
+	assert.NoError(t, err)
+	assert.Equal(t, 143, exitCode)
+}
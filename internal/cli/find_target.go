@@ -2,17 +2,22 @@ package cli
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/abdularis/kportfwd/internal/config"
+	"github.com/abdularis/kportfwd/internal/envfile"
 	"github.com/abdularis/kportfwd/internal/k8s"
 	"github.com/abdularis/kportfwd/internal/log"
 
+	"github.com/urfave/cli/v2"
 	v1 "k8s.io/api/core/v1"
 )
 
+// envarsDir is where target pod environment variables are saved by default.
+const envarsDir = ".envs"
+
 func FindTargetPod(ctx context.Context, cfg *config.Config, k8sClient *k8s.ClientConfig) (config.AgentTarget, error) {
 	pods, err := k8s.FindPod(ctx, k8sClient, cfg.Target.Pod.Namespace, cfg.Target.Pod.LabelSelector, "")
 	if err != nil {
@@ -66,23 +71,51 @@ func GetTargetPodEnvars(ctx context.Context, k8sClient *k8s.ClientConfig, namesp
 	return envvars, nil
 }
 
-func saveEnvar(podName string, envars map[string]string) error {
-	data := ""
-	for name, value := range envars {
-		data += fmt.Sprintf("%s=%s\n", name, value)
+// saveEnvar saves envars as a dotenv file .envs/<name>, only readable by the current user.
+func saveEnvar(name string, envars map[string]string) error {
+	if err := os.MkdirAll(envarsDir, 0700); err != nil {
+		return fmt.Errorf("create envs dir err: %w", err)
 	}
 
-	if err := os.MkdirAll("./.envs/", 0777); err != nil {
-		if !errors.Is(err, os.ErrExist) {
-			return fmt.Errorf("create envs dir err: %w", err)
+	fileName := filepath.Join(envarsDir, name)
+	log.Printf("save .env into %s", fileName)
+	if err := envfile.WriteFile(fileName, envfile.FormatDotenv, envars); err != nil {
+		return fmt.Errorf("write file err: %w", err)
+	}
+	return nil
+}
+
+// exportEnv exports envvars of target pod podName as set by export env flags.
+func exportEnv(c *cli.Context, podName string, envvars map[string]string) error {
+	format := c.String(flagNameExportEnv)
+	if err := envfile.ValidateFormat(format); err != nil {
+		return err
+	}
+
+	opts := envfile.Options{
+		Include: c.StringSlice(flagNameExportEnvInclude),
+		Exclude: c.StringSlice(flagNameExportEnvExclude),
+		Redact:  c.StringSlice(flagNameExportEnvRedact),
+	}
+	if c.Bool(flagNameExportEnvRedactSecrets) {
+		opts.Redact = append(opts.Redact, envfile.SecretPatterns...)
+	}
+	for _, patterns := range [][]string{opts.Include, opts.Exclude, opts.Redact} {
+		if err := envfile.ValidatePatterns(patterns); err != nil {
+			return err
 		}
 	}
 
-	fileName := fmt.Sprintf("./.envs/%s", podName)
-	log.Printf("save .env into %s", fileName)
-	err := os.WriteFile(fileName, []byte(data), 0777)
-	if err != nil {
-		return fmt.Errorf("write file err: %w", err)
+	fileName := c.String(flagNameExportEnvFile)
+	if fileName == "" {
+		if err := os.MkdirAll(envarsDir, 0700); err != nil {
+			return fmt.Errorf("create envs dir err: %w", err)
+		}
+		fileName = filepath.Join(envarsDir, podName+"."+format)
+	}
+	if err := envfile.WriteFile(fileName, format, envfile.Apply(envvars, opts)); err != nil {
+		return fmt.Errorf("unable to export environment variables: %w", err)
 	}
+	log.Printf("environment variables exported to %s", fileName)
 	return nil
 }
@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/abdularis/kportfwd/internal/k8s"
+
+	"github.com/urfave/cli/v2"
+)
+
+var inspectCommand = &cli.Command{
+	Name:      "inspect",
+	Usage:     "List recent HTTP exchanges of an inspected forward, show or replay one of them",
+	ArgsUsage: "<forward name or target address>",
+	Flags: []cli.Flag{
+		FlagConfigFile,
+		FlagTarget,
+		FlagNamespace,
+		FlagContainer,
+		&cli.Uint64Flag{
+			Name:  "id",
+			Usage: "Show headers and bodies of the exchange with this id",
+		},
+		&cli.Uint64Flag{
+			Name:  "replay",
+			Usage: "Send the request of the exchange with this id again and show the result",
+		},
+	},
+	Action: handleActionInspect,
+}
+
+func handleActionInspect(c *cli.Context) error {
+	forward := c.Args().First()
+	if forward == "" {
+		return fmt.Errorf("forward name or target address is required")
+	}
+
+	cfg, err := loadTargetConfig(c)
+	if err != nil {
+		return err
+	}
+
+	k8sClient, err := k8s.NewKubeClientConfig()
+	if err != nil {
+		return err
+	}
+
+	target, err := FindTargetPod(c.Context, cfg, k8sClient)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelFn := context.WithCancel(c.Context)
+	defer cancelFn()
+
+	agents, err := connectForwardAgents(ctx, k8sClient, target, forward)
+	if err != nil {
+		return err
+	}
+	if len(agents) > 1 && (c.IsSet("id") || c.IsSet("replay")) {
+		return fmt.Errorf("forward %s runs on %d agent sessions, exchange ids are ambiguous", forward, len(agents))
+	}
+
+	switch {
+	case c.IsSet("replay"):
+		exchange, err := agents[0].replayHTTPExchange(ctx, forward, c.Uint64("replay"))
+		if err != nil {
+			return err
+		}
+		printHTTPExchange(exchange)
+	case c.IsSet("id"):
+		exchange, err := agents[0].httpExchange(ctx, forward, c.Uint64("id"))
+		if err != nil {
+			return err
+		}
+		printHTTPExchange(exchange)
+	default:
+		var exchanges []agentapi.HTTPExchange
+		for _, agentAPI := range agents {
+			result, err := agentAPI.httpExchanges(ctx, forward)
+			if err != nil {
+				return err
+			}
+			exchanges = append(exchanges, result...)
+		}
+		sort.SliceStable(exchanges, func(i, j int) bool { return exchanges[i].Time.Before(exchanges[j].Time) })
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTIME\tMETHOD\tHOST\tURL\tSTATUS\tLATENCY\tREQ\tRESP\tERROR")
+		for _, exchange := range exchanges {
+			status := fmt.Sprint(exchange.Status)
+			if exchange.Replay {
+				status += " (replay)"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", exchange.ID, exchange.Time.Local().Format(time.TimeOnly),
+				exchange.Method, exchange.Host, exchange.URL, status, exchange.Latency.Round(time.Millisecond),
+				exchange.RequestSize, exchange.ResponseSize, exchange.Error)
+		}
+		return w.Flush()
+	}
+	return nil
+}
+
+// printHTTPExchange prints exchange as request and response messages.
+func printHTTPExchange(exchange agentapi.HTTPExchange) {
+	fmt.Printf("# exchange %d, %s, backend %s, latency %s, duration %s\n",
+		exchange.ID, exchange.Time.Local().Format(time.RFC3339), exchange.Backend, exchange.Latency, exchange.Duration)
+
+	fmt.Printf("%s %s %s\nHost: %s\n", exchange.Method, exchange.URL, exchange.Proto, exchange.Host)
+	_ = exchange.RequestHeader.Write(os.Stdout)
+	fmt.Println()
+	printHTTPBody(exchange.RequestBody, exchange.RequestSize, exchange.RequestBodyTruncated)
+
+	if exchange.Error != "" {
+		fmt.Printf("\n# error: %s\n", exchange.Error)
+		if exchange.Status == 0 {
+			return
+		}
+	}
+
+	fmt.Printf("\n%s %d\n", exchange.Proto, exchange.Status)
+	_ = exchange.ResponseHeader.Write(os.Stdout)
+	fmt.Println()
+	printHTTPBody(exchange.ResponseBody, exchange.ResponseSize, exchange.ResponseBodyTruncated)
+}
+
+func printHTTPBody(body []byte, size int64, truncated bool) {
+	if len(body) == 0 {
+		return
+	}
+	if !utf8.Valid(body) {
+		fmt.Printf("# %d bytes binary body\n", size)
+		return
+	}
+	fmt.Println(strings.TrimRight(string(body), "\n"))
+	if truncated {
+		fmt.Printf("# body truncated, %d of %d bytes shown\n", len(body), size)
+	}
+}
@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/abdularis/kportfwd/internal/log"
+)
+
+// halfCloseConn is a client connection able to half-close, *net.TCPConn or *tls.Conn.
+type halfCloseConn interface {
+	net.Conn
+	CloseWrite() error
+}
+
+// serveLocalClients accepts local client connections on listener and pipes them to upstreamAddr, the local end
+// of the kubernetes port forward to the agent, until ctx is done. TLS is terminated when tlsConfig is set, the
+// client address is written ahead of the connection data as a PROXY protocol header when proxyProtocol is set.
+func serveLocalClients(ctx context.Context, listener net.Listener, tlsConfig *tls.Config, upstreamAddr string, proxyProtocol bool) error {
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+
+			var client halfCloseConn = conn.(*net.TCPConn)
+			if tlsConfig != nil {
+				tlsConn, err := terminateTLS(ctx, conn, tlsConfig)
+				if err != nil {
+					log.Warnf("tls handshake from %s: %s", conn.RemoteAddr(), err)
+					return
+				}
+				client = tlsConn
+			}
+			pipeUpstream(ctx, client, upstreamAddr, proxyProtocol)
+		}()
+	}
+}
+
+// pipeUpstream dials upstreamAddr and copies both directions of conn through it until both are done.
+func pipeUpstream(ctx context.Context, conn halfCloseConn, upstreamAddr string, proxyProtocol bool) {
+	var dialer net.Dialer
+	upstream, err := dialer.DialContext(ctx, "tcp", upstreamAddr)
+	if err != nil {
+		log.Errorf("unable to connect to port forward %s: %s", upstreamAddr, err)
+		return
+	}
+	defer upstream.Close()
+
+	if proxyProtocol {
+		if err := agentapi.WriteProxyHeader(upstream, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			log.Errorf("unable to write client address to port forward %s: %s", upstreamAddr, err)
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(upstream, conn)
+		_ = upstream.(*net.TCPConn).CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(conn, upstream); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Debugf("forward %s: %s", conn.RemoteAddr(), err)
+		}
+		_ = conn.CloseWrite()
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ServeLocalClientsProxyProtocol(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer upstream.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = serveLocalClients(ctx, listener, nil, upstream.Addr().String(), true) }()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("ping"))
+	assert.NoError(t, err)
+	assert.NoError(t, client.(*net.TCPConn).CloseWrite())
+
+	// the agent side reads the client address ahead of the connection data
+	conn, err := upstream.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	clientAddr, err := agentapi.ReadProxyHeader(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, client.LocalAddr().String(), clientAddr)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(data))
+}
@@ -3,23 +3,33 @@ package cli
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
-	"net/http"
+	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/abdularis/kportfwd/internal/agentapi"
 	"github.com/abdularis/kportfwd/internal/config"
 	"github.com/abdularis/kportfwd/internal/etchosts"
 	"github.com/abdularis/kportfwd/internal/ifconfig"
 	"github.com/abdularis/kportfwd/internal/k8s"
+	"github.com/abdularis/kportfwd/internal/localca"
 	"github.com/abdularis/kportfwd/internal/log"
+	"github.com/abdularis/kportfwd/internal/router"
 )
 
-func PortForwardFromConfig(ctx context.Context, cfg *config.Config, k8sClient *k8s.ClientConfig, target config.AgentTarget) {
+// PortForwardFromConfig runs the forwarder agent on target and forwards cfg forwards to it until ctx is done,
+// onReady (optional) is called once every forward is ready.
+func PortForwardFromConfig(ctx context.Context, cfg *config.Config, k8sClient *k8s.ClientConfig, target config.AgentTarget, onReady func()) {
 	// 1. Get target pod name
 	// 2. Copy relay agent to target pod container
 	// 3. Execute relay agent on target pod container
@@ -59,27 +69,57 @@ func PortForwardFromConfig(ctx context.Context, cfg *config.Config, k8sClient *k
 			cancelFn()
 			wg.Done()
 		}()
-		portForwardAll(ctx, k8sClient, target.Namespace, target.Pod, cfg.Forwards)
+		portForwardAll(ctx, k8sClient, target.Namespace, target.Pod, cfg.Forwards, cfg.Rootless, onReady)
 	}()
 
 	wg.Wait()
 }
 
-func portForwardAll(ctx context.Context, k8sClient *k8s.ClientConfig, ns, targetPod string, cfgs []config.ForwardConfig) {
+// portForwardAll forwards local addresses of cfgs to the agent, target hosts are added to /etc/hosts
+// and local addresses other than 127.0.0.1 aliased on loopback unless rootless. onReady (optional) is called
+// once every forwarder is ready.
+func portForwardAll(ctx context.Context, k8sClient *k8s.ClientConfig, ns, targetPod string, cfgs []config.ForwardConfig, rootless bool, onReady func()) {
 	ctx, cancelFn := context.WithCancel(ctx)
 	defer cancelFn()
 
+	var ca *localca.CA
+	for _, rc := range cfgs {
+		if !rc.TerminateTLS {
+			continue
+		}
+		caDir, err := localca.DefaultDir()
+		if err == nil {
+			ca, err = localca.LoadOrCreate(caDir)
+		}
+		if err != nil {
+			log.Errorf("unable to load local CA for terminateTLS: %s", err)
+			return
+		}
+		break
+	}
+
+	routers, err := startRouters(ctx, cfgs)
+	if err != nil {
+		log.Errorf("%s", err)
+		return
+	}
+
+	notReady := int32(len(cfgs))
 	wg := sync.WaitGroup{}
 	for _, rc := range cfgs {
 		wg.Add(1)
 		go func(cfg config.ForwardConfig) {
 			defer func() {
-				etchosts.RemoveHost(rc.TargetAddrParsed.Hostname())
+				if !rootless {
+					if err := etchosts.RemoveHost(rc.TargetAddrParsed.Hostname()); err != nil {
+						log.Errorf("unable to remove host %s: %s", rc.Redact(rc.TargetAddrParsed.Hostname()), err)
+					}
+				}
 				wg.Done()
 				cancelFn()
 			}()
 
-			if cfg.LocalAddrParsed.Hostname() != "127.0.0.1" {
+			if !rootless && cfg.LocalAddrParsed.Hostname() != "127.0.0.1" && cfg.LocalAddrParsed.Hostname() != "localhost" {
 				// add the address to the hosts file
 				if err := ifconfig.AddLoopbackAlias(cfg.LocalAddrParsed.Hostname()); err != nil {
 					log.Errorf("unable to add loopback addr alias %s: %s", cfg.LocalAddrParsed.Hostname(), err)
@@ -93,20 +133,83 @@ func portForwardAll(ctx context.Context, k8sClient *k8s.ClientConfig, ns, target
 				}()
 			}
 
-			etchosts.AddHost(cfg.LocalAddrParsed.Hostname(), rc.TargetAddrParsed.Hostname())
+			if !rootless {
+				if err := etchosts.AddHost(cfg.LocalAddrParsed.Hostname(), rc.TargetAddrParsed.Hostname()); err != nil {
+					log.Warnf("unable to add host %s: %s", cfg.Redact(cfg.TargetAddrParsed.Hostname()), err)
+				}
+			}
 
 			forwarderReadyCh := make(chan struct{})
 			defer close(forwarderReadyCh)
 
 			go func() {
-				<-forwarderReadyCh
+				// NOTE: The channel is closed without being ready when port forwarding failed
+				if _, ok := <-forwarderReadyCh; !ok {
+					return
+				}
 				log.Printf("forwarder ready: %s -> %s -> %s",
-					cfg.LocalAddrParsed.Host, cfg.SourceAddrParsed.Host, cfg.TargetAddrParsed.Host)
+					cfg.LocalAddrParsed.Host, cfg.SourceAddrParsed.Host, cfg.Redact(cfg.TargetAddrParsed.Host))
+				if atomic.AddInt32(&notReady, -1) == 0 && onReady != nil {
+					onReady()
+				}
 			}()
 
-			err := k8s.PortForward(ctx, k8sClient, forwarderReadyCh, ns, targetPod, cfg.LocalAddrParsed.Hostname(), cfg.LocalAddrParsed.Port(), cfg.SourceAddrParsed.Port(), true)
+			// NOTE: Routed forwards are reached by the router on a free loopback port, terminateTLS forwards listen
+			// on the client address themselves and reach the agent through a port forward on a free loopback port
+			clientAddr := cfg.LocalAddrParsed.Host
+			if cfg.Routed {
+				port, err := freeLocalPort()
+				if err != nil {
+					log.Errorf("route %s: %s", cfg.Redact(cfg.TargetAddrParsed.Host), err)
+					return
+				}
+				clientAddr = net.JoinHostPort("127.0.0.1", port)
+			}
+
+			// NOTE: terminateTLS and sticky forwards listen on the client address themselves, to terminate TLS
+			// and to send the client address to the agent, it only sees the port forward otherwise
+			portForwardHost, portForwardPort, _ := net.SplitHostPort(clientAddr)
+			proxyProtocol := cfg.AgentSpec().ProxyProtocol
+			if cfg.TerminateTLS || proxyProtocol {
+				var tlsConfig *tls.Config
+				if cfg.TerminateTLS {
+					var err error
+					if tlsConfig, err = terminateTLSConfig(ca, cfg); err != nil {
+						log.Errorf("terminate tls %s: %s", clientAddr, err)
+						return
+					}
+				}
+				listener, err := net.Listen("tcp", clientAddr)
+				if err != nil {
+					log.Errorf("listen %s: %s", clientAddr, err)
+					return
+				}
+				portForwardHost = "127.0.0.1"
+				if portForwardPort, err = freeLocalPort(); err != nil {
+					_ = listener.Close()
+					log.Errorf("listen %s: %s", clientAddr, err)
+					return
+				}
+				go func() {
+					if err := serveLocalClients(ctx, listener, tlsConfig, net.JoinHostPort(portForwardHost, portForwardPort), proxyProtocol); err != nil {
+						log.Errorf("listen %s: %s", clientAddr, err)
+						cancelFn()
+					}
+				}()
+			}
+
+			if cfg.Routed {
+				routes := routers[cfg.LocalAddrParsed.Port()]
+				if err := routes.Add(cfg.TargetAddrParsed.Hostname(), clientAddr); err != nil {
+					log.Errorf("route %s: %s", cfg.Redact(cfg.TargetAddrParsed.Host), err)
+					return
+				}
+				defer routes.Remove(cfg.TargetAddrParsed.Hostname())
+			}
+
+			err := k8s.PortForward(ctx, k8sClient, forwarderReadyCh, ns, targetPod, portForwardHost, portForwardPort, cfg.SourceAddrParsed.Port(), true)
 			if err != nil {
-				log.Printf("port forwarding %s: %s", cfg.TargetAddr, err)
+				log.Printf("port forwarding %s: %s", cfg.Redact(cfg.TargetAddr), err)
 			}
 		}(rc)
 	}
@@ -116,58 +219,110 @@ func portForwardAll(ctx context.Context, k8sClient *k8s.ClientConfig, ns, target
 	wg.Wait()
 }
 
+// startRouters listens on 127.0.0.1 router ports used by routed forwards, the routers are returned by port
+// and serve until ctx is done.
+func startRouters(ctx context.Context, cfgs []config.ForwardConfig) (map[string]*router.Router, error) {
+	routers := map[string]*router.Router{}
+	for _, cfg := range cfgs {
+		port := cfg.LocalAddrParsed.Port()
+		if !cfg.Routed || routers[port] != nil {
+			continue
+		}
+
+		listener, err := net.Listen("tcp", cfg.LocalAddrParsed.Host)
+		if err != nil {
+			return nil, fmt.Errorf("unable to start router: %w", err)
+		}
+
+		routes := router.NewSNI()
+		if port == config.RouterHTTPPort {
+			routes = router.NewHost()
+		}
+		routers[port] = routes
+		go func() {
+			if err := routes.Serve(ctx, listener); err != nil {
+				log.Errorf("router %s: %s", listener.Addr(), err)
+			}
+		}()
+		log.Printf("router listening on %s", listener.Addr())
+	}
+	return routers, nil
+}
+
 func runForwarderAgent(ctx context.Context, cfg *config.Config, k8sClient *k8s.ClientConfig, onReadyCh chan struct{}, ns, targetPod, container string) error {
 	// What run relay agent do?
-	// - Copy relay agent script to target pod
-	// - Execute relay agent on target pod
+	// - Attach to a compatible relay agent already running on target pod, otherwise
+	//   copy relay agent script to target pod and execute it
 	// - Port forward relay agent api
 	// - Ping relay agent periodically
 
 	ctx, cancelFn := context.WithCancel(ctx)
 	defer cancelFn()
 
-	relayFileBin, relayFileInfo, md5sumResult, err := config.GetForwarderAgentBin(cfg)
+	targetBaseDir := agentStateDir
+
+	regs, err := listAgentRegistrations(ctx, k8sClient, ns, targetPod, container, targetBaseDir)
 	if err != nil {
-		return err
+		log.Warnf("unable to find running forwarder agents: %s", err)
 	}
 
-	targetBaseDir := "/tmp"
-	targetForwarderFilePath := fmt.Sprintf("%s/%s", targetBaseDir, relayFileInfo.Name())
-
-	result, err := checkMD5SumOnTargetPod(ctx, k8sClient, ns, targetPod, container, md5sumResult, targetBaseDir)
-	if err != nil {
-		log.Printf("%s", err)
-		log.Printf("copying %s to target pod...", relayFileInfo.Name())
-		err = k8s.CopyFileToPod(ctx, k8sClient, ns, targetPod, container, targetForwarderFilePath, os.FileMode(0555), relayFileBin)
+	reg, attached := findCompatibleAgent(regs, cfg.Forwards)
+	session := reg.Session
+	token := reg.Token
+	apiPort := reg.APIPort
+	if attached {
+		log.Printf("attaching to running forwarder agent session: %s (pid: %d)", reg.Session, reg.Pid)
+	} else {
+		session, err = newSessionID()
 		if err != nil {
-			return fmt.Errorf("unable to copy agent to target container: %w", err)
+			return err
+		}
+		token, err = newSessionToken()
+		if err != nil {
+			return err
 		}
-	} else {
-		log.Printf("forwarder agent already exist: %s", result)
-	}
 
-	readyCh := make(chan struct{})
+		apiPortCh := make(chan int, 1)
+		go func() {
+			defer cancelFn()
+			err := startForwarderAgent(ctx, cfg, k8sClient, apiPortCh, session, token, targetBaseDir, ns, targetPod, container)
+			if err != nil {
+				log.Printf("error on relay agent: %s", err)
+			}
+		}()
 
-	go func() {
-		defer cancelFn()
-		err := execRelayAgentOnPod(ctx, k8sClient, readyCh, targetForwarderFilePath, ns, targetPod, container, cfg.Forwards)
-		if err != nil {
-			log.Printf("error on relay agent: %s", err)
+		select {
+		case apiPort = <-apiPortCh:
+		case <-ctx.Done():
+			return fmt.Errorf("executing forwarder agent err: %w", ctx.Err())
+		case <-time.NewTimer(time.Second * 10).C:
+			return fmt.Errorf("executing forwarder agent err: timeout waiting to be ready")
 		}
-	}()
-	if err := waitReady(readyCh); err != nil {
-		return fmt.Errorf("executing forwarder agent err: %w", err)
 	}
 
-	go func() {
-		defer cancelFn()
-		err := k8s.PortForward(ctx, k8sClient, readyCh, ns, targetPod, "127.0.0.1", "8181", "8181", true)
-		if err != nil {
-			log.Printf("port forwarding relay-agent api: %s", err)
-		}
-	}()
-	if err := waitReady(readyCh); err != nil {
-		return fmt.Errorf("forwarder agent api port err: %w", err)
+	agentAPI, err := connectAgentAPI(ctx, k8sClient, ns, targetPod, apiPort, token, cancelFn)
+	if err != nil {
+		return err
+	}
+
+	info, err := agentAPI.info(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get forwarder agent session %s info: %w", session, err)
+	}
+	if info.Session != session {
+		return fmt.Errorf("unexpected forwarder agent session on api port %d: %s, expect %s", apiPort, info.Session, session)
+	}
+	if err := useAgentForwarders(cfg.Forwards, info.Forwarders); err != nil {
+		return err
+	}
+
+	if attached {
+		// NOTE: The agent was started by another session, follow its events through the api instead of its stdout
+		go func() {
+			if err := agentAPI.events(ctx, logAgentEvent); err != nil && ctx.Err() == nil {
+				log.Warnf("forwarder agent events stream stopped: %s", err)
+			}
+		}()
 	}
 
 	onReadyCh <- struct{}{}
@@ -182,26 +337,8 @@ func runForwarderAgent(ctx context.Context, cfg *config.Config, k8sClient *k8s.C
 		case <-timer.C:
 		}
 
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://127.0.0.1:8181/ping", nil)
-		if err != nil {
-			log.Printf("unable to create ping request: %s", err)
-			timer.Reset(time.Second * 5)
-			continue
-		}
-
-		client := http.Client{
-			Timeout: time.Second * 10,
-		}
-
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("unable to call ping: %s", err)
-			timer.Reset(time.Second * 5)
-			continue
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("ping got status code: %d, expect %d", resp.StatusCode, http.StatusOK)
+		if err := agentAPI.ping(ctx); err != nil {
+			log.Printf("%s", err)
 			timer.Reset(time.Second * 5)
 			continue
 		}
@@ -210,33 +347,79 @@ func runForwarderAgent(ctx context.Context, cfg *config.Config, k8sClient *k8s.C
 	}
 }
 
-func execRelayAgentOnPod(ctx context.Context, k8sClient *k8s.ClientConfig, readyCh chan struct{}, targetForwarderFilePath, ns string, pod string, container string, configs []config.ForwardConfig) error {
-	remoteCommand := fmt.Sprintf("FORWARDER_API_PORT=8181 %s", targetForwarderFilePath)
-	for _, rc := range configs {
-		remoteCommand += fmt.Sprintf(" -address '%s->%s'", rc.SourceAddr, rc.TargetAddr)
+// startForwarderAgent bootstraps and runs a new forwarder agent session on the target pod container,
+// it blocks until the agent exited. The agent api port is sent to apiPortCh once the agent is ready.
+func startForwarderAgent(ctx context.Context, cfg *config.Config, k8sClient *k8s.ClientConfig, apiPortCh chan int, session, token, targetBaseDir, ns, targetPod, container string) error {
+	relayFileBin, relayFileInfo, md5sumResult, err := config.GetForwarderAgentBin(cfg)
+	if err != nil {
+		return err
 	}
 
-	isReady := false
-	output := &customIOWriter{
-		WriterFn: func(p []byte) (n int, err error) {
-			if !isReady && strings.Contains(string(p), "FORWARDERS READY") {
-				isReady = true
-				readyCh <- struct{}{}
+	targetForwarderFilePath := fmt.Sprintf("%s/%s", targetBaseDir, relayFileInfo.Name())
+
+	var agentStdin io.Reader
+	if cfg.AgentBootstrap == config.AgentBootstrapMemfd {
+		interpreter, err := checkMemfdInterpreter(ctx, k8sClient, ns, targetPod, container)
+		if err != nil {
+			return err
+		}
+		log.Printf("running %s in memory on target pod with %s...", relayFileInfo.Name(), interpreter)
+		agentStdin = relayFileBin
+	} else {
+		result, err := checkMD5SumOnTargetPod(ctx, k8sClient, ns, targetPod, container, md5sumResult, targetBaseDir)
+		if err != nil {
+			log.Printf("%s", err)
+			log.Printf("copying %s to target pod...", relayFileInfo.Name())
+			err = k8s.CopyFileToPod(ctx, k8sClient, ns, targetPod, container, targetForwarderFilePath, os.FileMode(0555), relayFileBin)
+			if err != nil {
+				return fmt.Errorf("unable to copy agent to target container: %w", err)
 			}
-			return os.Stdout.Write(p)
-		},
+		} else {
+			log.Printf("forwarder agent already exist: %s", result)
+		}
 	}
 
-	cmd := []string{"sh", "-c", remoteCommand}
-	return k8s.ExecOnPod(ctx, k8sClient, ns, pod, container, output, os.Stderr, cmd)
+	log.Printf("starting forwarder agent session: %s", session)
+
+	// NOTE: The token and forward specs are written on the agent stdin, after the agent binary on memfd bootstrap
+	bootstrap, err := json.Marshal(agentBootstrap(token, cfg.Forwards))
+	if err != nil {
+		return fmt.Errorf("unable to encode agent bootstrap: %w", err)
+	}
+	bootstrapStdin := bytes.NewReader(append(bootstrap, '\n'))
+	if agentStdin != nil {
+		agentStdin = io.MultiReader(agentStdin, bootstrapStdin)
+	} else {
+		agentStdin = bootstrapStdin
+	}
+
+	args := []string{"-session", session, "-state-dir", targetBaseDir, "-bootstrap-stdin"}
+	remoteCommand := agentCommand(cfg.AgentBootstrap, targetForwarderFilePath, relayFileInfo.Size(), args)
+	return execRelayAgentOnPod(ctx, k8sClient, apiPortCh, agentStdin, remoteCommand, ns, targetPod, container)
+}
+
+// execRelayAgentOnPod runs the forwarder agent remote command and sends the agent api port to apiPortCh once the agent reports ready.
+// The agent runs without a TTY so its structured events on stdout are kept apart from its logs on stderr,
+// agentStdin carries the bootstrap secrets, preceded by the agent binary on memfd bootstrap.
+func execRelayAgentOnPod(ctx context.Context, k8sClient *k8s.ClientConfig, apiPortCh chan int, agentStdin io.Reader, remoteCommand []string, ns string, pod string, container string) error {
+	var readyOnce sync.Once
+	events := newAgentEventWriter(os.Stdout, func(event agentapi.Event) {
+		if event.Type == agentapi.EventReady {
+			readyOnce.Do(func() { apiPortCh <- event.APIPort })
+		}
+		logAgentEvent(event)
+	})
+
+	return k8s.ExecOnPodWithStdin(ctx, k8sClient, ns, pod, container, agentStdin, events, os.Stderr, remoteCommand)
 }
 
 func checkMD5SumOnTargetPod(ctx context.Context, k8sClient *k8s.ClientConfig, ns, targetPod, container, md5sumResult, targetDir string) (string, error) {
 	output := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
 	command := fmt.Sprintf("cd %s && echo '%s' | md5sum -c -", targetDir, strings.TrimSpace(md5sumResult))
-	err := k8s.ExecOnPod(ctx, k8sClient, ns, targetPod, container, output, &bytes.Buffer{}, []string{"sh", "-c", command})
+	err := k8s.ExecOnPod(ctx, k8sClient, ns, targetPod, container, output, stderr, []string{"sh", "-c", command})
 	if err != nil {
-		return "", fmt.Errorf("check md5sum on target pod err: %w (stderr: %s)", err, output.String())
+		return "", fmt.Errorf("check md5sum on target pod err: %w (output: %s)", err, strings.TrimSpace(output.String()+stderr.String()))
 	}
 	return output.String(), nil
 }
@@ -254,6 +437,16 @@ func md5sumLocalFile(forwarderAgentPath string) (string, error) {
 	return string(out), nil
 }
 
+// freeLocalPort returns a currently unused tcp port on 127.0.0.1.
+func freeLocalPort() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("unable to find free local port: %w", err)
+	}
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port), nil
+}
+
 func waitReady(readyCh chan struct{}) error {
 	select {
 	case <-readyCh:
@@ -262,11 +455,3 @@ func waitReady(readyCh chan struct{}) error {
 	}
 	return nil
 }
-
-type customIOWriter struct {
-	WriterFn func(p []byte) (n int, err error)
-}
-
-func (cw *customIOWriter) Write(p []byte) (n int, err error) {
-	return cw.WriterFn(p)
-}
@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/abdularis/kportfwd/internal/etchosts"
+	"github.com/abdularis/kportfwd/internal/ifconfig"
+	"github.com/abdularis/kportfwd/internal/log"
+	"github.com/abdularis/kportfwd/internal/privhelper"
+
+	"github.com/urfave/cli/v2"
+)
+
+var privilegedHelperCommand = &cli.Command{
+	Name:   privhelper.CommandName,
+	Usage:  "Privileged helper editing /etc/hosts and loopback aliases, started by kportfwd with sudo",
+	Hidden: true,
+	Action: func(c *cli.Context) error {
+		log.SetComponentName("kportfwd-helper")
+		// NOTE: Ctrl+C reaches the helper as well, it only stops once kportfwd closes its stdin
+		// so that kportfwd can still revert its changes through it
+		signal.Ignore(os.Interrupt)
+		return privhelper.Run(c.Context, os.Stdin, os.Stdout)
+	},
+}
+
+// setupPrivilegedChanges prepares /etc/hosts and loopback alias changes, directly when running as root,
+// otherwise through the privileged helper started with sudo. The returned func stops the helper.
+func setupPrivilegedChanges(c *cli.Context) (func(), error) {
+	if os.Geteuid() == 0 {
+		etchosts.Init()
+		return func() {}, nil
+	}
+
+	log.Printf("starting privileged helper with sudo to edit /etc/hosts and loopback aliases")
+	helper, err := privhelper.Start(c.Context)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start privileged helper (use --rootless to run without root): %w", err)
+	}
+	etchosts.UseHelper(helper)
+	ifconfig.UseHelper(helper)
+	return helper.Close, nil
+}
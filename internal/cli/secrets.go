@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/abdularis/kportfwd/internal/config"
+	"github.com/abdularis/kportfwd/internal/k8s"
+)
+
+// resolveOriginateTLSSecrets reads CA bundles and client certificates of originateTLS forwards from Secrets
+// in the target namespace, the PEM data is handed to the forwarder agent along with the forward spec.
+func resolveOriginateTLSSecrets(ctx context.Context, k8sClient *k8s.ClientConfig, ns string, forwards []config.ForwardConfig) error {
+	for idx := range forwards {
+		originateTLS := forwards[idx].OriginateTLS
+		if originateTLS == nil {
+			continue
+		}
+
+		if (originateTLS.CertSecret == nil) != (originateTLS.KeySecret == nil) {
+			return fmt.Errorf("forward %s: originateTLS certSecret and keySecret must be set together", forwards[idx].Redact(forwards[idx].TargetAddr))
+		}
+
+		refs := []struct {
+			ref  *config.SecretKeyRef
+			data *[]byte
+		}{
+			{originateTLS.CASecret, &originateTLS.CAData},
+			{originateTLS.CertSecret, &originateTLS.CertData},
+			{originateTLS.KeySecret, &originateTLS.KeyData},
+		}
+		for _, item := range refs {
+			if item.ref == nil {
+				continue
+			}
+			value, err := k8s.GetSecretKey(ctx, k8sClient, ns, item.ref.Name, item.ref.Key)
+			if err != nil {
+				return fmt.Errorf("forward %s: unable to read originateTLS secret: %w", forwards[idx].Redact(forwards[idx].TargetAddr), err)
+			}
+			*item.data = value
+		}
+	}
+	return nil
+}
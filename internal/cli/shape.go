@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/abdularis/kportfwd/internal/k8s"
+
+	"github.com/urfave/cli/v2"
+)
+
+var shapeCommand = &cli.Command{
+	Name:      "shape",
+	Usage:     "Change traffic shaping of a running forward, e.g. to test against a slow database",
+	ArgsUsage: "<forward name or target address>",
+	Flags: []cli.Flag{
+		FlagConfigFile,
+		FlagTarget,
+		FlagNamespace,
+		FlagContainer,
+		&cli.Int64Flag{
+			Name:  "bandwidth",
+			Usage: "Bandwidth cap in bytes/sec of each direction",
+		},
+		&cli.DurationFlag{
+			Name:  "latency",
+			Usage: "Latency added to every forwarded chunk of data (e.g. '200ms')",
+		},
+		&cli.DurationFlag{
+			Name:  "jitter",
+			Usage: "Random latency variation in either way",
+		},
+		&cli.Float64Flag{
+			Name:  "reset-probability",
+			Usage: "Probability (0 to 1) of resetting a connection on every forwarded chunk of data",
+		},
+		&cli.BoolFlag{
+			Name:  "off",
+			Usage: "Disable traffic shaping",
+		},
+	},
+	Action: handleActionShape,
+}
+
+func handleActionShape(c *cli.Context) error {
+	forward := c.Args().First()
+	if forward == "" {
+		return fmt.Errorf("forward name or target address is required")
+	}
+
+	shaping := agentapi.Shaping{}
+	if !c.Bool("off") {
+		shaping = agentapi.Shaping{
+			BandwidthBytesPerSec: c.Int64("bandwidth"),
+			Latency:              c.Duration("latency"),
+			Jitter:               c.Duration("jitter"),
+			ResetProbability:     c.Float64("reset-probability"),
+		}
+		if !shaping.Enabled() {
+			return fmt.Errorf("no shaping option given, use --off to disable traffic shaping")
+		}
+	}
+	if err := shaping.Validate(); err != nil {
+		return err
+	}
+
+	cfg, err := loadTargetConfig(c)
+	if err != nil {
+		return err
+	}
+
+	k8sClient, err := k8s.NewKubeClientConfig()
+	if err != nil {
+		return err
+	}
+
+	target, err := FindTargetPod(c.Context, cfg, k8sClient)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelFn := context.WithCancel(c.Context)
+	defer cancelFn()
+
+	agents, err := connectForwardAgents(ctx, k8sClient, target, forward)
+	if err != nil {
+		return err
+	}
+
+	for _, agentAPI := range agents {
+		if err := agentAPI.setShaping(ctx, forward, shaping); err != nil {
+			return err
+		}
+	}
+
+	if shaping.Enabled() {
+		fmt.Printf("traffic shaping of %s: %+v\n", forward, shaping)
+	} else {
+		fmt.Printf("traffic shaping of %s disabled\n", forward)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/abdularis/kportfwd/internal/agentapi"
+	"github.com/abdularis/kportfwd/internal/config"
+	"github.com/abdularis/kportfwd/internal/k8s"
+
+	"github.com/urfave/cli/v2"
+)
+
+var statusCommand = &cli.Command{
+	Name:  "status",
+	Usage: "Show forwarder agents running on the target pod and the health of their targets",
+	Flags: []cli.Flag{
+		FlagConfigFile,
+		FlagTarget,
+		FlagNamespace,
+		FlagContainer,
+	},
+	Action: handleActionStatus,
+}
+
+func handleActionStatus(c *cli.Context) error {
+	cfg, err := loadTargetConfig(c)
+	if err != nil {
+		return err
+	}
+
+	k8sClient, err := k8s.NewKubeClientConfig()
+	if err != nil {
+		return err
+	}
+
+	target, err := FindTargetPod(c.Context, cfg, k8sClient)
+	if err != nil {
+		return err
+	}
+
+	regs, err := listAgentRegistrations(c.Context, k8sClient, target.Namespace, target.Pod, target.Container, agentStateDir)
+	if err != nil {
+		return err
+	}
+
+	if len(regs) == 0 {
+		fmt.Printf("no forwarder agent running on pod %s\n", target.Pod)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION\tPID\tNAME\tSOURCE\tTARGET\tSTATE\tERROR")
+	for _, reg := range regs {
+		forwarders, err := agentForwarders(c.Context, k8sClient, target, reg)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%d\t\t\t\t%s\t%s\n", reg.Session, reg.Pid, "unknown", err)
+			continue
+		}
+		for _, fwd := range forwarders {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", reg.Session, reg.Pid, fwd.Name, fwd.SourceAddr, fwd.TargetAddr, fwd.State, fwd.Error)
+			if len(fwd.Backends) <= 1 {
+				continue
+			}
+			for _, b := range fwd.Backends {
+				fmt.Fprintf(w, "\t\t\t\t- %s (%d conns)\t%s\t%s\n", b.Addr, b.ActiveConnections, b.State, b.Error)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// agentForwarders returns live forwarders status of a running agent through its api.
+func agentForwarders(ctx context.Context, k8sClient *k8s.ClientConfig, target config.AgentTarget, reg agentapi.Registration) ([]agentapi.Forwarder, error) {
+	ctx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+
+	agentAPI, err := connectAgentAPI(ctx, k8sClient, target.Namespace, target.Pod, reg.APIPort, reg.Token, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := agentAPI.info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return info.Forwarders, nil
+}
+
+// connectForwardAgents connects the api of every agent running on target pod with a forwarder named forward
+// (or with that target address), connections are kept until ctx is done.
+func connectForwardAgents(ctx context.Context, k8sClient *k8s.ClientConfig, target config.AgentTarget, forward string) ([]*agentAPIClient, error) {
+	regs, err := listAgentRegistrations(ctx, k8sClient, target.Namespace, target.Pod, target.Container, agentStateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*agentAPIClient
+	for _, reg := range regs {
+		found := false
+		for _, fwd := range reg.Forwarders {
+			if fwd.Name == forward || (fwd.Name == "" && fwd.TargetAddr == forward) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		agentAPI, err := connectAgentAPI(ctx, k8sClient, target.Namespace, target.Pod, reg.APIPort, reg.Token, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect forwarder agent session %s: %w", reg.Session, err)
+		}
+		result = append(result, agentAPI)
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no forwarder agent running forward %s on pod %s", forward, target.Pod)
+	}
+	return result, nil
+}
+
+// loadTargetConfig reads config file when given, otherwise creates target config from CLI flags.
+func loadTargetConfig(c *cli.Context) (*config.Config, error) {
+	if configFileName := c.String(flagNameConfigFile); configFileName != "" {
+		cfg, err := config.GetConfig(configFileName)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config: %w", err)
+		}
+		return cfg, nil
+	}
+	return createTargetConfigFromFlags(c)
+}
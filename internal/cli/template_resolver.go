@@ -0,0 +1,94 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/abdularis/kportfwd/internal/config"
+	"github.com/abdularis/kportfwd/internal/k8s"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// k8sTemplateResolver looks up cluster resources of address templates with the kube client,
+// in the namespace of the target pod. Services and the pod are fetched once, as templates usually
+// reference several of their fields.
+type k8sTemplateResolver struct {
+	ctx       context.Context
+	k8sClient *k8s.ClientConfig
+	target    config.AgentTarget
+	services  map[string]config.Service
+	pod       *config.PodMetadata
+}
+
+func newK8sTemplateResolver(ctx context.Context, k8sClient *k8s.ClientConfig, target config.AgentTarget) *k8sTemplateResolver {
+	return &k8sTemplateResolver{ctx: ctx, k8sClient: k8sClient, target: target, services: map[string]config.Service{}}
+}
+
+func (r *k8sTemplateResolver) ConfigMapValue(name, key string) (string, error) {
+	return k8s.GetConfigMapKey(r.ctx, r.k8sClient, r.target.Namespace, name, key)
+}
+
+func (r *k8sTemplateResolver) SecretValue(name, key string) (string, error) {
+	value, err := k8s.GetSecretKey(r.ctx, r.k8sClient, r.target.Namespace, name, key)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+func (r *k8sTemplateResolver) Service(name string) (config.Service, error) {
+	if svc, ok := r.services[name]; ok {
+		return svc, nil
+	}
+
+	ns := r.target.Namespace
+	cacheKey := name
+	if namespace, serviceName, ok := strings.Cut(name, "/"); ok {
+		ns, name = namespace, serviceName
+	}
+
+	svc, err := r.k8sClient.Clientset.CoreV1().Services(ns).Get(r.ctx, name, metaV1.GetOptions{})
+	if err != nil {
+		return config.Service{}, fmt.Errorf("unable to get service %s/%s: %w", ns, name, err)
+	}
+
+	result := config.Service{
+		Name:      svc.Name,
+		Namespace: svc.Namespace,
+		ClusterIP: svc.Spec.ClusterIP,
+		DNSName:   fmt.Sprintf("%s.%s.svc", svc.Name, svc.Namespace),
+		Ports:     map[string]int32{},
+	}
+	for _, port := range svc.Spec.Ports {
+		portName := port.Name
+		if portName == "" {
+			portName = strconv.Itoa(int(port.Port))
+		}
+		result.Ports[portName] = port.Port
+	}
+	r.services[cacheKey] = result
+	return result, nil
+}
+
+func (r *k8sTemplateResolver) Pod() (config.PodMetadata, error) {
+	if r.pod != nil {
+		return *r.pod, nil
+	}
+
+	pod, err := r.k8sClient.Clientset.CoreV1().Pods(r.target.Namespace).Get(r.ctx, r.target.Pod, metaV1.GetOptions{})
+	if err != nil {
+		return config.PodMetadata{}, fmt.Errorf("unable to get pod %s: %w", r.target.Pod, err)
+	}
+	r.pod = &config.PodMetadata{
+		Name:        pod.Name,
+		Namespace:   pod.Namespace,
+		IP:          pod.Status.PodIP,
+		NodeName:    pod.Spec.NodeName,
+		Labels:      pod.Labels,
+		Annotations: pod.Annotations,
+	}
+	return *r.pod, nil
+}
@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/config"
+	"github.com/abdularis/kportfwd/internal/localca"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake of local clients on terminateTLS forwards.
+const tlsHandshakeTimeout = time.Second * 10
+
+// terminateTLSConfig returns the server TLS config of a terminateTLS forward, with a certificate valid for
+// the target host as well as the local address so clients can use either.
+func terminateTLSConfig(ca *localca.CA, cfg config.ForwardConfig) (*tls.Config, error) {
+	cert, err := ca.Issue(cfg.TargetAddrParsed.Hostname(), cfg.LocalAddrParsed.Hostname(), "localhost")
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: No ALPN, the agent speaks HTTP/1.1 to the target so clients must not negotiate h2
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// terminateTLS runs the TLS handshake of a local client on a terminateTLS forward.
+func terminateTLS(ctx context.Context, conn net.Conn, tlsConfig *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, tlsConfig)
+	handshakeCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
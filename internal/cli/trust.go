@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/abdularis/kportfwd/internal/localca"
+	"github.com/abdularis/kportfwd/internal/log"
+
+	"github.com/urfave/cli/v2"
+)
+
+var trustCommand = &cli.Command{
+	Name:  "trust",
+	Usage: "Install the local CA used by terminateTLS forwards into the system trust store (runs sudo)",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "uninstall",
+			Usage: "Remove the local CA from the system trust store",
+		},
+		&cli.BoolFlag{
+			Name:  "print",
+			Usage: "Only print the local CA certificate path, e.g. to add it to a browser or language runtime",
+		},
+	},
+	Action: handleActionTrust,
+}
+
+func handleActionTrust(c *cli.Context) error {
+	caDir, err := localca.DefaultDir()
+	if err != nil {
+		return err
+	}
+	ca, err := localca.LoadOrCreate(caDir)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c.Bool("print"):
+		fmt.Println(ca.CertFile())
+		return nil
+	case c.Bool("uninstall"):
+		if err := ca.Uninstall(); err != nil {
+			return fmt.Errorf("unable to uninstall local CA: %w", err)
+		}
+		log.Printf("local CA %s removed from system trust store", ca.CertFile())
+		return nil
+	}
+
+	if err := ca.Install(); err != nil {
+		return fmt.Errorf("unable to install local CA: %w", err)
+	}
+	log.Printf("local CA %s added to system trust store", ca.CertFile())
+	return nil
+}
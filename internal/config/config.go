@@ -12,7 +12,9 @@ import (
 	"regexp"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/abdularis/kportfwd/internal/agentapi"
 	"github.com/abdularis/kportfwd/internal/ping"
 	"gopkg.in/yaml.v3"
 )
@@ -43,14 +45,39 @@ func GetForwarderAgentBin(cfg *Config) (io.Reader, fs.FileInfo, string, error) {
 	return data, fsInfo, string(md5sum), nil
 }
 
+const (
+	// AgentBootstrapCopy copies the forwarder agent binary into the target container and executes it from there.
+	AgentBootstrapCopy = "copy"
+	// AgentBootstrapMemfd streams the forwarder agent binary through stdin into an anonymous memory file
+	// (memfd_create) and executes it from there, nothing is written to the container filesystem.
+	// Useful for hardened pods where no directory is writable or /tmp is mounted noexec.
+	AgentBootstrapMemfd = "memfd"
+)
+
 type Config struct {
 	ForwarderAgentPath string `yaml:"forwarderAgentPath"`
-	Target             struct {
+	// AgentBootstrap selects how the forwarder agent is started on the target pod,
+	// either AgentBootstrapCopy (default) or AgentBootstrapMemfd.
+	AgentBootstrap string `yaml:"agentBootstrap"`
+	Target         struct {
 		Pod *Pod `yaml:"pod"`
 	}
+	// Router shares 127.0.0.1:443 and 127.0.0.1:80 between forwards to port 443 (by TLS SNI) and port 80
+	// (by HTTP Host header) having no localAddr, instead of giving each of them a loopback alias.
+	Router bool `yaml:"router"`
+	// Rootless never requires root: forwards only get 127.0.0.1 local addresses, taking another port when theirs
+	// is used, and neither /etc/hosts nor loopback aliases are changed. Clients use the connection info instead.
+	Rootless bool            `yaml:"rootless"`
 	Forwards []ForwardConfig `yaml:"forwards"`
 }
 
+const (
+	// RouterHTTPSPort is the port of forwards routed by TLS SNI.
+	RouterHTTPSPort = "443"
+	// RouterHTTPPort is the port of forwards routed by HTTP Host header.
+	RouterHTTPPort = "80"
+)
+
 type AgentTarget struct {
 	Namespace string
 	Pod       string
@@ -91,7 +118,7 @@ type ForwardConfig struct {
 
 	// SourceAddr specifies the listener address on the target pod (forwarder agent).
 	// Format: "host:port" or ":port" (e.g., ":50001", "0.0.0.0:8080")
-	// If empty, an available port starting from 50000 will be automatically assigned.
+	// If empty, the forwarder agent listens on a random free port and reports it back to kportfwd.
 	// This is where the forwarder agent listens for incoming connections from LocalAddr.
 	SourceAddr string `yaml:"sourceAddr"`
 
@@ -99,13 +126,247 @@ type ForwardConfig struct {
 	// Format: "host:port" (e.g., "postgres.svc.cluster.local:5432", "redis:6379")
 	// Supports template variables that can be substituted with environment data from the target pod.
 	// Example: "{{.SERVICE_NAME}}.{{.NAMESPACE}}.svc.cluster.local:{{.PORT}}"
+	// Cluster resources can be referenced as well, see TemplateData.
+	// Example: "{{(service "postgres").ClusterIP}}:{{configMap "db" "port"}}"
 	TargetAddr string `yaml:"targetAddr"`
 
+	// TargetAddrs is an ordered list of target addresses, the forwarder agent dials the first healthy one
+	// (balance: failover, default) or spreads connections across healthy targets by weight (balance: roundRobin).
+	// Targets failing health checks are skipped. TargetAddr defaults to the first entry when empty.
+	// Entries support the same template variables as TargetAddr.
+	// Example:
+	//
+	//	targetAddrs:
+	//	  - postgres-primary.svc:5432
+	//	  - addr: postgres-replica.svc:5432
+	//	    weight: 2
+	//	balance: roundRobin
+	TargetAddrs []TargetAddr `yaml:"targetAddrs"`
+
+	// Balance is the strategy used to pick a target: "failover" (default), "roundRobin",
+	// "leastConnections" or "sticky" (same target for a client address).
+	Balance string `yaml:"balance"`
+
+	// ResolveAll resolves every A/AAAA record of the target hosts (e.g. a headless service) on the forwarder agent
+	// and balances connections across all of them, instead of dialing whatever DNS returns first.
+	ResolveAll bool `yaml:"resolveAll"`
+
+	// Ordinal pins the forward to one StatefulSet pod behind a headless service target, e.g. ordinal 2 of
+	// "kafka-headless:9092" with statefulSet "kafka" only connects to kafka-2.kafka-headless. It implies ResolveAll.
+	Ordinal *int `yaml:"ordinal"`
+	// StatefulSet is the name of the StatefulSet of Ordinal, defaults to the service name of TargetAddr.
+	StatefulSet string `yaml:"statefulSet"`
+
+	// HealthCheck defines how the forwarder agent checks TargetAddr, by default it dials the target every 15s
+	// and marks it degraded after 3 consecutive failures. Connections are refused while the target is degraded
+	// and accepted again once it recovers.
+	// Example:
+	//
+	//	healthCheck:
+	//	  mode: http             # tcp (default), http or none
+	//	  path: /healthz         # GET path on http mode
+	//	  interval: 10s
+	//	  timeout: 2s
+	//	  failureThreshold: 3
+	HealthCheck agentapi.HealthCheck `yaml:"healthCheck"`
+
+	// MaxConnections limits concurrent connections on the forwarder agent, further connections are refused.
+	MaxConnections int `yaml:"maxConnections"`
+	// IdleTimeout closes connections without traffic in either direction for that long (e.g. "5m").
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	// MaxConnectionLifetime closes connections open for that long, regardless of traffic.
+	MaxConnectionLifetime time.Duration `yaml:"maxConnectionLifetime"`
+	// DrainTimeout is how long active connections are given to finish when the forwarder agent
+	// shuts down before being closed, defaults to 5s.
+	DrainTimeout time.Duration `yaml:"drainTimeout"`
+
+	// Inspect parses HTTP/1.1 traffic of an http:// TargetAddr on the forwarder agent, logs method, path, status,
+	// latency and sizes of every exchange and keeps recent ones for `kportfwd inspect`.
+	Inspect bool `yaml:"inspect"`
+
+	// RewriteHost, AddHeaders and StripPathPrefix rewrite requests to an http:// TargetAddr on the forwarder agent,
+	// so that plain localhost URLs work against ingresses and virtual-host based services.
+	// Example:
+	//
+	//	targetAddr: http://ingress-nginx-controller.ingress-nginx:80
+	//	rewriteHost: shop.example.com    # Host header sent instead of 127.0.0.1:80
+	//	addHeaders:
+	//	  X-Forwarded-Proto: https
+	//	stripPathPrefix: /shop           # /shop/cart is sent as /cart
+	RewriteHost     string            `yaml:"rewriteHost"`
+	AddHeaders      map[string]string `yaml:"addHeaders"`
+	StripPathPrefix string            `yaml:"stripPathPrefix"`
+
+	// OriginateTLS makes the forwarder agent connect to TargetAddr over TLS while local clients keep connecting
+	// to LocalAddr in plaintext. SNI is the TargetAddr host unless serverName is set, the target certificate is
+	// verified against system roots or a CA bundle read from the target container or a Secret, and a client
+	// certificate can be presented for mTLS. `originateTLS: true` enables it with defaults.
+	// Example:
+	//
+	//	originateTLS:
+	//	  caFile: /etc/ssl/certs/internal-ca.pem    # path in the target container
+	//	  caSecret: {name: internal-ca, key: ca.crt} # or a Secret in the target namespace
+	//	  certSecret: {name: db-client, key: tls.crt}
+	//	  keySecret: {name: db-client, key: tls.key}
+	OriginateTLS *OriginateTLS `yaml:"originateTLS"`
+
+	// TerminateTLS makes kportfwd accept TLS on LocalAddr with a certificate for the TargetAddr host issued by
+	// its local CA (see `kportfwd trust`), the decrypted traffic is encrypted again toward the target by the
+	// forwarder agent, with originateTLS defaults unless originateTLS is set.
+	TerminateTLS bool `yaml:"terminateTLS"`
+
+	// Shaping degrades traffic on the forwarder agent to test against a slow or flaky target,
+	// it can be changed at runtime with `kportfwd shape`.
+	// Example:
+	//
+	//	shaping:
+	//	  bandwidthBytesPerSec: 65536  # each direction
+	//	  latency: 200ms
+	//	  jitter: 50ms
+	//	  resetProbability: 0.01       # per forwarded chunk of data
+	Shaping agentapi.Shaping `yaml:"shaping"`
+
 	// Parsed URL representations of the address fields (computed at runtime)
 	// These fields are populated during configuration processing and excluded from YAML serialization.
 	LocalAddrParsed  *url.URL `yaml:"-"`
 	SourceAddrParsed *url.URL `yaml:"-"`
 	TargetAddrParsed *url.URL `yaml:"-"`
+
+	// TargetAddrTemplate is TargetAddr as configured, before template variables are rendered.
+	TargetAddrTemplate string `yaml:"-"`
+	// SecretValues are the values of Secrets rendered into TargetAddr and TargetAddrs, see Redact.
+	SecretValues []string `yaml:"-"`
+
+	// Routed is set when the forward is reached through the router listening on LocalAddr.
+	Routed bool `yaml:"-"`
+}
+
+// TargetAddr is one of the forward target addresses, written either as a plain address
+// or as a mapping with addr and weight.
+type TargetAddr struct {
+	Addr   string `yaml:"addr"`
+	Weight int    `yaml:"weight"`
+}
+
+func (t *TargetAddr) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&t.Addr)
+	}
+
+	type targetAddr TargetAddr
+	return value.Decode((*targetAddr)(t))
+}
+
+// OriginateTLS configures TLS between the forwarder agent and targets.
+type OriginateTLS struct {
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+
+	// CA bundle and client certificate as paths in the target container.
+	CAFile   string `yaml:"caFile"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+
+	// CA bundle and client certificate from Secrets in the target namespace.
+	CASecret   *SecretKeyRef `yaml:"caSecret"`
+	CertSecret *SecretKeyRef `yaml:"certSecret"`
+	KeySecret  *SecretKeyRef `yaml:"keySecret"`
+
+	// PEM data read from the Secrets above (computed at runtime).
+	CAData   []byte `yaml:"-"`
+	CertData []byte `yaml:"-"`
+	KeyData  []byte `yaml:"-"`
+}
+
+func (t *OriginateTLS) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var enabled bool
+		if err := value.Decode(&enabled); err != nil {
+			return err
+		}
+		if !enabled {
+			return fmt.Errorf("originateTLS: false is not supported, remove the option instead")
+		}
+		return nil
+	}
+
+	type originateTLS OriginateTLS
+	return value.Decode((*originateTLS)(t))
+}
+
+// SecretKeyRef selects a key of a Secret.
+type SecretKeyRef struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+}
+
+// AgentSpec returns the forward spec passed to the forwarder agent.
+func (f *ForwardConfig) AgentSpec() agentapi.ForwardSpec {
+	spec := agentapi.ForwardSpec{
+		Name:        f.Name,
+		SourceAddr:  f.SourceAddr,
+		TargetAddr:  f.TargetAddr,
+		Balance:     f.Balance,
+		ResolveAll:  f.ResolveAll,
+		Ordinal:     f.Ordinal,
+		StatefulSet: f.StatefulSet,
+		HealthCheck: f.HealthCheck,
+		// NOTE: Sticky balance needs the local client address, kportfwd sends it ahead of every connection
+		ProxyProtocol: f.Balance == agentapi.BalanceSticky,
+
+		MaxConnections:        f.MaxConnections,
+		IdleTimeout:           f.IdleTimeout,
+		MaxConnectionLifetime: f.MaxConnectionLifetime,
+		DrainTimeout:          f.DrainTimeout,
+		Shaping:               f.Shaping,
+		SecretValues:          f.SecretValues,
+	}
+	httpOptions := agentapi.HTTPOptions{
+		Inspect:         f.Inspect,
+		RewriteHost:     f.RewriteHost,
+		AddHeaders:      f.AddHeaders,
+		StripPathPrefix: f.StripPathPrefix,
+	}
+	if httpOptions.Inspect || httpOptions.Rewrite() {
+		spec.HTTP = &httpOptions
+	}
+	if f.OriginateTLS != nil {
+		spec.OriginateTLS = &agentapi.OriginateTLS{
+			ServerName:         f.OriginateTLS.ServerName,
+			InsecureSkipVerify: f.OriginateTLS.InsecureSkipVerify,
+			CAFile:             f.OriginateTLS.CAFile,
+			CAData:             f.OriginateTLS.CAData,
+			CertFile:           f.OriginateTLS.CertFile,
+			KeyFile:            f.OriginateTLS.KeyFile,
+			CertData:           f.OriginateTLS.CertData,
+			KeyData:            f.OriginateTLS.KeyData,
+		}
+	}
+	if f.TerminateTLS && spec.OriginateTLS == nil {
+		spec.OriginateTLS = &agentapi.OriginateTLS{}
+	}
+	for _, target := range f.TargetAddrs {
+		spec.Targets = append(spec.Targets, agentapi.Target{Addr: target.Addr, Weight: target.Weight})
+	}
+	return spec
+}
+
+// Redact returns s with the values of Secrets rendered into the target addresses replaced,
+// used wherever target addresses are logged or shown.
+func (f *ForwardConfig) Redact(s string) string {
+	return agentapi.RedactSecrets(s, f.SecretValues)
+}
+
+// SetSourceAddr sets SourceAddr and its parsed representation.
+func (f *ForwardConfig) SetSourceAddr(sourceAddr string) error {
+	sourceAddrParsed, err := parseURL(sourceAddr)
+	if err != nil {
+		return fmt.Errorf("failed to parse source addr %s: %s", sourceAddr, err)
+	}
+
+	f.SourceAddr = sourceAddr
+	f.SourceAddrParsed = sourceAddrParsed
+	return nil
 }
 
 func GetConfig(filepath string) (*Config, error) {
@@ -122,60 +383,127 @@ func GetConfig(filepath string) (*Config, error) {
 	return &cfg, nil
 }
 
-func ParseConfigAddresses(cfg *Config, data map[string]string) error {
-	currentLocalIP := "10.0.0.10" // starting IP address to assign for localAddr if not specified
+// ParseConfigAddresses renders and parses forward addresses of cfg with environment variables of the target pod.
+func ParseConfigAddresses(cfg *Config, envvars map[string]string) error {
+	return ParseConfigAddressesWithData(cfg, NewTemplateData(envvars, nil))
+}
+
+// localAliasNetworks are the networks of local addresses aliased to the loopback interface: the loopback range,
+// and the 10.0.0.x pool local addresses are allocated from when the port is taken on 127.0.0.1.
+var (
+	localAliasPool     = &net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(24, 32)}
+	localAliasNetworks = []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}, localAliasPool}
+)
+
+// ValidateLocalAliasIP returns an error when ipAddr is outside of 127.0.0.0/8 and 10.0.0.0/24,
+// the only addresses aliased to the loopback interface.
+func ValidateLocalAliasIP(ipAddr string) error {
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return fmt.Errorf("invalid ip address: %q", ipAddr)
+	}
+	for _, network := range localAliasNetworks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("ip address %s is outside of 127.0.0.0/8 and 10.0.0.0/24", ipAddr)
+}
+
+// validateLocalAddr returns an error when localAddr would need a loopback alias outside of the alias networks.
+func validateLocalAddr(localAddr string) error {
+	ur, err := parseURL(localAddr)
+	if err != nil {
+		return fmt.Errorf("failed to parse local addr %s: %s", localAddr, err)
+	}
+	switch ur.Hostname() {
+	case "", "localhost":
+		return nil
+	}
+	if err := ValidateLocalAliasIP(ur.Hostname()); err != nil {
+		return fmt.Errorf("local addr %s can't be aliased to the loopback interface: %w", localAddr, err)
+	}
+	return nil
+}
+
+// ParseConfigAddressesWithData renders and parses forward addresses of cfg with template data, assigning
+// local and source addresses when not set.
+func ParseConfigAddressesWithData(cfg *Config, data TemplateData) error {
+	currentLocalIP := "10.0.0.10" // starting IP address to assign for localAddr if not specified, up to 10.0.0.254
 	takenLocalIPs := map[string]struct{}{}
 	usedLocalPorts := map[string]struct{}{}
+	routes := map[string]struct{}{}
 
-	sourceAddrPort := 50000
+	if cfg.Rootless && cfg.Router {
+		return fmt.Errorf("router is not supported in rootless mode, it relies on /etc/hosts")
+	}
 
 	for idx, fwdConfig := range cfg.Forwards {
 		// 1. Process from TargetAddr, give access to env data from target pod to render the address template given from config
+		if fwdConfig.TargetAddr == "" && len(fwdConfig.TargetAddrs) > 0 {
+			fwdConfig.TargetAddr = fwdConfig.TargetAddrs[0].Addr
+		}
 		if fwdConfig.TargetAddr == "" {
 			continue
 		}
 
-		// process config template, parses config string and substitute with env data from target pod
-		tmplt, err := template.New(fmt.Sprintf("%s_%d", fwdConfig.Name, idx)).
-			Funcs(template.FuncMap{
-				"splitAt": func(s string, sep string, index int) string {
-					parts := strings.Split(s, sep)
-					if index >= len(parts) || index < 0 {
-						return ""
-					}
-					return parts[index]
-				},
-			}).
-			Parse(fwdConfig.TargetAddr)
-		if err != nil {
-			return err
+		if err := fwdConfig.AgentSpec().Validate(); err != nil {
+			return fmt.Errorf("forward %s: %w", fwdConfig.TargetAddr, err)
 		}
-		tmplt.Option("missingkey=error")
 
-		output := bytes.NewBufferString("")
-		if err := tmplt.Execute(output, data); err != nil {
+		// process config template, parses config string and substitute with env data from target pod
+		var secretValues []string
+		fwdData := data.withSecretValues(&secretValues)
+		ur, err := renderAddr(fmt.Sprintf("%s_%d", fwdConfig.Name, idx), fwdConfig.TargetAddr, fwdData)
+		if err != nil {
 			return err
 		}
 
-		addr := output.String()
-		ur, err := parseURL(addr)
-		if err != nil {
-			return fmt.Errorf("failed to parse addr %s: %s", addr, err)
+		// NOTE: With originateTLS the agent sees https traffic in plaintext, so it can be inspected as well
+		if spec := fwdConfig.AgentSpec(); spec.HTTP != nil && ur.Scheme != "http" && (ur.Scheme != "https" || spec.OriginateTLS == nil) {
+			return fmt.Errorf("forward %s: inspect and http rewriting require an http:// target address, or https:// with originateTLS", fwdConfig.TargetAddr)
 		}
 
-		if ur.Port() == "" {
-			if port, ok := knownPortByScheme[ur.Scheme]; ok {
-				ur.Host += ":" + port
-			} else {
-				return fmt.Errorf("no port specified for addr: %s", addr)
+		for targetIdx, target := range fwdConfig.TargetAddrs {
+			targetURL, err := renderAddr(fmt.Sprintf("%s_%d_%d", fwdConfig.Name, idx, targetIdx), target.Addr, fwdData)
+			if err != nil {
+				return err
 			}
+			cfg.Forwards[idx].TargetAddrs[targetIdx].Addr = targetURL.Host
 		}
 
+		cfg.Forwards[idx].TargetAddrTemplate = fwdConfig.TargetAddr
+		cfg.Forwards[idx].SecretValues = secretValues
 		cfg.Forwards[idx].TargetAddr = ur.Host
 		cfg.Forwards[idx].TargetAddrParsed = ur
 
 		// 2. If LocalAddr is empty, set it to the same as SourceAddr
 		localAddrListener := fwdConfig.LocalAddr
+		if cfg.Router && localAddrListener == "" && (ur.Port() == RouterHTTPSPort || ur.Port() == RouterHTTPPort) {
+			route := net.JoinHostPort(ur.Hostname(), ur.Port())
+			if _, routed := routes[route]; routed {
+				return fmt.Errorf("forward %s: %s is already routed by another forward", fwdConfig.TargetAddr, route)
+			}
+			routes[route] = struct{}{}
+			localAddrListener = "127.0.0.1:" + ur.Port()
+			cfg.Forwards[idx].Routed = true
+		}
+		if cfg.Rootless && localAddrListener != "" {
+			if err := validateRootlessLocalAddr(localAddrListener); err != nil {
+				return fmt.Errorf("forward %s: %w", fwdConfig.TargetAddr, err)
+			}
+		}
+		if !cfg.Rootless && localAddrListener != "" {
+			if err := validateLocalAddr(localAddrListener); err != nil {
+				return fmt.Errorf("forward %s: %w", fwdConfig.TargetAddr, err)
+			}
+		}
+		if cfg.Rootless && localAddrListener == "" {
+			localAddrListener, err = rootlessLocalAddr(ur.Port(), usedLocalPorts)
+			if err != nil {
+				return fmt.Errorf("forward %s: %w", fwdConfig.TargetAddr, err)
+			}
+		}
 		if localAddrListener == "" {
 			for {
 				// prefer to use localhost if the port is available
@@ -195,9 +523,9 @@ func ParseConfigAddresses(cfg *Config, data map[string]string) error {
 				}
 
 				// increment to next ip address
-				currentLocalIP, err = nextIPAddress(currentLocalIP)
+				currentLocalIP, err = nextLocalAliasIP(currentLocalIP)
 				if err != nil {
-					return fmt.Errorf("failed to get next ip address: %w", err)
+					return fmt.Errorf("forward %s: %w", fwdConfig.TargetAddr, err)
 				}
 			}
 		}
@@ -210,25 +538,66 @@ func ParseConfigAddresses(cfg *Config, data map[string]string) error {
 		cfg.Forwards[idx].LocalAddrParsed = localAddrParsed
 		cfg.Forwards[idx].LocalAddr = localAddrListener
 
-		// 3. If SourceAddr is empty, assign an available port starting from 50000
+		// 3. If SourceAddr is empty, let the forwarder agent pick a free port, the actual port
+		// is reported back through agent api once it's running
 		sourceAddr := fwdConfig.SourceAddr
 		if sourceAddr == "" {
-			sourceAddr = fmt.Sprintf(":%d", sourceAddrPort)
-			sourceAddrPort++
+			sourceAddr = ":0"
 		}
 
-		sourceAddrParsed, err := parseURL(sourceAddr)
-		if err != nil {
-			return fmt.Errorf("failed to parse source addr %s: %s", sourceAddr, err)
+		if err := cfg.Forwards[idx].SetSourceAddr(sourceAddr); err != nil {
+			return err
 		}
-
-		cfg.Forwards[idx].SourceAddr = sourceAddr
-		cfg.Forwards[idx].SourceAddrParsed = sourceAddrParsed
 	}
 
 	return nil
 }
 
+var addrTemplateFuncs = template.FuncMap{
+	"splitAt": func(s string, sep string, index int) string {
+		parts := strings.Split(s, sep)
+		if index >= len(parts) || index < 0 {
+			return ""
+		}
+		return parts[index]
+	},
+}
+
+// newAddrTemplate returns an address template having the functions of data.
+func newAddrTemplate(name string, data TemplateData) *template.Template {
+	return template.New(name).Funcs(addrTemplateFuncs).Funcs(data.funcs())
+}
+
+// renderAddr renders address template with env data from target pod and parses it,
+// known scheme ports are added when the address has no port.
+func renderAddr(name, addrTemplate string, data TemplateData) (*url.URL, error) {
+	tmplt, err := newAddrTemplate(name, data).Parse(addrTemplate)
+	if err != nil {
+		return nil, err
+	}
+	tmplt.Option("missingkey=error")
+
+	output := bytes.NewBufferString("")
+	if err := tmplt.Execute(output, data.Env); err != nil {
+		return nil, err
+	}
+
+	addr := output.String()
+	ur, err := parseURL(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse addr %s: %s", addr, err)
+	}
+
+	if ur.Port() == "" {
+		if port, ok := knownPortByScheme[ur.Scheme]; ok {
+			ur.Host += ":" + port
+		} else {
+			return nil, fmt.Errorf("no port specified for addr: %s", addr)
+		}
+	}
+	return ur, nil
+}
+
 var knownPortByScheme = map[string]string{
 	"https": "443",
 	"http":  "80",
@@ -236,6 +605,43 @@ var knownPortByScheme = map[string]string{
 
 var networkSchemeRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+\-.]*:\/\/`)
 
+// rootlessLocalAddr returns 127.0.0.1 with port when it's neither used by another forward nor taken locally,
+// otherwise with a free port.
+func rootlessLocalAddr(port string, usedLocalPorts map[string]struct{}) (string, error) {
+	if _, used := usedLocalPorts[port]; !used {
+		if listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port)); err == nil {
+			_ = listener.Close()
+			return net.JoinHostPort("127.0.0.1", port), nil
+		}
+	}
+
+	for {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", fmt.Errorf("unable to find free local port: %w", err)
+		}
+		addr := listener.Addr().String()
+		_ = listener.Close()
+		_, freePort, _ := net.SplitHostPort(addr)
+		if _, used := usedLocalPorts[freePort]; !used {
+			return addr, nil
+		}
+	}
+}
+
+// validateRootlessLocalAddr returns an error when localAddr would need a loopback alias.
+func validateRootlessLocalAddr(localAddr string) error {
+	ur, err := parseURL(localAddr)
+	if err != nil {
+		return fmt.Errorf("failed to parse local addr %s: %s", localAddr, err)
+	}
+	switch ur.Hostname() {
+	case "", "127.0.0.1", "localhost":
+		return nil
+	}
+	return fmt.Errorf("local addr %s requires a loopback alias, only 127.0.0.1 is supported in rootless mode", localAddr)
+}
+
 func parseURL(rawURL string) (*url.URL, error) {
 	if !networkSchemeRegex.MatchString(rawURL) {
 		// no url scheme, add default tcp, so that parsing url will be correct
@@ -249,6 +655,18 @@ func parseURL(rawURL string) (*url.URL, error) {
 	return u, nil
 }
 
+// nextLocalAliasIP returns the address following ipAddr in the 10.0.0.x pool, an error once the pool is exhausted.
+func nextLocalAliasIP(ipAddr string) (string, error) {
+	next, err := nextIPAddress(ipAddr)
+	if err != nil {
+		return "", fmt.Errorf("failed to get next ip address: %w", err)
+	}
+	if !localAliasPool.Contains(net.ParseIP(next)) {
+		return "", fmt.Errorf("local address pool 10.0.0.10-10.0.0.254 exhausted, set localAddr of forwards")
+	}
+	return next, nil
+}
+
 func nextIPAddress(ipAddr string) (string, error) {
 	ip := net.ParseIP(ipAddr)
 	if ip == nil {
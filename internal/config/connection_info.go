@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// ConnectionInfoEnv prints connection info as shell exports, e.g. `eval "$(kportfwd ...)"`.
+	ConnectionInfoEnv = "env"
+	// ConnectionInfoDotenv prints connection info as a .env file.
+	ConnectionInfoDotenv = "dotenv"
+	// ConnectionInfoSSHConfig prints connection info as ~/.ssh/config style Host entries mapping target hosts to local addresses.
+	ConnectionInfoSSHConfig = "ssh-config"
+)
+
+// ConnectionInfo is how local clients reach a forward, used when target hosts don't resolve to the forward
+// (rootless mode) or its local port differs from the target port.
+type ConnectionInfo struct {
+	// EnvPrefix prefixes the forward variables, it's the forward name (or target host) in upper snake case.
+	EnvPrefix  string
+	Name       string
+	TargetHost string
+	TargetPort string
+	Host       string
+	Port       string
+}
+
+// GetConnectionInfo returns connection info of forwards with parsed addresses.
+func GetConnectionInfo(forwards []ForwardConfig) []ConnectionInfo {
+	var result []ConnectionInfo
+	for _, fwd := range forwards {
+		if fwd.LocalAddrParsed == nil || fwd.TargetAddrParsed == nil {
+			continue
+		}
+
+		name := fwd.Name
+		if name == "" {
+			name = fwd.TargetAddrParsed.Hostname()
+		}
+		result = append(result, ConnectionInfo{
+			EnvPrefix:  envName(name),
+			Name:       name,
+			TargetHost: fwd.TargetAddrParsed.Hostname(),
+			TargetPort: fwd.TargetAddrParsed.Port(),
+			Host:       localHost(fwd),
+			Port:       fwd.LocalAddrParsed.Port(),
+		})
+	}
+	return result
+}
+
+// WriteConnectionInfo writes connection info of forwards to w in format.
+func WriteConnectionInfo(w io.Writer, format string, forwards []ForwardConfig) error {
+	infos := GetConnectionInfo(forwards)
+
+	switch format {
+	case ConnectionInfoEnv, ConnectionInfoDotenv:
+		prefix := ""
+		if format == ConnectionInfoEnv {
+			prefix = "export "
+		}
+		for _, info := range infos {
+			if _, err := fmt.Fprintf(w, "# %s -> %s:%s\n%s%s_HOST=%s\n%s%s_PORT=%s\n%s%s_ADDR=%s:%s\n",
+				info.Name, info.TargetHost, info.TargetPort,
+				prefix, info.EnvPrefix, info.Host,
+				prefix, info.EnvPrefix, info.Port,
+				prefix, info.EnvPrefix, info.Host, info.Port); err != nil {
+				return err
+			}
+		}
+	case ConnectionInfoSSHConfig:
+		for _, info := range infos {
+			if _, err := fmt.Fprintf(w, "# %s -> %s:%s\nHost %s\n    HostName %s\n    Port %s\n\n",
+				info.Name, info.TargetHost, info.TargetPort, info.TargetHost, info.Host, info.Port); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown connection info format: %s (expected '%s', '%s' or '%s')", format, ConnectionInfoEnv, ConnectionInfoDotenv, ConnectionInfoSSHConfig)
+	}
+	return nil
+}
+
+// envName converts name to an upper snake case environment variable name.
+func envName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(name) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	result := b.String()
+	if result == "" || (result[0] >= '0' && result[0] <= '9') {
+		result = "_" + result
+	}
+	return result
+}
+
+// localHost returns the host local clients connect to for fwd.
+func localHost(fwd ForwardConfig) string {
+	host := fwd.LocalAddrParsed.Hostname()
+	if host == "" || host == "localhost" {
+		host = "127.0.0.1"
+	}
+	return host
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"text/template/parse"
+)
+
+// RewriteEnv returns envvars of the target pod with values pointing at a forward target rewritten to the forward
+// local address, so that they work from the local machine. Variables used in a forward TargetAddr template, and
+// variables whose value is a forwarded host, host:port or URL are rewritten, URLs keep their scheme, credentials,
+// path and query. Forwards must have parsed addresses (see ParseConfigAddresses).
+func RewriteEnv(forwards []ForwardConfig, envvars map[string]string) map[string]string {
+	var locals []localForward
+	templateVars := map[string]localForward{}
+	for _, fwd := range forwards {
+		if fwd.LocalAddrParsed == nil || fwd.TargetAddrParsed == nil {
+			continue
+		}
+		local := localForward{
+			targetHost: fwd.TargetAddrParsed.Hostname(),
+			targetPort: fwd.TargetAddrParsed.Port(),
+			host:       localHost(fwd),
+			port:       fwd.LocalAddrParsed.Port(),
+		}
+		locals = append(locals, local)
+		for _, name := range templateFields(fwd.TargetAddrTemplate) {
+			if _, ok := templateVars[name]; !ok {
+				templateVars[name] = local
+			}
+		}
+	}
+
+	result := make(map[string]string, len(envvars))
+	for name, value := range envvars {
+		result[name] = value
+
+		if local, ok := templateVars[name]; ok {
+			if rewritten, ok := local.rewrite(value, true); ok {
+				result[name] = rewritten
+				continue
+			}
+		}
+		for _, local := range locals {
+			if rewritten, ok := local.rewrite(value, false); ok {
+				result[name] = rewritten
+				break
+			}
+		}
+	}
+	return result
+}
+
+// localForward is a forward target address and the local address it's reached on.
+type localForward struct {
+	targetHost string
+	targetPort string
+	host       string
+	port       string
+}
+
+// rewrite returns value pointing at the local address when it's the target host, host:port or a URL to it.
+// A bare port is only rewritten when matchPort is set, as any number may look like one.
+func (l localForward) rewrite(value string, matchPort bool) (string, bool) {
+	if matchPort && value == l.targetPort {
+		return l.port, true
+	}
+	if strings.EqualFold(value, l.targetHost) {
+		return l.host, true
+	}
+	if host, port, err := net.SplitHostPort(value); err == nil {
+		if strings.EqualFold(host, l.targetHost) && port == l.targetPort {
+			return net.JoinHostPort(l.host, l.port), true
+		}
+		return "", false
+	}
+
+	if !networkSchemeRegex.MatchString(value) {
+		return "", false
+	}
+	ur, err := url.Parse(value)
+	if err != nil || !strings.EqualFold(ur.Hostname(), l.targetHost) {
+		return "", false
+	}
+	port := ur.Port()
+	if port == "" {
+		port = knownPortByScheme[ur.Scheme]
+	}
+	if port != l.targetPort {
+		return "", false
+	}
+	ur.Host = net.JoinHostPort(l.host, l.port)
+	return ur.String(), true
+}
+
+// templateFields returns names of the fields referenced by addrTemplate, e.g. POSTGRES_HOST of {{.POSTGRES_HOST}}.
+func templateFields(addrTemplate string) []string {
+	if addrTemplate == "" {
+		return nil
+	}
+	tmplt, err := newAddrTemplate("", TemplateData{}).Parse(addrTemplate)
+	if err != nil || tmplt.Tree == nil {
+		return nil
+	}
+
+	var fields []string
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, child := range n.Nodes {
+				walk(child)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, cmd := range n.Cmds {
+				walk(cmd)
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.FieldNode:
+			fields = append(fields, n.Ident[0])
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		}
+	}
+	walk(tmplt.Tree.Root)
+	return fields
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"text/template"
+)
+
+// TemplateResolver looks up cluster resources referenced by address templates, in the target pod namespace.
+type TemplateResolver interface {
+	ConfigMapValue(name, key string) (string, error)
+	SecretValue(name, key string) (string, error)
+	Service(name string) (Service, error)
+	Pod() (PodMetadata, error)
+}
+
+// Service is a Kubernetes Service as seen by address templates.
+// Example: "{{(service "postgres").ClusterIP}}:{{(service "postgres").Ports.sql}}"
+type Service struct {
+	Name      string
+	Namespace string
+	// ClusterIP is "None" for headless services.
+	ClusterIP string
+	// DNSName is the cluster DNS name, e.g. postgres.default.svc
+	DNSName string
+	// Ports are service ports by name, an unnamed single port is named after its number.
+	Ports map[string]int32
+}
+
+// PodMetadata is the target pod as seen by address templates.
+// Example: "{{(pod).Labels.release}}-postgres:5432"
+type PodMetadata struct {
+	Name        string
+	Namespace   string
+	IP          string
+	NodeName    string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// TemplateData is the data of address templates: environment variables of the target pod, referenced by name
+// as in {{.POSTGRES_HOST}}, and a resolver of cluster resources looked up with template functions:
+// {{configMap "name" "key"}}, {{secret "name" "key"}}, {{(service "name").ClusterIP}} or {{(pod).Name}}.
+// Functions never shadow variables.
+type TemplateData struct {
+	Env map[string]string
+	// Resolver is nil when cluster resources are not available, the functions fail then.
+	Resolver TemplateResolver
+
+	// secretValues collects values rendered by the secret function, so that they can be redacted.
+	secretValues *[]string
+}
+
+// NewTemplateData returns template data of envvars, resource lookups fail when resolver is nil.
+func NewTemplateData(envvars map[string]string, resolver TemplateResolver) TemplateData {
+	return TemplateData{Env: envvars, Resolver: resolver}
+}
+
+// withSecretValues returns a copy of d appending values rendered by the secret function to secretValues.
+func (d TemplateData) withSecretValues(secretValues *[]string) TemplateData {
+	d.secretValues = secretValues
+	return d
+}
+
+// funcs returns template functions looking up cluster resources with the resolver of d.
+func (d TemplateData) funcs() template.FuncMap {
+	return template.FuncMap{
+		// configMap returns key of ConfigMap name.
+		"configMap": func(name, key string) (string, error) {
+			resolver, err := d.resolver()
+			if err != nil {
+				return "", err
+			}
+			return resolver.ConfigMapValue(name, key)
+		},
+		// secret returns key of Secret name, the value is redacted wherever the rendered address is shown.
+		"secret": func(name, key string) (string, error) {
+			resolver, err := d.resolver()
+			if err != nil {
+				return "", err
+			}
+			value, err := resolver.SecretValue(name, key)
+			if err != nil {
+				return "", err
+			}
+			if d.secretValues != nil {
+				*d.secretValues = append(*d.secretValues, value)
+			}
+			return value, nil
+		},
+		// service returns Service name, given as "name" or "namespace/name".
+		"service": func(name string) (Service, error) {
+			resolver, err := d.resolver()
+			if err != nil {
+				return Service{}, err
+			}
+			return resolver.Service(name)
+		},
+		// pod returns metadata of the target pod.
+		"pod": func() (PodMetadata, error) {
+			resolver, err := d.resolver()
+			if err != nil {
+				return PodMetadata{}, err
+			}
+			return resolver.Pod()
+		},
+	}
+}
+
+func (d TemplateData) resolver() (TemplateResolver, error) {
+	if d.Resolver == nil {
+		return nil, fmt.Errorf("cluster resources are not available to templates")
+	}
+	return d.Resolver, nil
+}
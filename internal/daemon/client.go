@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client calls the control server of a background session.
+type Client struct {
+	client http.Client
+}
+
+// NewClient returns a client of the session listening on socket.
+func NewClient(socket string) *Client {
+	return &Client{
+		client: http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Session returns the current state of the session.
+func (c *Client) Session(ctx context.Context) (Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	resp, err := c.do(ctx, http.MethodGet, "/session")
+	if err != nil {
+		return Session{}, err
+	}
+	defer resp.Body.Close()
+
+	var session Session
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return Session{}, fmt.Errorf("invalid session response: %w", err)
+	}
+	return session, nil
+}
+
+// Shutdown asks the session to stop, it returns before the session process exited.
+func (c *Client) Shutdown(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	resp, err := c.do(ctx, http.MethodPost, "/shutdown")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Logs writes the session log to w, when follow is true it keeps writing new lines until ctx is done or the session stops.
+func (c *Client) Logs(ctx context.Context, follow bool, w io.Writer) error {
+	path := "/logs"
+	if follow {
+		path += "?follow=true"
+	}
+	resp, err := c.do(ctx, http.MethodGet, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(w, resp.Body); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://session"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s %s: %s", method, path, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
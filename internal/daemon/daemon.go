@@ -0,0 +1,164 @@
+// Package daemon keeps track of kportfwd sessions running in the background (`kportfwd up -d`).
+// Every session has a state file, a pidfile, a log file and a control unix socket in the state dir,
+// `kportfwd ls`, `down` and `logs` talk to the session through its socket.
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Session describes a background kportfwd session.
+type Session struct {
+	ID         string    `json:"id"`
+	PID        int       `json:"pid"`
+	ConfigFile string    `json:"configFile,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	// State is SessionStateStarting until forwards are set up, then SessionStateRunning.
+	State    string    `json:"state"`
+	Target   string    `json:"target,omitempty"`
+	Forwards []Forward `json:"forwards,omitempty"`
+}
+
+const (
+	SessionStateStarting = "starting"
+	SessionStateRunning  = "running"
+	// SessionStateDead is reported by List for sessions whose process is gone, their files are removed.
+	SessionStateDead = "dead"
+)
+
+// Forward is a forward of a session.
+type Forward struct {
+	Name       string `json:"name,omitempty"`
+	LocalAddr  string `json:"localAddr"`
+	TargetAddr string `json:"targetAddr"`
+}
+
+var sessionIDRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// ValidateSessionID returns an error when id can't be used as a session id.
+func ValidateSessionID(id string) error {
+	if len(id) > 64 || !sessionIDRegex.MatchString(id) {
+		return fmt.Errorf("invalid session name %q, use letters, digits, '.', '_' and '-'", id)
+	}
+	return nil
+}
+
+// Dir returns the state dir of background sessions of the current user.
+func Dir() (string, error) {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, "kportfwd"), nil
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "kportfwd", "sessions"), nil
+}
+
+// Paths are the files of a session in the state dir.
+type Paths struct {
+	State  string
+	PID    string
+	Socket string
+	Log    string
+}
+
+// SessionPaths returns the files of session id in dir.
+func SessionPaths(dir, id string) Paths {
+	return Paths{
+		State:  filepath.Join(dir, id+".json"),
+		PID:    filepath.Join(dir, id+".pid"),
+		Socket: filepath.Join(dir, id+".sock"),
+		Log:    filepath.Join(dir, id+".log"),
+	}
+}
+
+// WriteSession writes the state file and pidfile of session into dir.
+func WriteSession(dir string, session Session) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to create session dir: %w", err)
+	}
+	paths := SessionPaths(dir, session.ID)
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	// NOTE: Written to a temporary file first so readers never see a partial state
+	tmpFile := paths.State + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
+		return fmt.Errorf("unable to write session state: %w", err)
+	}
+	if err := os.Rename(tmpFile, paths.State); err != nil {
+		return fmt.Errorf("unable to write session state: %w", err)
+	}
+	if err := os.WriteFile(paths.PID, []byte(strconv.Itoa(session.PID)+"\n"), 0600); err != nil {
+		return fmt.Errorf("unable to write pidfile: %w", err)
+	}
+	return nil
+}
+
+// RemoveSession removes state file, pidfile and socket of session id, the log file is kept
+// for `kportfwd logs` until the session id is reused.
+func RemoveSession(dir, id string) {
+	paths := SessionPaths(dir, id)
+	_ = os.Remove(paths.State)
+	_ = os.Remove(paths.PID)
+	_ = os.Remove(paths.Socket)
+}
+
+// ReadSession reads the state file of session id.
+func ReadSession(dir, id string) (Session, error) {
+	data, err := os.ReadFile(SessionPaths(dir, id).State)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Session{}, fmt.Errorf("session %s not found", id)
+		}
+		return Session{}, err
+	}
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return Session{}, fmt.Errorf("invalid session state %s: %w", id, err)
+	}
+	return session, nil
+}
+
+// List returns sessions in dir sorted by id, sessions whose process is gone are reported
+// as SessionStateDead and their files removed.
+func List(dir string) ([]Session, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var result []Session
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		session, err := ReadSession(dir, id)
+		if err != nil {
+			continue
+		}
+		if !processAlive(session.PID) {
+			session.State = SessionStateDead
+			RemoveSession(dir, id)
+		}
+		result = append(result, session)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, nil
+}
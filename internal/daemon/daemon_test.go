@@ -0,0 +1,63 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Server(t *testing.T) {
+	dir := t.TempDir()
+	paths := SessionPaths(dir, "dev")
+	assert.NoError(t, os.WriteFile(paths.Log, []byte("forwarder ready\n"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := NewServer(dir, Session{ID: "dev", PID: os.Getpid(), State: SessionStateStarting}, cancel)
+	doneCh := make(chan error)
+	go func() { doneCh <- server.Serve(ctx) }()
+
+	client := NewClient(paths.Socket)
+	assert.Eventually(t, func() bool {
+		_, err := client.Session(ctx)
+		return err == nil
+	}, time.Second*5, time.Millisecond*10)
+
+	forwards := []Forward{{Name: "db", LocalAddr: "127.0.0.1:5432", TargetAddr: "postgres:5432"}}
+	assert.NoError(t, server.SetRunning("default/api-0/service", forwards))
+	session, err := client.Session(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, SessionStateRunning, session.State)
+	assert.Equal(t, forwards, session.Forwards)
+
+	sessions, err := List(dir)
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, "dev", sessions[0].ID)
+
+	logs := &bytes.Buffer{}
+	assert.NoError(t, client.Logs(ctx, false, logs))
+	assert.Equal(t, "forwarder ready\n", logs.String())
+
+	assert.NoError(t, client.Shutdown(context.Background()))
+	assert.NoError(t, <-doneCh)
+	_, err = os.Stat(paths.State)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_ListDeadSession(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, WriteSession(dir, Session{ID: "gone", PID: 999999999}))
+
+	sessions, err := List(dir)
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, SessionStateDead, sessions[0].State)
+
+	_, err = ReadSession(dir, "gone")
+	assert.Error(t, err)
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package daemon
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// processAlive reports whether process pid is running.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	// NOTE: EPERM means the process exists but belongs to another user, e.g. a reused pid
+	return err == nil
+}
+
+// Detach makes cmd run in its own session, without controlling terminal, so that it keeps running
+// once the terminal it was started from is closed.
+func Detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,150 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/log"
+)
+
+// logFollowInterval is how often a followed log file is checked for new content.
+const logFollowInterval = time.Millisecond * 500
+
+// Server is the control server of a background session.
+type Server struct {
+	dir      string
+	shutdown func()
+
+	mu      sync.Mutex
+	session Session
+}
+
+// NewServer returns the control server of session, shutdown is called on `kportfwd down`.
+func NewServer(dir string, session Session, shutdown func()) *Server {
+	return &Server{dir: dir, session: session, shutdown: shutdown}
+}
+
+// SetRunning records the forwards of the session once they are set up.
+func (s *Server) SetRunning(target string, forwards []Forward) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session.State = SessionStateRunning
+	s.session.Target = target
+	s.session.Forwards = forwards
+	return WriteSession(s.dir, s.session)
+}
+
+func (s *Server) currentSession() Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session
+}
+
+// Serve writes the session state and serves the control socket until ctx is done, session files are removed then.
+func (s *Server) Serve(ctx context.Context) error {
+	session := s.currentSession()
+	paths := SessionPaths(s.dir, session.ID)
+
+	if err := WriteSession(s.dir, session); err != nil {
+		return err
+	}
+	defer RemoveSession(s.dir, session.ID)
+
+	_ = os.Remove(paths.Socket)
+	listener, err := net.Listen("unix", paths.Socket)
+	if err != nil {
+		return fmt.Errorf("unable to listen on session socket: %w", err)
+	}
+	if err := os.Chmod(paths.Socket, 0600); err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("unable to restrict session socket: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/session", s.handleSession)
+	mux.HandleFunc("/shutdown", s.handleShutdown)
+	mux.HandleFunc("/logs", s.handleLogs(ctx, paths.Log))
+	httpServer := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		_ = httpServer.Close()
+	}()
+
+	if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.currentSession())
+}
+
+func (s *Server) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "Method not allowed")
+		return
+	}
+	log.Printf("shutdown requested")
+	w.WriteHeader(http.StatusNoContent)
+	s.shutdown()
+}
+
+// handleLogs writes the session log file, with `?follow=true` it keeps writing appended content
+// until the client goes away or the session stops.
+func (s *Server) handleLogs(ctx context.Context, logFile string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintln(w, "Method not allowed")
+			return
+		}
+
+		file, err := os.Open(logFile)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to open log file: %s", err), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		w.Header().Set("Content-Type", "text/plain")
+		if _, err := io.Copy(w, file); err != nil || r.URL.Query().Get("follow") != "true" {
+			return
+		}
+
+		flusher, _ := w.(http.Flusher)
+		ticker := time.NewTicker(logFollowInterval)
+		defer ticker.Stop()
+		for {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if _, err := io.Copy(w, file); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Package envfile writes environment variables in formats read by shells, dotenv libraries, docker and direnv.
+package envfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// FormatDotenv writes NAME=value lines, quoted and escaped when needed.
+	FormatDotenv = "dotenv"
+	// FormatShell writes `export NAME='value'` lines, e.g. for `source` or `eval`.
+	FormatShell = "shell"
+	// FormatJSON writes a JSON object of names to values.
+	FormatJSON = "json"
+	// FormatDocker writes a `docker run --env-file` file, values are taken literally by docker so they aren't quoted.
+	FormatDocker = "docker"
+	// FormatEnvrc writes a .envrc file for direnv.
+	FormatEnvrc = "envrc"
+)
+
+// Formats are the supported formats.
+var Formats = []string{FormatDotenv, FormatShell, FormatJSON, FormatDocker, FormatEnvrc}
+
+// Redacted replaces values of redacted variables.
+const Redacted = "REDACTED"
+
+// SecretPatterns match names of variables likely holding secrets.
+var SecretPatterns = []string{"*PASSWORD*", "*PASSWD*", "*SECRET*", "*TOKEN*", "*KEY*", "*CREDENTIAL*", "*PRIVATE*", "*AUTH*"}
+
+// Options selects and redacts variables before they are written. Patterns are matched against variable names
+// with path.Match syntax, case-insensitive.
+type Options struct {
+	// Include keeps only variables matching one of the patterns, all variables when empty.
+	Include []string
+	// Exclude drops variables matching one of the patterns.
+	Exclude []string
+	// Redact replaces values of variables matching one of the patterns with Redacted.
+	Redact []string
+}
+
+var shellNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var dotenvUnquotedRegex = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]*$`)
+
+// ValidateFormat returns an error when format is not supported.
+func ValidateFormat(format string) error {
+	for _, f := range Formats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown env format: %s (expected one of %s)", format, strings.Join(Formats, ", "))
+}
+
+// ValidatePatterns returns an error when one of patterns is malformed.
+func ValidatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Apply returns envvars selected and redacted by opts.
+func Apply(envvars map[string]string, opts Options) map[string]string {
+	result := make(map[string]string, len(envvars))
+	for name, value := range envvars {
+		if len(opts.Include) > 0 && !matchAny(opts.Include, name) {
+			continue
+		}
+		if matchAny(opts.Exclude, name) {
+			continue
+		}
+		if matchAny(opts.Redact, name) {
+			value = Redacted
+		}
+		result[name] = value
+	}
+	return result
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToUpper(pattern), strings.ToUpper(name)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes envvars to w in format, sorted by name. Shell formats skip names which aren't valid shell
+// variable names, docker format fails on multi-line values as they can't be represented.
+func Write(w io.Writer, format string, envvars map[string]string) error {
+	names := make([]string, 0, len(envvars))
+	for name := range envvars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buff := &bytes.Buffer{}
+	switch format {
+	case FormatDotenv:
+		for _, name := range names {
+			fmt.Fprintf(buff, "%s=%s\n", name, quoteDotenv(envvars[name]))
+		}
+	case FormatShell, FormatEnvrc:
+		if format == FormatEnvrc {
+			buff.WriteString("# Generated by kportfwd, allow with `direnv allow`\n")
+		}
+		for _, name := range names {
+			if !shellNameRegex.MatchString(name) {
+				continue
+			}
+			fmt.Fprintf(buff, "export %s=%s\n", name, quoteShell(envvars[name]))
+		}
+	case FormatJSON:
+		data, err := json.MarshalIndent(envvars, "", "  ")
+		if err != nil {
+			return err
+		}
+		buff.Write(data)
+		buff.WriteString("\n")
+	case FormatDocker:
+		for _, name := range names {
+			if strings.ContainsAny(envvars[name], "\r\n") {
+				return fmt.Errorf("variable %s has a multi-line value, not supported by docker env files", name)
+			}
+			fmt.Fprintf(buff, "%s=%s\n", name, envvars[name])
+		}
+	default:
+		return ValidateFormat(format)
+	}
+
+	_, err := w.Write(buff.Bytes())
+	return err
+}
+
+// WriteFile writes envvars to filename in format, the file is only readable by the current user.
+func WriteFile(filename, format string, envvars map[string]string) error {
+	buff := &bytes.Buffer{}
+	if err := Write(buff, format, envvars); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// NOTE: An existing file keeps its permissions on open, tighten them before writing
+	if err := file.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err := file.Write(buff.Bytes()); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// quoteDotenv quotes value when needed: single quotes keep it literal, double quotes are used
+// with escapes for values having a single quote or line breaks. $ is escaped in double quotes,
+// docker compose, direnv and python-dotenv would expand it as a variable otherwise.
+func quoteDotenv(value string) string {
+	if dotenvUnquotedRegex.MatchString(value) {
+		return value
+	}
+	if !strings.ContainsAny(value, "'\r\n") {
+		return "'" + value + "'"
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// quoteShell quotes value for POSIX shells.
+func quoteShell(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
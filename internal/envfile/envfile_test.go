@@ -0,0 +1,106 @@
+package envfile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testEnvvars = map[string]string{
+	"DB_HOST":     "127.0.0.1",
+	"DB_PASSWORD": "it's $ecret",
+	"GREETING":    "hello world",
+	"CERT":        "line1\nline2",
+	"app.name":    "orders",
+}
+
+func Test_Write(t *testing.T) {
+	testCases := []struct {
+		Format      string
+		Envvars     map[string]string
+		Expected    string
+		ExpectedErr bool
+	}{
+		{
+			Format:   FormatDotenv,
+			Envvars:  testEnvvars,
+			Expected: "CERT=\"line1\\nline2\"\nDB_HOST=127.0.0.1\nDB_PASSWORD=\"it's \\$ecret\"\nGREETING='hello world'\napp.name=orders\n",
+		},
+		{
+			Format:   FormatShell,
+			Envvars:  testEnvvars,
+			Expected: "export CERT='line1\nline2'\nexport DB_HOST='127.0.0.1'\nexport DB_PASSWORD='it'\\''s $ecret'\nexport GREETING='hello world'\n",
+		},
+		{
+			Format:   FormatEnvrc,
+			Envvars:  map[string]string{"DB_HOST": "127.0.0.1"},
+			Expected: "# Generated by kportfwd, allow with `direnv allow`\nexport DB_HOST='127.0.0.1'\n",
+		},
+		{
+			Format:   FormatJSON,
+			Envvars:  map[string]string{"DB_HOST": "127.0.0.1", "CERT": "a\nb"},
+			Expected: "{\n  \"CERT\": \"a\\nb\",\n  \"DB_HOST\": \"127.0.0.1\"\n}\n",
+		},
+		{
+			Format:   FormatDocker,
+			Envvars:  map[string]string{"DB_HOST": "127.0.0.1", "GREETING": "hello \"world\""},
+			Expected: "DB_HOST=127.0.0.1\nGREETING=hello \"world\"\n",
+		},
+		{
+			Format:      FormatDocker,
+			Envvars:     testEnvvars,
+			ExpectedErr: true,
+		},
+		{
+			Format:      "yaml",
+			Envvars:     testEnvvars,
+			ExpectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Format, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			err := Write(output, tc.Format, tc.Envvars)
+			if tc.ExpectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, output.String())
+		})
+	}
+}
+
+func Test_Apply(t *testing.T) {
+	result := Apply(testEnvvars, Options{
+		Include: []string{"DB_*", "GREETING", "cert"},
+		Exclude: []string{"GREETING"},
+		Redact:  SecretPatterns,
+	})
+	assert.Equal(t, map[string]string{
+		"DB_HOST":     "127.0.0.1",
+		"DB_PASSWORD": Redacted,
+		"CERT":        "line1\nline2",
+	}, result)
+
+	assert.Equal(t, testEnvvars, Apply(testEnvvars, Options{}))
+	assert.Error(t, ValidatePatterns([]string{"DB_["}))
+}
+
+func Test_WriteFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), ".env")
+	assert.NoError(t, os.WriteFile(filename, []byte("OLD=1\n"), 0644))
+
+	assert.NoError(t, WriteFile(filename, FormatDotenv, map[string]string{"DB_HOST": "127.0.0.1"}))
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "DB_HOST=127.0.0.1\n", string(data))
+}
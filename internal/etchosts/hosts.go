@@ -12,6 +12,19 @@ import (
 
 var hostsFile *txeh.Hosts
 
+// Helper edits the hosts file on behalf of an unprivileged process, see internal/privhelper.
+type Helper interface {
+	AddHost(ip, host string) error
+	RemoveHost(host string) error
+}
+
+var helper Helper
+
+// UseHelper makes AddHost and RemoveHost go through h instead of editing the hosts file, Init is not needed then.
+func UseHelper(h Helper) {
+	helper = h
+}
+
 func Init() {
 	hosts, err := txeh.NewHostsDefault()
 	if err != nil {
@@ -25,12 +38,26 @@ func Init() {
 	}
 }
 
-func AddHost(ip, host string) {
+func AddHost(ip, host string) error {
+	if helper != nil {
+		return helper.AddHost(ip, host)
+	}
 	hostsFile.AddHost(ip, host)
-	hostsFile.Save()
+	return hostsFile.Save()
 }
 
-func RemoveHost(host string) {
+func RemoveHost(host string) error {
+	if helper != nil {
+		return helper.RemoveHost(host)
+	}
 	hostsFile.RemoveHost(host)
-	hostsFile.Save()
+	return hostsFile.Save()
+}
+
+// HasHost reports whether the hosts file has an entry for host, it always reads the file itself.
+func HasHost(host string) (bool, error) {
+	if err := hostsFile.Reload(); err != nil {
+		return false, err
+	}
+	return len(hostsFile.ListAddressesByHost(host, true)) > 0, nil
 }
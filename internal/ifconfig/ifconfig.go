@@ -7,7 +7,24 @@ import (
 	"os/exec"
 )
 
+// Helper changes loopback aliases on behalf of an unprivileged process, see internal/privhelper.
+type Helper interface {
+	AddLoopbackAlias(aliasIpAddr string) error
+	RemoveLoopbackAlias(aliasIpAddr string) error
+}
+
+var helper Helper
+
+// UseHelper makes AddLoopbackAlias and RemoveLoopbackAlias go through h instead of running ifconfig.
+func UseHelper(h Helper) {
+	helper = h
+}
+
 func AddLoopbackAlias(aliasIpAddr string) error {
+	if helper != nil {
+		return helper.AddLoopbackAlias(aliasIpAddr)
+	}
+
 	strBuff := bytes.NewBufferString("")
 	cmd := exec.Command("ifconfig", "lo0", "alias", aliasIpAddr)
 	cmd.Stdout = os.Stdout
@@ -21,6 +38,10 @@ func AddLoopbackAlias(aliasIpAddr string) error {
 }
 
 func RemoveLoopbackAlias(aliasIpAddr string) error {
+	if helper != nil {
+		return helper.RemoveLoopbackAlias(aliasIpAddr)
+	}
+
 	strBuff := bytes.NewBufferString("")
 
 	cmd := exec.Command("ifconfig", "lo0", "-alias", aliasIpAddr)
@@ -0,0 +1,21 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GetConfigMapKey returns the value of key in ConfigMap name.
+func GetConfigMapKey(ctx context.Context, cfg *ClientConfig, ns, name, key string) (string, error) {
+	configMap, err := cfg.Clientset.CoreV1().ConfigMaps(ns).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	value, ok := configMap.Data[key]
+	if !ok {
+		return "", fmt.Errorf("key %s not found in configmap %s/%s", key, ns, name)
+	}
+	return value, nil
+}
@@ -0,0 +1,272 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/abdularis/kportfwd/internal/log"
+
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// envCommands print the environment of the container NUL-separated, tried in order. An exec'd process gets the
+// container environment (image ENV and pod spec env), PID 1 is only the main process when the pod doesn't share
+// its process namespace, so it's used when env doesn't support -0 (e.g. old busybox).
+var envCommands = [][]string{
+	{"env", "-0"},
+	{"cat", "/proc/1/environ"},
+}
+
+// GetEnvVariablesFromPod returns environment variables of the pod container, read from the running container,
+// or resolved from the pod spec when the container can't be exec'd (e.g. distroless images without cat or env).
+func GetEnvVariablesFromPod(ctx context.Context, cfg *ClientConfig, ns, pod, container string) (map[string]string, error) {
+	for _, command := range envCommands {
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+		if err := ExecOnPodWithStdin(ctx, cfg, ns, pod, container, nil, stdout, stderr, command); err != nil {
+			log.Debugf("get env of %s with %s: %s %s", pod, strings.Join(command, " "), err, strings.TrimSpace(stderr.String()))
+			continue
+		}
+		if envs := ParseEnviron(stdout.Bytes()); len(envs) > 0 {
+			return envs, nil
+		}
+	}
+
+	log.Warnf("unable to read environment of %s/%s, resolving it from the pod spec (image ENV is not included)", pod, container)
+	targetPod, err := cfg.Clientset.CoreV1().Pods(ns).Get(ctx, pod, metaV1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get pod %s: %w", pod, err)
+	}
+	return GetEnvVariablesFromPodSpec(ctx, cfg.Clientset, targetPod, container)
+}
+
+// ParseEnviron parses NUL-separated NAME=value records, as in /proc/<pid>/environ or `env -0` output.
+// Values are kept as is, they may contain '=' or line breaks.
+func ParseEnviron(data []byte) map[string]string {
+	result := map[string]string{}
+	for _, record := range strings.Split(string(data), "\x00") {
+		name, value, ok := strings.Cut(record, "=")
+		if !ok || name == "" {
+			continue
+		}
+		result[name] = value
+	}
+	return result
+}
+
+// GetEnvVariablesFromPodSpec resolves environment variables declared for container in the pod spec: envFrom
+// ConfigMaps and Secrets, then env values, valueFrom ConfigMap/Secret keys and pod fields, with $(VAR) references
+// expanded. References which can't be resolved (e.g. Secrets not readable) are skipped with a warning.
+// An empty container picks the default container, see podContainer.
+func GetEnvVariablesFromPodSpec(ctx context.Context, client kubernetes.Interface, pod *v1.Pod, container string) (map[string]string, error) {
+	spec, err := podContainer(pod, container)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := &envRefResolver{ctx: ctx, client: client, ns: pod.Namespace, configMaps: map[string]*v1.ConfigMap{}, secrets: map[string]*v1.Secret{}}
+	result := map[string]string{}
+
+	for _, envFrom := range spec.EnvFrom {
+		var data map[string]string
+		var err error
+		switch {
+		case envFrom.ConfigMapRef != nil:
+			data, err = refs.configMapData(envFrom.ConfigMapRef.Name, envFrom.ConfigMapRef.Optional)
+		case envFrom.SecretRef != nil:
+			data, err = refs.secretData(envFrom.SecretRef.Name, envFrom.SecretRef.Optional)
+		}
+		if err != nil {
+			log.Warnf("pod %s envFrom: %s", pod.Name, err)
+			continue
+		}
+		for name, value := range data {
+			result[envFrom.Prefix+name] = value
+		}
+	}
+
+	for _, env := range spec.Env {
+		if env.ValueFrom == nil {
+			result[env.Name] = expandEnvRefs(env.Value, result)
+			continue
+		}
+
+		value, ok, err := refs.valueFrom(pod, env.ValueFrom)
+		if err != nil {
+			log.Warnf("pod %s env %s: %s", pod.Name, env.Name, err)
+			continue
+		}
+		if ok {
+			result[env.Name] = value
+		}
+	}
+
+	return result, nil
+}
+
+// envRefResolver resolves ConfigMaps and Secrets referenced by a pod env, each fetched once.
+type envRefResolver struct {
+	ctx        context.Context
+	client     kubernetes.Interface
+	ns         string
+	configMaps map[string]*v1.ConfigMap
+	secrets    map[string]*v1.Secret
+}
+
+// valueFrom returns the value of source, ok is false when an optional reference is missing.
+func (r *envRefResolver) valueFrom(pod *v1.Pod, source *v1.EnvVarSource) (string, bool, error) {
+	switch {
+	case source.ConfigMapKeyRef != nil:
+		data, err := r.configMapData(source.ConfigMapKeyRef.Name, source.ConfigMapKeyRef.Optional)
+		if err != nil {
+			return "", false, err
+		}
+		value, ok := data[source.ConfigMapKeyRef.Key]
+		if !ok && !isOptional(source.ConfigMapKeyRef.Optional) {
+			return "", false, fmt.Errorf("key %s not found in configmap %s", source.ConfigMapKeyRef.Key, source.ConfigMapKeyRef.Name)
+		}
+		return value, ok, nil
+	case source.SecretKeyRef != nil:
+		data, err := r.secretData(source.SecretKeyRef.Name, source.SecretKeyRef.Optional)
+		if err != nil {
+			return "", false, err
+		}
+		value, ok := data[source.SecretKeyRef.Key]
+		if !ok && !isOptional(source.SecretKeyRef.Optional) {
+			return "", false, fmt.Errorf("key %s not found in secret %s", source.SecretKeyRef.Key, source.SecretKeyRef.Name)
+		}
+		return value, ok, nil
+	case source.FieldRef != nil:
+		value, err := podFieldValue(pod, source.FieldRef.FieldPath)
+		return value, err == nil, err
+	}
+	return "", false, fmt.Errorf("unsupported valueFrom source")
+}
+
+// configMapData returns data of ConfigMap name, nil without error when it's optional and missing.
+func (r *envRefResolver) configMapData(name string, optional *bool) (map[string]string, error) {
+	configMap, ok := r.configMaps[name]
+	if !ok {
+		var err error
+		configMap, err = r.client.CoreV1().ConfigMaps(r.ns).Get(r.ctx, name, metaV1.GetOptions{})
+		if err != nil {
+			if isOptional(optional) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unable to get configmap %s: %w", name, err)
+		}
+		r.configMaps[name] = configMap
+	}
+	return configMap.Data, nil
+}
+
+// secretData returns decoded data of Secret name, nil without error when it's optional and missing.
+func (r *envRefResolver) secretData(name string, optional *bool) (map[string]string, error) {
+	secret, ok := r.secrets[name]
+	if !ok {
+		var err error
+		secret, err = r.client.CoreV1().Secrets(r.ns).Get(r.ctx, name, metaV1.GetOptions{})
+		if err != nil {
+			if isOptional(optional) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unable to get secret %s: %w", name, err)
+		}
+		r.secrets[name] = secret
+	}
+
+	data := make(map[string]string, len(secret.Data))
+	for key, value := range secret.Data {
+		data[key] = string(value)
+	}
+	return data, nil
+}
+
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
+
+// podFieldValue returns the value of a downward API field path of pod.
+func podFieldValue(pod *v1.Pod, fieldPath string) (string, error) {
+	switch fieldPath {
+	case "metadata.name":
+		return pod.Name, nil
+	case "metadata.namespace":
+		return pod.Namespace, nil
+	case "metadata.uid":
+		return string(pod.UID), nil
+	case "spec.nodeName":
+		return pod.Spec.NodeName, nil
+	case "spec.serviceAccountName":
+		return pod.Spec.ServiceAccountName, nil
+	case "status.podIP":
+		return pod.Status.PodIP, nil
+	case "status.hostIP":
+		return pod.Status.HostIP, nil
+	}
+
+	for prefix, values := range map[string]map[string]string{"metadata.labels": pod.Labels, "metadata.annotations": pod.Annotations} {
+		if key, ok := strings.CutPrefix(fieldPath, prefix+"['"); ok && strings.HasSuffix(key, "']") {
+			return values[strings.TrimSuffix(key, "']")], nil
+		}
+	}
+	return "", fmt.Errorf("unsupported field path %s", fieldPath)
+}
+
+// expandEnvRefs expands $(VAR) references to variables defined in envs the way kubelet does, references to
+// undefined variables are kept as is and $$ escapes a $.
+func expandEnvRefs(value string, envs map[string]string) string {
+	var b strings.Builder
+	for idx := 0; idx < len(value); idx++ {
+		if value[idx] != '$' || idx+1 >= len(value) {
+			b.WriteByte(value[idx])
+			continue
+		}
+
+		switch next := value[idx+1]; {
+		case next == '$':
+			b.WriteByte('$')
+			idx++
+		case next == '(':
+			end := strings.IndexByte(value[idx+2:], ')')
+			if end < 0 {
+				b.WriteString(value[idx:])
+				return b.String()
+			}
+			name := value[idx+2 : idx+2+end]
+			if envValue, ok := envs[name]; ok {
+				b.WriteString(envValue)
+			} else {
+				b.WriteString(value[idx : idx+3+end])
+			}
+			idx += 2 + end
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String()
+}
+
+// defaultContainerAnnotation names the container kubectl picks when none is given.
+const defaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+// podContainer returns the container named name, or when name is empty the one of the default container
+// annotation, then the first container, as kubectl does.
+func podContainer(pod *v1.Pod, name string) (*v1.Container, error) {
+	if name == "" {
+		name = pod.Annotations[defaultContainerAnnotation]
+	}
+	if name == "" && len(pod.Spec.Containers) > 0 {
+		return &pod.Spec.Containers[0], nil
+	}
+	for idx := range pod.Spec.Containers {
+		if pod.Spec.Containers[idx].Name == name {
+			return &pod.Spec.Containers[idx], nil
+		}
+	}
+	return nil, fmt.Errorf("container %s not found in pod %s", name, pod.Name)
+}
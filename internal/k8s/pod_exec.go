@@ -1,22 +1,24 @@
 package k8s
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"net/http"
-	"strings"
-
-	"github.com/abdularis/kportfwd/internal/log"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/remotecommand"
 )
 
+// ExecOnPod executes command on the pod container without a TTY and without stdin.
 func ExecOnPod(ctx context.Context, cfg *ClientConfig, ns, pod, container string, stdout, stderr io.Writer, command []string) error {
+	return ExecOnPodWithStdin(ctx, cfg, ns, pod, container, nil, stdout, stderr, command)
+}
+
+// ExecOnPodWithStdin executes command on the pod container without a TTY and streams stdin to it.
+// Stdout and stderr are kept as separate streams so that binary input is not mangled by the terminal.
+func ExecOnPodWithStdin(ctx context.Context, cfg *ClientConfig, ns, pod, container string, stdin io.Reader, stdout, stderr io.Writer, command []string) error {
 	if stderr == nil || stdout == nil {
 		return fmt.Errorf("stdout and stderr should not be nil")
 	}
@@ -29,10 +31,10 @@ func ExecOnPod(ctx context.Context, cfg *ClientConfig, ns, pod, container string
 		VersionedParams(&v1.PodExecOptions{
 			Container: container,
 			Command:   command,
-			Stdin:     false,
+			Stdin:     stdin != nil,
 			Stdout:    true,
 			Stderr:    true,
-			TTY:       true,
+			TTY:       false,
 		}, scheme.ParameterCodec).
 		URL()
 	exec, err := remotecommand.NewSPDYExecutor(cfg.RestConfig, http.MethodPost, url)
@@ -41,6 +43,7 @@ func ExecOnPod(ctx context.Context, cfg *ClientConfig, ns, pod, container string
 	}
 
 	err = exec.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
 		Stdout: stdout,
 		Stderr: stderr,
 	})
@@ -50,29 +53,3 @@ func ExecOnPod(ctx context.Context, cfg *ClientConfig, ns, pod, container string
 
 	return nil
 }
-
-func GetEnvVariablesFromPod(ctx context.Context, cfg *ClientConfig, ns, pod, container string) (map[string]string, error) {
-	command := []string{"env"}
-	output := &bytes.Buffer{}
-	err := ExecOnPod(ctx, cfg, ns, pod, container, output, &bytes.Buffer{}, command)
-	if err != nil {
-		return nil, fmt.Errorf("unable to exec get env: %w", err)
-	}
-	envs := output.String()
-
-	result := map[string]string{}
-	scanner := bufio.NewScanner(strings.NewReader(envs))
-	for scanner.Scan() {
-		line := scanner.Text()
-		splits := strings.Split(line, "=")
-		if len(splits) < 2 {
-			log.Printf("GetEnvVariablesFromPod %s: %s can't be parsed", pod, line)
-			continue
-		}
-		varName := strings.TrimSpace(splits[0])
-		varValue := strings.TrimSpace(splits[1])
-		result[varName] = varValue
-	}
-
-	return result, nil
-}
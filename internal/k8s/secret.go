@@ -0,0 +1,21 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GetSecretKey returns the value of key in Secret name.
+func GetSecretKey(ctx context.Context, cfg *ClientConfig, ns, name, key string) ([]byte, error) {
+	secret, err := cfg.Clientset.CoreV1().Secrets(ns).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	value, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found in secret %s/%s", key, ns, name)
+	}
+	return value, nil
+}
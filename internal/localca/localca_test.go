@@ -0,0 +1,45 @@
+package localca
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_LoadOrCreate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ca")
+
+	ca, err := LoadOrCreate(dir)
+	assert.NoError(t, err)
+	assert.True(t, ca.Certificate().IsCA)
+
+	info, err := os.Stat(filepath.Join(dir, keyFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	loaded, err := LoadOrCreate(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, ca.Certificate().Raw, loaded.Certificate().Raw)
+}
+
+func Test_Issue(t *testing.T) {
+	ca, err := LoadOrCreate(t.TempDir())
+	assert.NoError(t, err)
+
+	cert, err := ca.Issue("api.internal.svc", "127.0.0.1")
+	assert.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+	for _, host := range []string{"api.internal.svc", "127.0.0.1"} {
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots, CurrentTime: time.Now()})
+		assert.NoError(t, err, host)
+	}
+
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "other.svc", Roots: roots})
+	assert.Error(t, err)
+}
@@ -0,0 +1,92 @@
+package localca
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// linuxTrustStore is a system CA anchors directory and the command regenerating the trust bundle from it.
+type linuxTrustStore struct {
+	dir     string
+	command []string
+}
+
+var linuxTrustStores = []linuxTrustStore{
+	{dir: "/usr/local/share/ca-certificates", command: []string{"update-ca-certificates"}},           // debian, ubuntu, alpine
+	{dir: "/etc/pki/ca-trust/source/anchors", command: []string{"update-ca-trust", "extract"}},       // fedora, rhel
+	{dir: "/etc/ca-certificates/trust-source/anchors", command: []string{"trust", "extract-compat"}}, // arch
+	{dir: "/usr/share/pki/trust/anchors", command: []string{"update-ca-certificates"}},               // opensuse
+}
+
+const linuxTrustFileName = "kportfwd-local-ca.crt"
+
+// Install adds the CA certificate to the OS trust store, system changes are made with sudo unless running as root.
+func (ca *CA) Install() error {
+	switch runtime.GOOS {
+	case "darwin":
+		return run("security", "add-trusted-cert", "-d", "-r", "trustRoot", "-k", "/Library/Keychains/System.keychain", ca.CertFile())
+	case "linux":
+		store, err := findLinuxTrustStore()
+		if err != nil {
+			return err
+		}
+		if err := run("cp", ca.CertFile(), filepath.Join(store.dir, linuxTrustFileName)); err != nil {
+			return fmt.Errorf("unable to add local CA to %s: %w", store.dir, err)
+		}
+		return run(store.command...)
+	}
+	return fmt.Errorf("installing the local CA is not supported on %s, add %s to your trust store manually", runtime.GOOS, ca.CertFile())
+}
+
+// Uninstall removes the CA certificate from the OS trust store, system changes are made with sudo unless running as root.
+func (ca *CA) Uninstall() error {
+	switch runtime.GOOS {
+	case "darwin":
+		return run("security", "remove-trusted-cert", "-d", ca.CertFile())
+	case "linux":
+		store, err := findLinuxTrustStore()
+		if err != nil {
+			return err
+		}
+		if err := run("rm", "-f", filepath.Join(store.dir, linuxTrustFileName)); err != nil {
+			return fmt.Errorf("unable to remove local CA from %s: %w", store.dir, err)
+		}
+		return run(store.command...)
+	}
+	return fmt.Errorf("uninstalling the local CA is not supported on %s, remove %s from your trust store manually", runtime.GOOS, ca.CertFile())
+}
+
+func findLinuxTrustStore() (linuxTrustStore, error) {
+	for _, store := range linuxTrustStores {
+		if _, err := os.Stat(store.dir); err != nil {
+			continue
+		}
+		if _, err := exec.LookPath(store.command[0]); err != nil {
+			continue
+		}
+		return store, nil
+	}
+	return linuxTrustStore{}, fmt.Errorf("no supported system trust store found")
+}
+
+// run runs a command changing the system trust store, with sudo unless running as root.
+func run(command ...string) error {
+	if os.Geteuid() != 0 {
+		command = append([]string{"sudo"}, command...)
+	}
+
+	strBuff := bytes.NewBufferString("")
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = strBuff
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", strings.Join(command, " "), err, strBuff.String())
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package privhelper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Client calls the helper api, it implements etchosts.Helper and ifconfig.Helper.
+type Client struct {
+	token  string
+	client http.Client
+
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	dir   string
+}
+
+// NewClient returns a client of the helper listening on socket.
+func NewClient(socket, token string) *Client {
+	return &Client{
+		token: token,
+		client: http.Client{
+			Timeout: time.Second * 30,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Start starts the helper with sudo, which may prompt for a password on the terminal, and returns a client
+// calling it once it's ready. Close stops the helper.
+func Start(ctx context.Context) (*Client, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("unable to find kportfwd executable: %w", err)
+	}
+
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, fmt.Errorf("unable to generate helper token: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "kportfwd-helper-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create helper socket dir: %w", err)
+	}
+	cfg := Config{
+		Socket: filepath.Join(dir, "helper.sock"),
+		Token:  hex.EncodeToString(tokenBytes),
+		UID:    os.Getuid(),
+		GID:    os.Getgid(),
+	}
+
+	cmd := exec.Command("sudo", executable, CommandName)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("unable to start helper: %w", err)
+	}
+
+	c := NewClient(cfg.Socket, cfg.Token)
+	c.cmd, c.stdin, c.dir = cmd, stdin, dir
+
+	if err := json.NewEncoder(stdin).Encode(cfg); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("unable to configure helper: %w", err)
+	}
+
+	readyCh := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(stdout).ReadString('\n')
+		if err != nil {
+			readyCh <- fmt.Errorf("helper exited before being ready")
+			return
+		}
+		if strings.TrimSpace(line) != readyLine {
+			readyCh <- fmt.Errorf("unexpected helper output: %s", line)
+			return
+		}
+		readyCh <- nil
+	}()
+
+	// NOTE: No timeout, sudo may be waiting for the password
+	select {
+	case err := <-readyCh:
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	}
+	return c, nil
+}
+
+// Close stops the helper started by Start and waits until it reverted its changes.
+func (c *Client) Close() {
+	if c.cmd == nil {
+		return
+	}
+	_ = c.stdin.Close()
+	_ = c.cmd.Wait()
+	_ = os.RemoveAll(c.dir)
+}
+
+func (c *Client) AddHost(ip, host string) error {
+	return c.do(http.MethodPost, "/hosts", hostEntry{IP: ip, Host: host})
+}
+
+func (c *Client) RemoveHost(host string) error {
+	return c.do(http.MethodDelete, "/hosts", hostEntry{Host: host})
+}
+
+func (c *Client) AddLoopbackAlias(ip string) error {
+	return c.do(http.MethodPost, "/aliases", aliasEntry{IP: ip})
+}
+
+func (c *Client) RemoveLoopbackAlias(ip string) error {
+	return c.do(http.MethodDelete, "/aliases", aliasEntry{IP: ip})
+}
+
+func (c *Client) do(method, path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, "http://helper"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("privileged helper: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("privileged helper: %s", strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
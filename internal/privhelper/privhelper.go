@@ -0,0 +1,45 @@
+// Package privhelper runs the only privileged part of kportfwd, /etc/hosts edits and loopback aliases,
+// in a small helper process started with sudo. The main process keeps running as the invoking user and
+// calls the helper over an http api on a unix socket, authenticated with a token only it knows.
+//
+// The helper only removes hosts and aliases it added itself, and removes all of them once the main
+// process closes its stdin (exit or crash).
+package privhelper
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// CommandName is the hidden kportfwd command running the helper.
+const CommandName = "privileged-helper"
+
+// readyLine is written by the helper on stdout once it's listening.
+const readyLine = "ready"
+
+// Config is passed by the main process to the helper as a JSON line on stdin.
+type Config struct {
+	Socket string `json:"socket"`
+	Token  string `json:"token"`
+	// UID and GID own the socket, so that the unprivileged main process can connect.
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+type hostEntry struct {
+	IP   string `json:"ip,omitempty"`
+	Host string `json:"host"`
+}
+
+type aliasEntry struct {
+	IP string `json:"ip"`
+}
+
+var hostnameRegex = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]*[A-Za-z0-9])?$`)
+
+func validateHost(host string) error {
+	if len(host) > 253 || !hostnameRegex.MatchString(host) || host == "localhost" {
+		return fmt.Errorf("invalid host name: %q", host)
+	}
+	return nil
+}
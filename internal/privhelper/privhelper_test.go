@@ -0,0 +1,94 @@
+package privhelper
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeOperations struct {
+	mu      sync.Mutex
+	hosts   map[string]string
+	aliases map[string]bool
+}
+
+func (f *fakeOperations) AddHost(ip, host string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hosts[host] = ip
+	return nil
+}
+
+func (f *fakeOperations) RemoveHost(host string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.hosts, host)
+	return nil
+}
+
+func (f *fakeOperations) HasHost(host string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.hosts[host]
+	return ok, nil
+}
+
+func (f *fakeOperations) AddLoopbackAlias(ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.aliases[ip] = true
+	return nil
+}
+
+func (f *fakeOperations) RemoveLoopbackAlias(ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.aliases, ip)
+	return nil
+}
+
+func Test_Serve(t *testing.T) {
+	ops := &fakeOperations{hosts: map[string]string{"keep.internal": "127.0.0.1"}, aliases: map[string]bool{}}
+	cfg := Config{Socket: filepath.Join(t.TempDir(), "helper.sock"), Token: "secret"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	readyCh := make(chan struct{})
+	doneCh := make(chan error)
+	go func() { doneCh <- serve(ctx, cfg, ops, func() { close(readyCh) }) }()
+	<-readyCh
+
+	info, err := os.Stat(cfg.Socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	client := NewClient(cfg.Socket, cfg.Token)
+	assert.NoError(t, client.AddLoopbackAlias("10.0.0.10"))
+	assert.NoError(t, client.AddHost("10.0.0.10", "postgres.db.svc"))
+	assert.NoError(t, client.AddHost("127.0.0.1", "redis"))
+	assert.NoError(t, client.AddHost("127.0.0.1", "postgres.db.svc"))
+	assert.NoError(t, client.AddHost("10.0.0.10", "postgres.db.svc"))
+	assert.NoError(t, client.RemoveHost("redis"))
+	assert.Equal(t, map[string]string{"keep.internal": "127.0.0.1", "postgres.db.svc": "10.0.0.10"}, ops.hosts)
+	assert.Equal(t, map[string]bool{"10.0.0.10": true}, ops.aliases)
+
+	// only changes made by the helper can be reverted, with sane values and the right token
+	assert.Error(t, client.RemoveHost("keep.internal"))
+	assert.Error(t, client.AddHost("127.0.0.1", "evil.internal\n1.2.3.4 bank.com"))
+	assert.Error(t, client.AddLoopbackAlias("8.8.8.8"))
+	assert.Error(t, client.AddHost("10.0.0.11", "mysql"))
+	assert.Error(t, client.AddHost("192.168.1.1", "mysql"))
+	assert.Error(t, client.AddHost("127.0.0.1", "keep.internal"))
+	assert.Equal(t, "127.0.0.1", ops.hosts["keep.internal"])
+	assert.NotContains(t, ops.hosts, "mysql")
+	assert.Error(t, NewClient(cfg.Socket, "guess").AddHost("127.0.0.1", "other"))
+
+	// remaining changes are reverted on shutdown
+	cancel()
+	assert.NoError(t, <-doneCh)
+	assert.Equal(t, map[string]string{"keep.internal": "127.0.0.1"}, ops.hosts)
+	assert.Empty(t, ops.aliases)
+}
@@ -0,0 +1,245 @@
+package privhelper
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/abdularis/kportfwd/internal/config"
+	"github.com/abdularis/kportfwd/internal/etchosts"
+	"github.com/abdularis/kportfwd/internal/ifconfig"
+	"github.com/abdularis/kportfwd/internal/log"
+)
+
+// operations are the privileged changes made by the helper.
+type operations interface {
+	AddHost(ip, host string) error
+	RemoveHost(host string) error
+	HasHost(host string) (bool, error)
+	AddLoopbackAlias(ip string) error
+	RemoveLoopbackAlias(ip string) error
+}
+
+type systemOperations struct{}
+
+func (systemOperations) AddHost(ip, host string) error       { return etchosts.AddHost(ip, host) }
+func (systemOperations) RemoveHost(host string) error        { return etchosts.RemoveHost(host) }
+func (systemOperations) HasHost(host string) (bool, error)   { return etchosts.HasHost(host) }
+func (systemOperations) AddLoopbackAlias(ip string) error    { return ifconfig.AddLoopbackAlias(ip) }
+func (systemOperations) RemoveLoopbackAlias(ip string) error { return ifconfig.RemoveLoopbackAlias(ip) }
+
+// Run runs the helper: it reads Config from stdin, serves until stdin is closed or ctx is done,
+// then reverts the changes it made.
+func Run(ctx context.Context, stdin io.Reader, stdout io.Writer) error {
+	reader := bufio.NewReader(stdin)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("unable to read helper config: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(line, &cfg); err != nil {
+		return fmt.Errorf("invalid helper config: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		// NOTE: stdin stays open as long as the main process is alive
+		_, _ = io.Copy(io.Discard, reader)
+		cancel()
+	}()
+
+	etchosts.Init()
+	return serve(ctx, cfg, systemOperations{}, func() {
+		fmt.Fprintln(stdout, readyLine)
+	})
+}
+
+type server struct {
+	token string
+	ops   operations
+
+	mu      sync.Mutex
+	hosts   map[string]struct{}
+	aliases map[string]struct{}
+}
+
+func serve(ctx context.Context, cfg Config, ops operations, ready func()) error {
+	_ = os.Remove(cfg.Socket)
+	listener, err := net.Listen("unix", cfg.Socket)
+	if err != nil {
+		return fmt.Errorf("unable to listen on helper socket: %w", err)
+	}
+	defer os.Remove(cfg.Socket)
+
+	if err := os.Chmod(cfg.Socket, 0600); err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("unable to restrict helper socket: %w", err)
+	}
+	if os.Geteuid() == 0 && cfg.UID != 0 {
+		if err := os.Chown(cfg.Socket, cfg.UID, cfg.GID); err != nil {
+			_ = listener.Close()
+			return fmt.Errorf("unable to chown helper socket: %w", err)
+		}
+	}
+
+	s := &server{token: cfg.Token, ops: ops, hosts: map[string]struct{}{}, aliases: map[string]struct{}{}}
+	defer s.revert()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hosts", s.authorized(s.handleHosts))
+	mux.HandleFunc("/aliases", s.authorized(s.handleAliases))
+	httpServer := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		_ = httpServer.Close()
+	}()
+
+	ready()
+	if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Unauthorized")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *server) handleHosts(w http.ResponseWriter, r *http.Request) {
+	var entry hostEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		http.Error(w, fmt.Sprintf("invalid host entry: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateHost(entry.Host); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPost:
+		ip := net.ParseIP(entry.IP)
+		if ip == nil {
+			http.Error(w, fmt.Sprintf("invalid ip address: %q", entry.IP), http.StatusBadRequest)
+			return
+		}
+		// hosts may only point to loopback or to an alias of this helper, and must not shadow entries of others
+		if _, aliased := s.aliases[ip.String()]; !ip.IsLoopback() && !aliased {
+			http.Error(w, fmt.Sprintf("ip address %s is neither loopback nor aliased by this helper", entry.IP), http.StatusForbidden)
+			return
+		}
+		if _, owned := s.hosts[entry.Host]; !owned {
+			exists, err := s.ops.HasHost(entry.Host)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if exists {
+				http.Error(w, fmt.Sprintf("host %s already has an entry not added by this helper", entry.Host), http.StatusConflict)
+				return
+			}
+		}
+		if err := s.ops.AddHost(entry.IP, entry.Host); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.hosts[entry.Host] = struct{}{}
+	case http.MethodDelete:
+		if _, ok := s.hosts[entry.Host]; !ok {
+			http.Error(w, fmt.Sprintf("host %s was not added by this helper", entry.Host), http.StatusNotFound)
+			return
+		}
+		if err := s.ops.RemoveHost(entry.Host); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		delete(s.hosts, entry.Host)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "Method not allowed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handleAliases(w http.ResponseWriter, r *http.Request) {
+	var entry aliasEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		http.Error(w, fmt.Sprintf("invalid alias entry: %s", err), http.StatusBadRequest)
+		return
+	}
+	// NOTE: Only addresses kportfwd allocates itself, the helper must not be usable to take over addresses of the local network
+	if err := config.ValidateLocalAliasIP(entry.IP); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entry.IP = net.ParseIP(entry.IP).String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPost:
+		if err := s.ops.AddLoopbackAlias(entry.IP); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.aliases[entry.IP] = struct{}{}
+	case http.MethodDelete:
+		if _, ok := s.aliases[entry.IP]; !ok {
+			http.Error(w, fmt.Sprintf("alias %s was not added by this helper", entry.IP), http.StatusNotFound)
+			return
+		}
+		if err := s.ops.RemoveLoopbackAlias(entry.IP); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		delete(s.aliases, entry.IP)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "Method not allowed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revert removes hosts and aliases still left, e.g. when the main process crashed.
+func (s *server) revert() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for host := range s.hosts {
+		if err := s.ops.RemoveHost(host); err != nil {
+			log.Errorf("unable to remove host %s: %s", host, err)
+		}
+		delete(s.hosts, host)
+	}
+	for ip := range s.aliases {
+		if err := s.ops.RemoveLoopbackAlias(ip); err != nil {
+			log.Errorf("unable to remove loopback alias %s: %s", ip, err)
+		}
+		delete(s.aliases, ip)
+	}
+}
@@ -0,0 +1,197 @@
+// Package router shares one local listener between forwards, connections are dispatched by the TLS SNI
+// of their ClientHello or the Host header of their first HTTP request.
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abdularis/kportfwd/internal/log"
+)
+
+// peekTimeout bounds how long a client has to send its ClientHello or request headers.
+const peekTimeout = time.Second * 10
+
+var errPeeked = errors.New("peeked")
+
+// Router dispatches connections to upstream addresses by host name.
+type Router struct {
+	name string
+	// peek reads the host name from the start of a connection.
+	peek func(r io.Reader) (string, error)
+	// reject answers connections with an unknown host name.
+	reject func(conn net.Conn, host string)
+
+	mu     sync.RWMutex
+	routes map[string]string
+}
+
+// NewSNI returns a router of TLS connections by ClientHello server name, TLS is passed through as is.
+func NewSNI() *Router {
+	return &Router{name: "sni", peek: peekServerName, reject: func(net.Conn, string) {}, routes: map[string]string{}}
+}
+
+// NewHost returns a router of plaintext HTTP/1.x connections by Host header of their first request.
+func NewHost() *Router {
+	return &Router{name: "host", peek: peekHost, reject: rejectHTTP, routes: map[string]string{}}
+}
+
+// Add routes connections for host to upstreamAddr.
+func (r *Router) Add(host, upstreamAddr string) error {
+	host = normalizeHost(host)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.routes[host]; ok {
+		return fmt.Errorf("host %s is already routed to %s", host, existing)
+	}
+	r.routes[host] = upstreamAddr
+	return nil
+}
+
+// Remove removes route of host.
+func (r *Router) Remove(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.routes, normalizeHost(host))
+}
+
+func (r *Router) route(host string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	upstreamAddr, ok := r.routes[normalizeHost(host)]
+	return upstreamAddr, ok
+}
+
+// Serve dispatches connections accepted on listener until ctx is done.
+func (r *Router) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go r.handle(ctx, conn)
+	}
+}
+
+func (r *Router) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// NOTE: Bytes read while peeking are kept and sent to upstream before the rest of the connection
+	peeked := &bytes.Buffer{}
+	_ = conn.SetReadDeadline(time.Now().Add(peekTimeout))
+	host, err := r.peek(io.TeeReader(conn, peeked))
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Debugf("%s router %s: %s", r.name, conn.RemoteAddr(), err)
+		return
+	}
+
+	upstreamAddr, ok := r.route(host)
+	if !ok {
+		log.Warnf("%s router: no forward for host %q", r.name, host)
+		r.reject(conn, host)
+		return
+	}
+
+	var dialer net.Dialer
+	upstream, err := dialer.DialContext(ctx, "tcp", upstreamAddr)
+	if err != nil {
+		log.Errorf("%s router: unable to connect to %s for host %s: %s", r.name, upstreamAddr, host, err)
+		return
+	}
+	defer upstream.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(upstream, io.MultiReader(peeked, conn))
+		_ = upstream.(*net.TCPConn).CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(conn, upstream)
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			_ = tcpConn.CloseWrite()
+		}
+	}()
+	wg.Wait()
+}
+
+// peekServerName reads a TLS ClientHello from r and returns its server name.
+func peekServerName(r io.Reader) (string, error) {
+	var serverName string
+	// NOTE: The handshake is aborted right after the ClientHello is parsed, nothing is written back
+	err := tls.Server(readOnlyConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errPeeked
+		},
+	}).Handshake()
+	if !errors.Is(err, errPeeked) {
+		return "", fmt.Errorf("unable to read tls client hello: %w", err)
+	}
+	if serverName == "" {
+		return "", fmt.Errorf("tls client hello without server name")
+	}
+	return serverName, nil
+}
+
+// peekHost reads HTTP request headers from r and returns the Host header.
+func peekHost(r io.Reader) (string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(r))
+	if err != nil {
+		return "", fmt.Errorf("unable to read http request: %w", err)
+	}
+	if req.Host == "" {
+		return "", fmt.Errorf("http request without host")
+	}
+	return req.Host, nil
+}
+
+func rejectHTTP(conn net.Conn, host string) {
+	body := fmt.Sprintf("kportfwd: no forward for host %s\n", host)
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 421 Misdirected Request\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+}
+
+// normalizeHost lowercases host and strips its port.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// readOnlyConn is a net.Conn reading from r, writes are discarded.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,89 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_peekServerName(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: "api.internal.svc"}).Handshake()
+	}()
+
+	serverName, err := peekServerName(server)
+	assert.NoError(t, err)
+	assert.Equal(t, "api.internal.svc", serverName)
+
+	_, err = peekServerName(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	assert.Error(t, err)
+}
+
+func Test_peekHost(t *testing.T) {
+	host, err := peekHost(strings.NewReader("GET /orders HTTP/1.1\r\nHost: Orders.internal.svc:80\r\n\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "orders.internal.svc", normalizeHost(host))
+
+	_, err = peekHost(strings.NewReader("GET / HTTP/1.0\r\n\r\n"))
+	assert.Error(t, err)
+}
+
+func Test_RouterServe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upstream := startEchoServer(t)
+	router := NewHost()
+	assert.NoError(t, router.Add("orders.internal.svc", upstream))
+	assert.Error(t, router.Add("ORDERS.internal.svc", upstream))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = router.Serve(ctx, listener) }()
+
+	// the request reaches upstream unchanged, including bytes read while peeking
+	request := "GET /orders HTTP/1.1\r\nHost: orders.internal.svc\r\n\r\n"
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	_, _ = io.WriteString(conn, request)
+	_ = conn.(*net.TCPConn).CloseWrite()
+	data, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, request, string(data))
+
+	conn, err = net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: unknown.svc\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+}
+
+// startEchoServer returns address of a server writing back whatever it reads on each connection.
+func startEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}